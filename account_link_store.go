@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"time"
+)
+
+// AccountLink pending move of the social account from the previous owner to the user
+type AccountLink struct {
+	UserID         int64
+	Service        ExternalService
+	ExternalID     string
+	Name           string
+	Link           string
+	PreviousUserID int64
+}
+
+// AccountLinkStore pending re-linkings waiting for the confirmation of the user
+type AccountLinkStore struct {
+	db     *sql.DB
+	ttl    time.Duration
+	logger *log.Logger
+	ticker *time.Ticker
+}
+
+// NewAccountLinkStore constructor
+func NewAccountLinkStore(db *sql.DB, ttl time.Duration) *AccountLinkStore {
+	s := &AccountLinkStore{
+		db:     db,
+		ttl:    ttl,
+		logger: log.New(os.Stderr, "[ACCOUNT-LINK-PG-ERROR]", log.LstdFlags),
+		ticker: time.NewTicker(10 * time.Minute),
+	}
+	go s.gc()
+	return s
+}
+
+func (s *AccountLinkStore) gc() {
+	for range s.ticker.C {
+		_, err := s.db.Exec("DELETE FROM account_links WHERE expires_at <= $1", time.Now())
+		if err != nil {
+			s.logger.Printf("Error while cleaning out outdated account links: %+v", err)
+		}
+	}
+}
+
+// Close Close
+func (s *AccountLinkStore) Close() error {
+	s.ticker.Stop()
+	return nil
+}
+
+// Put stores the pending link and returns the token of its confirmation
+func (s *AccountLinkStore) Put(link AccountLink) (string, error) {
+	token, err := randomBase64String(43)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO account_links (token_hash, user_id, service_id, external_id, name, link, previous_user_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`,
+		hashClientSecret(token), link.UserID, string(link.Service), link.ExternalID, link.Name, link.Link,
+		link.PreviousUserID, time.Now().Add(s.ttl),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Consume removes the pending link of the user and returns it, nil when missing or expired
+func (s *AccountLinkStore) Consume(token string, userID int64) (*AccountLink, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	link := AccountLink{}
+	var service string
+	err := s.db.QueryRow(`
+		DELETE FROM account_links
+		WHERE token_hash = $1 AND user_id = $2 AND expires_at > $3
+		RETURNING user_id, service_id, external_id, name, link, previous_user_id
+	`, hashClientSecret(token), userID, time.Now()).Scan(
+		&link.UserID, &service, &link.ExternalID, &link.Name, &link.Link, &link.PreviousUserID,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	link.Service = ExternalService(service)
+
+	return &link, nil
+}
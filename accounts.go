@@ -0,0 +1,240 @@
+package auth
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gin-gonic/gin"
+)
+
+// UserAccount social account linked to the user
+type UserAccount struct {
+	Service    ExternalService `json:"service"`
+	ExternalID string          `json:"external_id"`
+	Name       string          `json:"name"`
+	Link       string          `json:"link"`
+}
+
+// UserAccountResponse linked account, the last login method of the user can not be unlinked
+type UserAccountResponse struct {
+	UserAccount
+	CanUnlink bool `json:"can_unlink"`
+}
+
+type accountLinkConfirmRequest struct {
+	LinkToken string `form:"link_token" json:"link_token" binding:"required"`
+}
+
+func (s *Service) getUserAccounts(userID int64) ([]UserAccount, error) {
+	rows, err := s.usersDB.Query(`
+		SELECT service_id, external_id, name, link
+		FROM user_account
+		WHERE user_id = ?
+		ORDER BY service_id, external_id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer Close(rows)
+
+	accounts := make([]UserAccount, 0)
+	for rows.Next() {
+		var account UserAccount
+		err = rows.Scan(&account.Service, &account.ExternalID, &account.Name, &account.Link)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+
+	return accounts, rows.Err()
+}
+
+// loginMethods counts the password, the linked accounts and the passkeys of the user
+func (s *Service) loginMethods(userID int64, accounts int) (int, error) {
+	count := accounts
+
+	hash, err := s.userStore.GetPasswordHash(userID)
+	if err != nil {
+		return 0, err
+	}
+	if hash != "" {
+		count++
+	}
+
+	if s.webAuthnStore != nil {
+		credentials, err := s.webAuthnStore.GetByUser(userID)
+		if err != nil {
+			return 0, err
+		}
+		count += len(credentials)
+	}
+
+	return count, nil
+}
+
+func (s *Service) accountsInternalError(c *gin.Context, err error) {
+	log.Println("Accounts request failed:", err.Error())
+	sentry.CaptureException(err)
+	c.Status(http.StatusInternalServerError)
+}
+
+func (s *Service) handleAccounts(c *gin.Context) {
+	ti := s.userToken(c)
+	if ti == nil {
+		return
+	}
+
+	accounts, err := s.getUserAccounts(ti.GetUserID())
+	if err != nil {
+		s.accountsInternalError(c, err)
+		return
+	}
+
+	methods, err := s.loginMethods(ti.GetUserID(), len(accounts))
+	if err != nil {
+		s.accountsInternalError(c, err)
+		return
+	}
+
+	items := make([]UserAccountResponse, len(accounts))
+	for i, account := range accounts {
+		items[i] = UserAccountResponse{
+			UserAccount: account,
+			CanUnlink:   methods > 1,
+		}
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"items": items,
+	})
+}
+
+func (s *Service) handleAccountDelete(c *gin.Context) {
+	ti := s.userToken(c)
+	if ti == nil {
+		return
+	}
+
+	accounts, err := s.getUserAccounts(ti.GetUserID())
+	if err != nil {
+		s.accountsInternalError(c, err)
+		return
+	}
+
+	found := false
+	for _, account := range accounts {
+		if string(account.Service) == c.Param("service") && account.ExternalID == c.Param("external_id") {
+			found = true
+			break
+		}
+	}
+	if !found {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	methods, err := s.loginMethods(ti.GetUserID(), len(accounts))
+	if err != nil {
+		s.accountsInternalError(c, err)
+		return
+	}
+	if methods <= 1 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":             "last_login_method",
+			"error_description": "Set a password before unlinking the last account",
+		})
+		return
+	}
+
+	_, err = s.usersDB.Exec(
+		"DELETE FROM user_account WHERE user_id = ? AND service_id = ? AND external_id = ?",
+		ti.GetUserID(), c.Param("service"), c.Param("external_id"),
+	)
+	if err != nil {
+		s.accountsInternalError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// handleAccountLinkConfirm moves the account of the other user by the link_token of the account_conflict error
+func (s *Service) handleAccountLinkConfirm(c *gin.Context) {
+	ti := s.userToken(c)
+	if ti == nil {
+		return
+	}
+
+	var request accountLinkConfirmRequest
+	err := c.ShouldBind(&request)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	link, err := s.linkStore.Consume(request.LinkToken, ti.GetUserID())
+	if err != nil {
+		s.accountsInternalError(c, err)
+		return
+	}
+	if link == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             "invalid_token",
+			"error_description": "The link token is invalid or expired",
+		})
+		return
+	}
+
+	// the previous owner must keep the way to log in
+	previousAccounts, err := s.getUserAccounts(link.PreviousUserID)
+	if err != nil {
+		s.accountsInternalError(c, err)
+		return
+	}
+
+	methods, err := s.loginMethods(link.PreviousUserID, len(previousAccounts))
+	if err != nil {
+		s.accountsInternalError(c, err)
+		return
+	}
+	if methods <= 1 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":             "last_login_method",
+			"error_description": "The account is the only login method of its owner",
+		})
+		return
+	}
+
+	// conditioned on the previous owner, so the account changed since the conflict is not taken
+	res, err := s.usersDB.Exec(`
+		UPDATE user_account SET user_id = ?, used_for_reg = 0, name = ?, link = ?
+		WHERE service_id = ? AND external_id = ? AND user_id = ?
+	`, link.UserID, link.Name, link.Link, link.Service, link.ExternalID, link.PreviousUserID)
+	if err != nil {
+		s.accountsInternalError(c, err)
+		return
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		s.accountsInternalError(c, err)
+		return
+	}
+	if affected == 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":             "link_outdated",
+			"error_description": "The account was changed since the linking, try again",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, UserAccount{
+		Service:    link.Service,
+		ExternalID: link.ExternalID,
+		Name:       link.Name,
+		Link:       link.Link,
+	})
+}
@@ -0,0 +1,282 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/autowp/auth/oauth2server/errors"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+// sessionCookie the first-party session of the browser, started by the login page of the frontend
+const sessionCookie = "auth_session"
+
+const sessionAudience = "session"
+
+// consentParams the authorization request parameters kept by the consent form
+var consentParams = []string{
+	"response_type", "client_id", "redirect_uri", "scope", "state", "nonce", "code_challenge", "code_challenge_method",
+}
+
+var consentPageTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>Authorize {{.Client}}</title>
+</head>
+<body>
+	<h1>Authorize {{.Client}}</h1>
+	<p>{{.Client}} at {{.Host}} requests the access to your account{{if .Scopes}}: {{range $i, $s := .Scopes}}{{if $i}}, {{end}}{{$s}}{{end}}{{end}}</p>
+	<form method="post" action="{{.Action}}">
+		{{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+		{{end}}<input type="hidden" name="consent_token" value="{{.Token}}">
+		<button type="submit" name="consent" value="approve">Allow</button>
+		<button type="submit" name="consent" value="deny">Deny</button>
+	</form>
+</body>
+</html>
+`))
+
+// namedClient the client with the display name
+type namedClient interface {
+	GetName() string
+}
+
+func (s *Service) isFirstPartyClient(clientID string) bool {
+	for _, id := range s.config.OAuth.FirstPartyClients {
+		if id == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeIncluded checks that each of the requested scopes is granted
+func scopeIncluded(granted string, requested string) bool {
+	for _, scope := range strings.Fields(requested) {
+		if !hasScope(granted, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Service) sessionKey() []byte {
+	mac := hmac.New(sha256.New, s.config.OAuth.TokenHashSecret())
+	_, _ = mac.Write([]byte("session-cookie"))
+	return mac.Sum(nil)
+}
+
+// sessionUser the user of the session cookie, zero when it is missing, invalid or the session is revoked.
+// The cookie is bound to the token family of the first-party login, so it ends with that session
+func (s *Service) sessionUser(r *http.Request) (int64, string, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return 0, "", nil
+	}
+
+	claims := &jwt.StandardClaims{}
+	_, err = jwt.ParseWithClaims(cookie.Value, claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodHS256 {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return s.sessionKey(), nil
+	})
+	if err != nil || !claims.VerifyAudience(sessionAudience, true) || claims.Id == "" {
+		return 0, "", nil
+	}
+
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || userID <= 0 {
+		return 0, "", nil
+	}
+
+	active, err := s.tokenStore.IsSessionActive(userID, claims.Id)
+	if err != nil || !active {
+		return 0, "", err
+	}
+
+	return userID, claims.Id, nil
+}
+
+// consentToken binds the consent form to the session and the authorization request
+func (s *Service) consentToken(family string, r *http.Request) string {
+	mac := hmac.New(sha256.New, s.sessionKey())
+	_, _ = mac.Write([]byte("consent"))
+	for _, value := range []string{family, r.FormValue("client_id"), r.FormValue("redirect_uri"), r.FormValue("scope")} {
+		_, _ = mac.Write([]byte{0})
+		_, _ = mac.Write([]byte(value))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Service) redirectToLogin(w http.ResponseWriter, r *http.Request) error {
+	if s.config.OAuth.LoginURL == "" {
+		return errors.ErrAccessDenied
+	}
+
+	u, err := url.Parse(s.config.OAuth.LoginURL)
+	if err != nil {
+		return err
+	}
+
+	q := u.Query()
+	q.Set("return_to", r.URL.RequestURI())
+	u.RawQuery = q.Encode()
+
+	http.Redirect(w, r, u.String(), http.StatusFound)
+
+	return nil
+}
+
+func (s *Service) renderConsent(w http.ResponseWriter, r *http.Request, family string) error {
+	clientID := r.FormValue("client_id")
+	cli, err := s.oauthServer.Manager.GetClient(clientID)
+	if err != nil {
+		return err
+	}
+
+	name := clientID
+	if named, ok := cli.(namedClient); ok && named.GetName() != "" {
+		name = named.GetName()
+	}
+
+	redirectURI, err := url.Parse(r.FormValue("redirect_uri"))
+	if err != nil {
+		return err
+	}
+
+	params := make(map[string]string, len(consentParams))
+	for _, param := range consentParams {
+		if value := r.FormValue(param); value != "" {
+			params[param] = value
+		}
+	}
+
+	var buf bytes.Buffer
+	err = consentPageTemplate.Execute(&buf, gin.H{
+		"Client": name,
+		"Host":   redirectURI.Host,
+		"Scopes": strings.Fields(r.FormValue("scope")),
+		"Action": r.URL.Path,
+		"Params": params,
+		"Token":  s.consentToken(family, r),
+	})
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// authorizeUser authenticates the user of the authorization request by the first-party session cookie,
+// the other clients get the code only with the consent of the user.
+// The access token authorizes only the request of its own client within the granted scope
+func (s *Service) authorizeUser(w http.ResponseWriter, r *http.Request) (int64, error) {
+	clientID := r.FormValue("client_id")
+
+	if r.Header.Get("Authorization") != "" {
+		ti, err := s.oauthServer.ValidationBearerToken(r)
+		if err != nil || ti.GetUserID() == 0 {
+			return 0, errors.ErrAccessDenied
+		}
+		if ti.GetClientID() != clientID || !scopeIncluded(ti.GetScope(), r.FormValue("scope")) {
+			return 0, errors.ErrAccessDenied
+		}
+		return ti.GetUserID(), nil
+	}
+
+	userID, family, err := s.sessionUser(r)
+	if err != nil {
+		return 0, err
+	}
+	if userID == 0 {
+		return 0, s.redirectToLogin(w, r)
+	}
+
+	if s.isFirstPartyClient(clientID) {
+		return userID, nil
+	}
+
+	// the form is posted from the page of the server, so the cookie is sent with SameSite=Lax
+	if r.Method == http.MethodPost {
+		switch r.PostFormValue("consent") {
+		case "deny":
+			return 0, errors.ErrAccessDenied
+		case "approve":
+			token := r.PostFormValue("consent_token")
+			if !hmac.Equal([]byte(token), []byte(s.consentToken(family, r))) {
+				return 0, errors.ErrAccessDenied
+			}
+			return userID, nil
+		}
+	}
+
+	return 0, s.renderConsent(w, r, family)
+}
+
+// handleSessionStart starts the browser session of the user authorized by the first-party client
+func (s *Service) handleSessionStart(c *gin.Context) {
+	ti := s.userToken(c)
+	if ti == nil {
+		return
+	}
+
+	if ti.GetFamily() == "" {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":             "access_denied",
+			"error_description": "The token has no session",
+		})
+		return
+	}
+
+	claims := jwt.StandardClaims{
+		Audience: sessionAudience,
+		Subject:  strconv.FormatInt(ti.GetUserID(), 10),
+		Id:       ti.GetFamily(),
+	}
+	value, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.sessionKey())
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     "/api/oauth",
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	c.Status(http.StatusNoContent)
+}
+
+// handleSessionEnd removes the session cookie, the tokens of the session stay valid
+func (s *Service) handleSessionEnd(c *gin.Context) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/api/oauth",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,348 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/autowp/auth/oauth2server"
+	"github.com/autowp/auth/oauth2server/models"
+	"github.com/autowp/auth/oauth2server/store"
+)
+
+// StoredClient client registered in the database, the secret is kept hashed
+type StoredClient struct {
+	models.Client
+	SecretHash string
+	Disabled   bool
+	CreatedAt  time.Time
+	// TokenEndpointAuthMethod registered by the client itself, informational
+	TokenEndpointAuthMethod string
+	// RegistrationAccessTokenHash empty for the clients created by the admin
+	RegistrationAccessTokenHash string
+}
+
+// VerifyPassword VerifyPassword
+func (c *StoredClient) VerifyPassword(secret string) bool {
+	if c.Public {
+		return secret == ""
+	}
+	return subtle.ConstantTimeCompare([]byte(hashClientSecret(secret)), []byte(c.SecretHash)) == 1
+}
+
+// hashClientSecret the secrets and registration tokens are random and long, so the fast hash is enough
+func hashClientSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// ClientStore PostgreSQL client store.
+// Clients from the config take precedence over the registered ones
+type ClientStore struct {
+	db     *sql.DB
+	static *store.ClientStore
+}
+
+// NewClientStore constructor
+func NewClientStore(db *sql.DB, clients []models.Client) (*ClientStore, error) {
+	static := store.NewClientStore()
+	for i := range clients {
+		client := clients[i]
+		err := static.Set(client.ID, &client)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &ClientStore{
+		db:     db,
+		static: static,
+	}, nil
+}
+
+const clientColumns = `
+	id, name, secret_hash, public, domain, redirect_uris, grant_types, scopes,
+	access_token_expires_in, refresh_token_expires_in, disabled, created_at,
+	token_endpoint_auth_method, registration_access_token_hash
+`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanClient(row rowScanner) (*StoredClient, error) {
+	c := &StoredClient{}
+	var redirectURIs, grantTypes, scopes []byte
+
+	err := row.Scan(
+		&c.ID, &c.Name, &c.SecretHash, &c.Public, &c.Domain, &redirectURIs, &grantTypes, &scopes,
+		&c.AccessTokenExpiresIn, &c.RefreshTokenExpiresIn, &c.Disabled, &c.CreatedAt,
+		&c.TokenEndpointAuthMethod, &c.RegistrationAccessTokenHash,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, field := range []struct {
+		data []byte
+		dest *[]string
+	}{
+		{redirectURIs, &c.RedirectURIs},
+		{grantTypes, &c.GrantTypes},
+		{scopes, &c.Scopes},
+	} {
+		err = json.Unmarshal(field.data, field.dest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// GetByID returns the enabled client
+func (s *ClientStore) GetByID(id string) (oauth2server.ClientInfo, error) {
+	if cli, err := s.static.GetByID(id); err == nil {
+		return cli, nil
+	}
+
+	c, err := s.GetStored(id)
+	if err != nil || c == nil {
+		// the unknown client is the nil without the error, so the manager reports invalid_client
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// GetStored returns the enabled client registered in the database, nil when not found
+func (s *ClientStore) GetStored(id string) (*StoredClient, error) {
+	c, err := scanClient(s.db.QueryRow(
+		"SELECT "+clientColumns+" FROM clients WHERE id = $1 AND NOT disabled",
+		id,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// List all the registered clients
+func (s *ClientStore) List() ([]*StoredClient, error) {
+	rows, err := s.db.Query("SELECT " + clientColumns + " FROM clients ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	defer Close(rows)
+
+	result := make([]*StoredClient, 0)
+	for rows.Next() {
+		c, err := scanClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+
+	return result, rows.Err()
+}
+
+// NewRegistrationAccessToken returns the token and its hash for StoredClient.RegistrationAccessTokenHash
+func NewRegistrationAccessToken() (string, string, error) {
+	return newClientSecret(false)
+}
+
+// VerifyRegistrationAccessToken VerifyRegistrationAccessToken
+func (c *StoredClient) VerifyRegistrationAccessToken(token string) bool {
+	if c.RegistrationAccessTokenHash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashClientSecret(token)), []byte(c.RegistrationAccessTokenHash)) == 1
+}
+
+func newClientSecret(public bool) (string, string, error) {
+	if public {
+		return "", "", nil
+	}
+
+	secret, err := randomBase64String(43)
+	if err != nil {
+		return "", "", err
+	}
+
+	return secret, hashClientSecret(secret), nil
+}
+
+// Create registers the client and returns its secret, which is not stored and can't be shown again.
+// Random id is assigned when it is empty
+func (s *ClientStore) Create(c *StoredClient) (string, error) {
+	if c.ID == "" {
+		id, err := randomBase64String(22)
+		if err != nil {
+			return "", err
+		}
+		c.ID = id
+	}
+
+	if _, err := s.static.GetByID(c.ID); err == nil {
+		return "", fmt.Errorf("Client `%s` is defined in the config", c.ID)
+	}
+
+	for _, uri := range c.RedirectURIs {
+		err := validateRegisteredRedirectURI(uri)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	secret, secretHash, err := newClientSecret(c.Public)
+	if err != nil {
+		return "", err
+	}
+	c.SecretHash = secretHash
+	c.CreatedAt = time.Now()
+
+	redirectURIs, grantTypes, scopes, err := marshalClientLists(c)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = s.db.Exec(
+		`
+			INSERT INTO clients (
+				id, name, secret_hash, public, domain, redirect_uris, grant_types, scopes,
+				access_token_expires_in, refresh_token_expires_in, disabled, created_at,
+				token_endpoint_auth_method, registration_access_token_hash
+			)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		`,
+		c.ID, c.Name, c.SecretHash, c.Public, c.Domain, redirectURIs, grantTypes, scopes,
+		c.AccessTokenExpiresIn, c.RefreshTokenExpiresIn, c.Disabled, c.CreatedAt,
+		c.TokenEndpointAuthMethod, c.RegistrationAccessTokenHash,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+// UpdateMetadata updates the metadata of the registered client, secret and lifetimes are kept
+func (s *ClientStore) UpdateMetadata(c *StoredClient) error {
+	for _, uri := range c.RedirectURIs {
+		err := validateRegisteredRedirectURI(uri)
+		if err != nil {
+			return err
+		}
+	}
+
+	redirectURIs, grantTypes, scopes, err := marshalClientLists(c)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.Exec(
+		`
+			UPDATE clients
+			SET name = $1, domain = $2, redirect_uris = $3, grant_types = $4, scopes = $5,
+				token_endpoint_auth_method = $6
+			WHERE id = $7 AND NOT disabled
+		`,
+		c.Name, c.Domain, redirectURIs, grantTypes, scopes, c.TokenEndpointAuthMethod, c.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return requireAffected(res, c.ID)
+}
+
+func marshalClientLists(c *StoredClient) ([]byte, []byte, []byte, error) {
+	redirectURIs, err := json.Marshal(nonNilStrings(c.RedirectURIs))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	grantTypes, err := json.Marshal(nonNilStrings(c.GrantTypes))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	scopes, err := json.Marshal(nonNilStrings(c.Scopes))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return redirectURIs, grantTypes, scopes, nil
+}
+
+// RotateSecret replaces the secret of the confidential client, the old one stops working immediately
+func (s *ClientStore) RotateSecret(id string) (string, error) {
+	secret, secretHash, err := newClientSecret(false)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := s.db.Exec("UPDATE clients SET secret_hash = $1 WHERE id = $2 AND NOT public", secretHash, id)
+	if err != nil {
+		return "", err
+	}
+
+	err = requireAffected(res, id)
+	if err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+// Disable disables the client and revokes all the tokens issued to it
+func (s *ClientStore) Disable(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec("UPDATE clients SET disabled = TRUE WHERE id = $1", id)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = requireAffected(res, id)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM tokens WHERE client_id = $1", id)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func requireAffected(res sql.Result, id string) error {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return fmt.Errorf("Client `%s` not found", id)
+	}
+	return nil
+}
+
+func nonNilStrings(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
@@ -16,9 +16,34 @@ func main() {
 
 	config := auth.LoadConfig()
 
-	auth.ValidateConfig(config)
+	err := auth.ValidateConfig(config)
+	if err != nil {
+		log.Printf("Error: %v\n", err)
+		os.Exit(1)
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "client" {
+		err = clientCommand(config, os.Args[2:])
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "user" {
+		err = userCommand(config, os.Args[2:])
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+		return
+	}
 
-	err := sentry.Init(sentry.ClientOptions{
+	err = sentry.Init(sentry.ClientOptions{
 		Dsn:         config.Sentry.DSN,
 		Environment: config.Sentry.Environment,
 	})
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/autowp/auth"
+	"github.com/autowp/auth/oauth2server"
+)
+
+// stringsFlag repeatable string flag
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+const clientUsage = `Usage:
+  auth client create -name NAME [-id ID] [-public] [-domain URL] [-redirect-uri URI]... [-grant-type TYPE]... [-scope SCOPE]...
+  auth client list
+  auth client rotate-secret ID
+  auth client disable ID`
+
+func clientCommand(config auth.Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf(clientUsage)
+	}
+
+	db, err := sql.Open(config.OAuth.Driver, config.OAuth.DSN)
+	if err != nil {
+		return err
+	}
+	defer auth.Close(db)
+
+	store, err := auth.NewClientStore(db, config.OAuth.Clients)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "create":
+		return clientCreate(store, args[1:])
+	case "list":
+		return clientList(store)
+	case "rotate-secret":
+		if len(args) != 2 {
+			return fmt.Errorf(clientUsage)
+		}
+		secret, err := store.RotateSecret(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Secret: %s\n", secret)
+		return nil
+	case "disable":
+		if len(args) != 2 {
+			return fmt.Errorf(clientUsage)
+		}
+		return store.Disable(args[1])
+	}
+
+	return fmt.Errorf(clientUsage)
+}
+
+func clientCreate(store *auth.ClientStore, args []string) error {
+	fs := flag.NewFlagSet("client create", flag.ContinueOnError)
+
+	client := &auth.StoredClient{}
+	var redirectURIs, grantTypes, scopes stringsFlag
+
+	fs.StringVar(&client.ID, "id", "", "client id, random when empty")
+	fs.StringVar(&client.Name, "name", "", "client name")
+	fs.StringVar(&client.Domain, "domain", "", "client domain")
+	fs.BoolVar(&client.Public, "public", false, "public client without secret, PKCE is required")
+	fs.UintVar(&client.AccessTokenExpiresIn, "access-token-expires-in", 0, "access token lifetime in minutes")
+	fs.UintVar(&client.RefreshTokenExpiresIn, "refresh-token-expires-in", 0, "refresh token lifetime in minutes")
+	fs.Var(&redirectURIs, "redirect-uri", "registered redirect uri, repeatable")
+	fs.Var(&grantTypes, "grant-type", "allowed grant type, repeatable")
+	fs.Var(&scopes, "scope", "allowed scope, repeatable")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if client.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+
+	for _, gt := range grantTypes {
+		if oauth2server.GrantType(gt).String() == "" {
+			return fmt.Errorf("unknown grant type `%s`", gt)
+		}
+	}
+
+	client.RedirectURIs = redirectURIs
+	client.GrantTypes = grantTypes
+	client.Scopes = scopes
+
+	secret, err := store.Create(client)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("ID: %s\n", client.ID)
+	if !client.Public {
+		fmt.Printf("Secret: %s\n", secret)
+	}
+
+	return nil
+}
+
+func clientList(store *auth.ClientStore) error {
+	clients, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tTYPE\tSTATUS\tGRANT TYPES\tREDIRECT URIS")
+	for _, c := range clients {
+		clientType := "confidential"
+		if c.Public {
+			clientType = "public"
+		}
+		status := "active"
+		if c.Disabled {
+			status = "disabled"
+		}
+		fmt.Fprintf(
+			w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			c.ID, c.Name, clientType, status, strings.Join(c.GrantTypes, ","), strings.Join(c.RedirectURIs, " "),
+		)
+	}
+
+	return w.Flush()
+}
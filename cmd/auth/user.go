@@ -0,0 +1,47 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"github.com/autowp/auth"
+)
+
+const userUsage = `Usage:
+  auth user revoke-tokens USER_ID`
+
+func userCommand(config auth.Config, args []string) error {
+	if len(args) != 2 || args[0] != "revoke-tokens" {
+		return fmt.Errorf(userUsage)
+	}
+
+	userID, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || userID <= 0 {
+		return fmt.Errorf("invalid user id `%s`", args[1])
+	}
+
+	db, err := sql.Open(config.OAuth.Driver, config.OAuth.DSN)
+	if err != nil {
+		return err
+	}
+	defer auth.Close(db)
+
+	store, err := auth.NewTokenStore(
+		db,
+		auth.WithTokenStoreGCDisabled(),
+		auth.WithTokenStoreHashKey(config.OAuth.TokenHashSecret()),
+	)
+	if err != nil {
+		return err
+	}
+
+	err = store.RemoveByUser(userID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Tokens of the user %d are revoked\n", userID)
+
+	return nil
+}
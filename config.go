@@ -2,6 +2,7 @@ package auth
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/autowp/auth/oauth2server/models"
 	"github.com/spf13/viper"
@@ -19,30 +20,84 @@ type SentryConfig struct {
 	Environment string `yaml:"environment"`
 }
 
-// OAuthConfig OAuthConfig
+// JWTKeyConfig JWT signing key.
+// Keys are activated by not_before (RFC 3339), so it should be set for the key that replaces the previous one
+type JWTKeyConfig struct {
+	ID             string `yaml:"id"               mapstructure:"id"`
+	Algorithm      string `yaml:"algorithm"        mapstructure:"algorithm"`
+	PrivateKey     string `yaml:"private_key"      mapstructure:"private_key"`
+	PrivateKeyFile string `yaml:"private_key_file" mapstructure:"private_key_file"`
+	NotBefore      string `yaml:"not_before"       mapstructure:"not_before"`
+}
+
+// OAuthConfig OAuthConfig.
+// FirstPartyClients are the own frontends, they get the codes without the consent of the user
+// and only their tokens manage the account.
+// The requests without client credentials are authenticated as the public DefaultClient,
+// the confidential one is used only with LegacyDefaultClient as it exposes its secret to anyone
 type OAuthConfig struct {
-	Driver                string          `yaml:"driver"                     mapstructure:"driver"`
-	DSN                   string          `yaml:"dsn"                        mapstructure:"dsn"`
-	Secret                string          `yaml:"secret"                     mapstructure:"secret"`
-	UserStore             UserStoreConfig `yaml:"user_store"                 mapstructure:"user_store"`
-	Clients               []models.Client `yaml:"clients"                    mapstructure:"clients"`
-	AccessTokenExpiresIn  uint            `yaml:"access_token_expires_in"    mapstructure:"access_token_expires_in"`
-	RefreshTokenExpiresIn uint            `yaml:"refresh_token_expires_in"   mapstructure:"refresh_token_expires_in"`
+	Driver                 string             `yaml:"driver"                    mapstructure:"driver"`
+	DSN                    string             `yaml:"dsn"                       mapstructure:"dsn"`
+	Secret                 string             `yaml:"secret"                    mapstructure:"secret"`
+	Keys                   []JWTKeyConfig     `yaml:"keys"                      mapstructure:"keys"`
+	Issuer                 string             `yaml:"issuer"                    mapstructure:"issuer"`
+	LoginURL               string             `yaml:"login_url"                 mapstructure:"login_url"`
+	GrantTypes             []string           `yaml:"grant_types"               mapstructure:"grant_types"`
+	UserStore              UserStoreConfig    `yaml:"user_store"                mapstructure:"user_store"`
+	Clients                []models.Client    `yaml:"clients"                   mapstructure:"clients"`
+	DefaultClient          string             `yaml:"default_client"            mapstructure:"default_client"`
+	FirstPartyClients      []string           `yaml:"first_party_clients"       mapstructure:"first_party_clients"`
+	LegacyDefaultClient    bool               `yaml:"legacy_default_client"     mapstructure:"legacy_default_client"`
+	Registration           RegistrationConfig `yaml:"registration"              mapstructure:"registration"`
+	Throttle               ThrottleConfig     `yaml:"throttle"                  mapstructure:"throttle"`
+	MFA                    MFAConfig          `yaml:"mfa"                       mapstructure:"mfa"`
+	WebAuthn               WebAuthnConfig     `yaml:"webauthn"                  mapstructure:"webauthn"`
+	SignUp                 SignUpConfig       `yaml:"signup"                    mapstructure:"signup"`
+	EmailFlows             EmailFlowsConfig   `yaml:"email_flows"               mapstructure:"email_flows"`
+	AccessTokenExpiresIn   uint               `yaml:"access_token_expires_in"   mapstructure:"access_token_expires_in"`
+	RefreshTokenExpiresIn  uint               `yaml:"refresh_token_expires_in"  mapstructure:"refresh_token_expires_in"`
+	RefreshTokenReuseGrace uint               `yaml:"refresh_token_reuse_grace" mapstructure:"refresh_token_reuse_grace"`
+	TokenHashKey           string             `yaml:"token_hash_key"            mapstructure:"token_hash_key"`
 }
 
 // ServiceConfig ServiceConfig
 type ServiceConfig struct {
+	// Type of the provider, service id is used when empty
+	Type         string   `yaml:"type"          mapstructure:"type"`
 	ClientID     string   `yaml:"client_id"     mapstructure:"client_id"`
 	ClientSecret string   `yaml:"client_secret" mapstructure:"client_secret"`
 	Scopes       []string `yaml:"scopes"        mapstructure:"scopes"`
+	// Issuer enables discovery and id_token validation, explicit endpoints take precedence over discovered
+	Issuer      string              `yaml:"issuer"       mapstructure:"issuer"`
+	AuthURL     string              `yaml:"auth_url"     mapstructure:"auth_url"`
+	TokenURL    string              `yaml:"token_url"    mapstructure:"token_url"`
+	UserInfoURL string              `yaml:"userinfo_url" mapstructure:"userinfo_url"`
+	JWKSURL     string              `yaml:"jwks_url"     mapstructure:"jwks_url"`
+	Claims      ServiceClaimsConfig `yaml:"claims"       mapstructure:"claims"`
+}
+
+// ServiceClaimsConfig gjson paths of the profile fields in the id_token claims or userinfo response
+type ServiceClaimsConfig struct {
+	ID   string `yaml:"id"   mapstructure:"id"`
+	Name string `yaml:"name" mapstructure:"name"`
+	URL  string `yaml:"url"  mapstructure:"url"`
 }
 
 // ServicesConfig ...
 type ServicesConfig struct {
-	RedirectURI string        `yaml:"redirect_uri" mapstructure:"redirect_uri"`
-	Google      ServiceConfig `yaml:"google"       mapstructure:"google"`
-	Facebook    ServiceConfig `yaml:"facebook"     mapstructure:"facebook"`
-	VK          ServiceConfig `yaml:"vk"           mapstructure:"vk"`
+	RedirectURI string `yaml:"redirect_uri" mapstructure:"redirect_uri"`
+	// StateStore postgres or memory, memory works only with the single instance
+	StateStore string `yaml:"state_store" mapstructure:"state_store"`
+	// StateTTL lifetime of the login state in minutes
+	StateTTL uint `yaml:"state_ttl" mapstructure:"state_ttl"`
+	// LinkTTL lifetime of the pending confirmation of the account re-linking in minutes
+	LinkTTL uint `yaml:"link_ttl" mapstructure:"link_ttl"`
+	// Providers keyed by service id, stored in user_account.service_id
+	Providers map[string]ServiceConfig `yaml:"providers" mapstructure:"providers"`
+	// Google, Facebook and VK are deprecated, mapped to the providers of their services
+	Google   ServiceConfig `yaml:"google"   mapstructure:"google"`
+	Facebook ServiceConfig `yaml:"facebook" mapstructure:"facebook"`
+	VK       ServiceConfig `yaml:"vk"       mapstructure:"vk"`
 }
 
 // Config Application config definition
@@ -53,6 +108,9 @@ type Config struct {
 	OAuth      OAuthConfig      `yaml:"oauth"`
 	Hosts      []Host           `yaml:"hosts"`
 	Services   ServicesConfig   `yaml:"services"`
+	Mail       MailerConfig     `yaml:"mail"`
+	// TrustedProxies the reverse proxies allowed to pass the client address in X-Forwarded-For
+	TrustedProxies []string `yaml:"trusted_proxies" mapstructure:"trusted_proxies"`
 }
 
 // LoadConfig LoadConfig
@@ -83,6 +141,60 @@ func LoadConfig() Config {
 	return config
 }
 
+// TokenHashSecret the HMAC key of the stored token values
+func (c OAuthConfig) TokenHashSecret() []byte {
+	if c.TokenHashKey != "" {
+		return []byte(c.TokenHashKey)
+	}
+	return []byte(c.Secret)
+}
+
 // ValidateConfig ValidateConfig
-func ValidateConfig(config Config) {
+func ValidateConfig(config Config) error {
+	if len(config.Hosts) == 0 {
+		return fmt.Errorf("At least one host is required")
+	}
+
+	for _, host := range config.Hosts {
+		if host.Hostname == "" || strings.ContainsAny(host.Hostname, "/?#@") {
+			return fmt.Errorf("Invalid hostname `%s`", host.Hostname)
+		}
+	}
+
+	if config.OAuth.TokenHashKey == "" && config.OAuth.Secret == "" {
+		return fmt.Errorf("oauth.token_hash_key is required")
+	}
+
+	// the e-mail of the signed up user is confirmed by the e-mail flows only, so without them the user
+	// without the login could never sign in
+	if config.OAuth.SignUp.Enabled && !config.OAuth.EmailFlows.Enabled {
+		return fmt.Errorf("oauth.signup requires oauth.email_flows")
+	}
+
+	if config.OAuth.Registration.Enabled {
+		// the empty scopes of the client allow any scope
+		if len(config.OAuth.Registration.DefaultScopes) == 0 {
+			return fmt.Errorf("oauth.registration.default_scopes are required")
+		}
+		for _, scope := range config.OAuth.Registration.DefaultScopes {
+			if !registrableScope(config.OAuth.Registration, scope) {
+				return fmt.Errorf("Default scope `%s` is not in oauth.registration.scopes", scope)
+			}
+		}
+	}
+
+	for _, client := range config.OAuth.Clients {
+		if client.ID == "" {
+			return fmt.Errorf("Client id is required")
+		}
+
+		for _, uri := range client.RedirectURIs {
+			err := validateRegisteredRedirectURI(uri)
+			if err != nil {
+				return fmt.Errorf("Client `%s`: %v", client.ID, err)
+			}
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,414 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/getsentry/sentry-go"
+	"github.com/gin-gonic/gin"
+)
+
+// EmailFlowsConfig email verification and password reset, the mail must be configured.
+// URLs are the pages of the frontend with {hostname} and {token} placeholders, TTLs are in minutes.
+// Emails to the address are limited to MailLimit per MailWindow minutes, the window must not exceed the throttle one
+type EmailFlowsConfig struct {
+	Enabled         bool   `yaml:"enabled"          mapstructure:"enabled"`
+	VerificationURL string `yaml:"verification_url" mapstructure:"verification_url"`
+	VerificationTTL uint   `yaml:"verification_ttl" mapstructure:"verification_ttl"`
+	ResetURL        string `yaml:"reset_url"        mapstructure:"reset_url"`
+	ResetTTL        uint   `yaml:"reset_ttl"        mapstructure:"reset_ttl"`
+	MailLimit       uint   `yaml:"mail_limit"       mapstructure:"mail_limit"`
+	MailWindow      uint   `yaml:"mail_window"      mapstructure:"mail_window"`
+}
+
+const tokenPlaceholder = "{token}"
+
+// emailTokenClaims signed token of the emailed link, the audience is the mail template name.
+// Code is the email check code of the verification or the password fingerprint of the reset,
+// so the token becomes invalid once it is used
+type emailTokenClaims struct {
+	jwt.StandardClaims
+	Email string `json:"email"`
+	Code  string `json:"code"`
+}
+
+type emailVerificationRequest struct {
+	Email string `form:"email" json:"email" binding:"required"`
+}
+
+type emailConfirmRequest struct {
+	Token string `form:"token" json:"token" binding:"required"`
+}
+
+type passwordForgotRequest struct {
+	Email string `form:"email" json:"email" binding:"required"`
+}
+
+type passwordResetRequest struct {
+	Token    string `form:"token"    json:"token"    binding:"required"`
+	Password string `form:"password" json:"password" binding:"required"`
+}
+
+func (s *Service) emailTokenKey() []byte {
+	mac := hmac.New(sha256.New, s.config.OAuth.TokenHashSecret())
+	_, _ = mac.Write([]byte("email-token"))
+	return mac.Sum(nil)
+}
+
+// passwordFingerprint identifies the current password hash without revealing it
+func (s *Service) passwordFingerprint(hash string) string {
+	mac := hmac.New(sha256.New, s.emailTokenKey())
+	_, _ = mac.Write([]byte("password:" + hash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Service) signEmailToken(purpose string, userID int64, email, code string, ttl uint) (string, error) {
+	now := time.Now()
+	claims := emailTokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Audience:  purpose,
+			Subject:   strconv.FormatInt(userID, 10),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(time.Duration(ttl) * time.Minute).Unix(),
+		},
+		Email: email,
+		Code:  code,
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.emailTokenKey())
+}
+
+// parseEmailToken returns nil when the token is invalid, expired or issued for the other purpose
+func (s *Service) parseEmailToken(purpose string, token string) (int64, *emailTokenClaims) {
+	claims := &emailTokenClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodHS256 {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return s.emailTokenKey(), nil
+	})
+	if err != nil || !claims.VerifyAudience(purpose, true) || claims.Code == "" {
+		return 0, nil
+	}
+
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || userID <= 0 {
+		return 0, nil
+	}
+
+	return userID, claims
+}
+
+func newEmailCheckCode() (string, error) {
+	code := make([]byte, 16)
+	_, err := rand.Read(code)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(code), nil
+}
+
+// mailAllowed counts the email to the address, false when the limit is reached
+func (s *Service) mailAllowed(email string) (bool, error) {
+	limit := s.config.OAuth.EmailFlows.MailLimit
+	if limit == 0 {
+		return true, nil
+	}
+
+	window := time.Duration(s.config.OAuth.EmailFlows.MailWindow) * time.Minute
+	count, err := s.throttleStore.Fail("mail:"+strings.ToLower(email), window)
+	if err != nil {
+		return false, err
+	}
+
+	return count <= limit, nil
+}
+
+func (s *Service) sendEmailToken(host Host, template string, to string, name string, token string) error {
+	link := s.config.OAuth.EmailFlows.VerificationURL
+	if template == mailPasswordReset {
+		link = s.config.OAuth.EmailFlows.ResetURL
+	}
+	link = strings.Replace(link, hostnamePlaceholder, host.Hostname, -1)
+	link = strings.Replace(link, tokenPlaceholder, url.QueryEscape(token), -1)
+
+	message, err := renderMail(host.Language, template, to, MailData{
+		Name:     name,
+		Hostname: host.Hostname,
+		Link:     link,
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.mailer.Send(message)
+}
+
+// sendEmailVerification emails the confirmation link of the pending email with the code
+func (s *Service) sendEmailVerification(host Host, userID int64, name string, email string, code string) error {
+	token, err := s.signEmailToken(
+		mailEmailVerification, userID, email, code, s.config.OAuth.EmailFlows.VerificationTTL,
+	)
+	if err != nil {
+		return err
+	}
+
+	return s.sendEmailToken(host, mailEmailVerification, email, name, token)
+}
+
+func (s *Service) emailFlowsInternalError(c *gin.Context, err error) {
+	log.Println("Email flow failed:", err.Error())
+	sentry.CaptureException(err)
+	c.Status(http.StatusInternalServerError)
+}
+
+func invalidEmailToken(c *gin.Context) {
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error":             "invalid_token",
+		"error_description": "The link is invalid or expired",
+	})
+}
+
+// handleEmailVerification sets the pending email of the user and sends the confirmation link to it
+func (s *Service) handleEmailVerification(c *gin.Context) {
+	ti := s.userToken(c)
+	if ti == nil {
+		return
+	}
+
+	var request emailVerificationRequest
+	err := c.ShouldBind(&request)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	email := strings.TrimSpace(request.Email)
+	if e := validateEmail(email); e != nil {
+		s.signUpError(c, e)
+		return
+	}
+
+	user, err := s.userStore.GetUserByID(ti.GetUserID())
+	if err != nil {
+		s.emailFlowsInternalError(c, err)
+		return
+	}
+	if user == nil {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	taken, err := s.userStore.IsEmailTaken(email, user.ID)
+	if err != nil {
+		s.emailFlowsInternalError(c, err)
+		return
+	}
+	if taken {
+		s.signUpError(c, emailTakenError())
+		return
+	}
+
+	allowed, err := s.mailAllowed(email)
+	if err != nil {
+		s.emailFlowsInternalError(c, err)
+		return
+	}
+	if !allowed {
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error":             "too_many_emails",
+			"error_description": "Too many emails to this address, try again later",
+		})
+		return
+	}
+
+	code, err := newEmailCheckCode()
+	if err != nil {
+		s.emailFlowsInternalError(c, err)
+		return
+	}
+
+	err = s.userStore.SetEmailToCheck(user.ID, email, code)
+	if err != nil {
+		s.emailFlowsInternalError(c, err)
+		return
+	}
+
+	err = s.sendEmailVerification(s.requestHost(c), user.ID, user.Name, email, code)
+	if err != nil {
+		s.emailFlowsInternalError(c, err)
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+}
+
+func (s *Service) handleEmailConfirm(c *gin.Context) {
+	var request emailConfirmRequest
+	err := c.ShouldBind(&request)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userID, claims := s.parseEmailToken(mailEmailVerification, request.Token)
+	if claims == nil {
+		invalidEmailToken(c)
+		return
+	}
+
+	// the address may be confirmed by the other account since the link was sent
+	taken, err := s.userStore.IsEmailTaken(claims.Email, userID)
+	if err != nil {
+		s.emailFlowsInternalError(c, err)
+		return
+	}
+	if taken {
+		s.signUpError(c, emailTakenError())
+		return
+	}
+
+	confirmed, err := s.userStore.ConfirmEmail(userID, claims.Email, claims.Code)
+	if err != nil {
+		s.emailFlowsInternalError(c, err)
+		return
+	}
+	if !confirmed {
+		invalidEmailToken(c)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// sendPasswordReset emails the reset link when the user exists, errors are only logged
+func (s *Service) sendPasswordReset(host Host, email string) {
+	err := func() error {
+		user, err := s.userStore.GetUserByEmail(email)
+		if err != nil || user == nil || user.EMail == nil {
+			return err
+		}
+
+		allowed, err := s.mailAllowed(email)
+		if err != nil || !allowed {
+			return err
+		}
+
+		hash, err := s.userStore.GetPasswordHash(user.ID)
+		if err != nil {
+			return err
+		}
+
+		token, err := s.signEmailToken(
+			mailPasswordReset, user.ID, *user.EMail, s.passwordFingerprint(hash), s.config.OAuth.EmailFlows.ResetTTL,
+		)
+		if err != nil {
+			return err
+		}
+
+		return s.sendEmailToken(host, mailPasswordReset, email, user.Name, token)
+	}()
+	if err != nil {
+		log.Println("Failed to send password reset:", err.Error())
+		sentry.CaptureException(err)
+	}
+}
+
+// handlePasswordForgot always responds the same way, so the registered emails can not be enumerated
+func (s *Service) handlePasswordForgot(c *gin.Context) {
+	var request passwordForgotRequest
+	err := c.ShouldBind(&request)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	email := strings.TrimSpace(request.Email)
+	if _, err := mail.ParseAddress(email); err == nil {
+		go s.sendPasswordReset(s.requestHost(c), email)
+	}
+
+	c.Status(http.StatusAccepted)
+}
+
+// handlePasswordReset sets the new password and revokes all the tokens of the user
+func (s *Service) handlePasswordReset(c *gin.Context) {
+	var request passwordResetRequest
+	err := c.ShouldBind(&request)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userID, claims := s.parseEmailToken(mailPasswordReset, request.Token)
+	if claims == nil {
+		invalidEmailToken(c)
+		return
+	}
+
+	if e := s.validatePassword(request.Password); e != nil {
+		s.signUpError(c, e)
+		return
+	}
+
+	// the link sent to the address the user has changed since is not valid anymore
+	user, err := s.userStore.GetUserByID(userID)
+	if err != nil {
+		s.emailFlowsInternalError(c, err)
+		return
+	}
+	if user == nil || user.EMail == nil || *user.EMail != claims.Email {
+		invalidEmailToken(c)
+		return
+	}
+
+	hash, err := s.userStore.GetPasswordHash(userID)
+	if err != nil {
+		s.emailFlowsInternalError(c, err)
+		return
+	}
+	if !hmac.Equal([]byte(s.passwordFingerprint(hash)), []byte(claims.Code)) {
+		invalidEmailToken(c)
+		return
+	}
+
+	// conditioned on the old hash, so the concurrent use of the same link fails
+	reset, err := s.userStore.ResetPassword(userID, hash, request.Password)
+	if err != nil {
+		s.emailFlowsInternalError(c, err)
+		return
+	}
+	if !reset {
+		invalidEmailToken(c)
+		return
+	}
+
+	err = s.tokenStore.RemoveByUser(userID)
+	if err != nil {
+		s.emailFlowsInternalError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Service) setupEmailFlowsRoutes(apiGroup *gin.RouterGroup) {
+	if s.mailer == nil {
+		return
+	}
+
+	apiGroup.POST("/email/verify", s.handleEmailVerification)
+	apiGroup.POST("/email/confirm", s.handleEmailConfirm)
+	apiGroup.POST("/password/forgot", s.handlePasswordForgot)
+	apiGroup.POST("/password/reset", s.handlePasswordReset)
+}
@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errorPageTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>{{.Title}}</title>
+</head>
+<body>
+	<h1>{{.Title}}</h1>
+	<p>{{.Message}}</p>
+</body>
+</html>
+`))
+
+// renderErrorPage the page for the errors that can not be redirected back to the client
+func renderErrorPage(c *gin.Context, status int, message string) {
+	var buf bytes.Buffer
+	err := errorPageTemplate.Execute(&buf, gin.H{
+		"Title":   http.StatusText(status),
+		"Message": message,
+	})
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.Data(status, "text/html; charset=utf-8", buf.Bytes())
+}
@@ -3,7 +3,7 @@ package auth
 // ExternalService ...
 type ExternalService string
 
-// define authorization model
+// default identifiers of the bundled providers, stored in user_account.service_id
 const (
 	Google   ExternalService = "google-plus"
 	Facebook ExternalService = "facebook"
@@ -11,12 +11,7 @@ const (
 )
 
 func (gt ExternalService) String() string {
-	if gt == Google ||
-		gt == Facebook ||
-		gt == VK {
-		return string(gt)
-	}
-	return ""
+	return string(gt)
 }
 
 // UserInfo ...
@@ -25,22 +20,3 @@ type UserInfo struct {
 	Name string
 	URL  string
 }
-
-// FacebookUser ...
-type FacebookUser struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
-}
-
-// VKGetUsers ...
-type VKGetUsers struct {
-	Response []VKUser `json:"response"`
-}
-
-// VKUser ...
-type VKUser struct {
-	ID         int64  `json:"id"`
-	FirstName  string `json:"first_name"`
-	LastName   string `json:"last_name"`
-	ScreenName string `json:"screen_name"`
-}
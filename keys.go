@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/autowp/auth/oauth2server/generates"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+// NewJWTKeySet loads the signing keys.
+// The legacy secret becomes the HS512 key without kid, so the tokens issued before the rotation stay valid
+func NewJWTKeySet(config OAuthConfig) (*generates.JWTKeySet, error) {
+	keys := make([]*generates.JWTKey, 0)
+
+	if config.Secret != "" {
+		key, err := generates.NewJWTKey("", jwt.SigningMethodHS512, []byte(config.Secret), time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	for _, keyConfig := range config.Keys {
+		if keyConfig.ID == "" {
+			return nil, fmt.Errorf("Key id is required")
+		}
+
+		method := jwt.GetSigningMethod(keyConfig.Algorithm)
+		if method == nil {
+			return nil, fmt.Errorf("Key `%s`: unsupported algorithm `%s`", keyConfig.ID, keyConfig.Algorithm)
+		}
+
+		data := []byte(keyConfig.PrivateKey)
+		if keyConfig.PrivateKeyFile != "" {
+			var err error
+			data, err = ioutil.ReadFile(keyConfig.PrivateKeyFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var notBefore time.Time
+		if keyConfig.NotBefore != "" {
+			var err error
+			notBefore, err = time.Parse(time.RFC3339, keyConfig.NotBefore)
+			if err != nil {
+				return nil, fmt.Errorf("Key `%s`: %v", keyConfig.ID, err)
+			}
+		}
+
+		key, err := generates.NewJWTKey(keyConfig.ID, method, data, notBefore)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	// retired keys must outlive the longest access token
+	retention := time.Duration(config.AccessTokenExpiresIn) * time.Minute
+	for _, client := range config.Clients {
+		if exp := client.GetAccessTokenExp(); exp > retention {
+			retention = exp
+		}
+	}
+
+	return generates.NewJWTKeySet(retention, keys...)
+}
+
+func (s *Service) handleJWKS(c *gin.Context) {
+	set, err := generates.NewJWKSet(s.accessGenerate.Keys.PublishedKeys(time.Now()))
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age=3600")
+	c.JSON(http.StatusOK, set)
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+// Mail templates
+const (
+	mailEmailVerification = "email_verification"
+	mailPasswordReset     = "password_reset"
+)
+
+const mailDefaultLanguage = "en"
+
+// mailTexts subject and body templates by the host language
+var mailTexts = map[string]map[string][2]string{
+	"en": {
+		mailEmailVerification: {
+			"Confirm your email on {{.Hostname}}",
+			"Hello, {{.Name}}!\n\n" +
+				"To confirm the email of your account on {{.Hostname}} open the link:\n\n" +
+				"{{.Link}}\n\n" +
+				"If you did not request it, just ignore this email.\n",
+		},
+		mailPasswordReset: {
+			"Password recovery on {{.Hostname}}",
+			"Hello, {{.Name}}!\n\n" +
+				"Someone, probably you, requested the password reset of your account on {{.Hostname}}. " +
+				"To set a new password open the link:\n\n" +
+				"{{.Link}}\n\n" +
+				"If you did not request it, ignore this email and your password stays unchanged.\n",
+		},
+	},
+	"ru": {
+		mailEmailVerification: {
+			"Подтверждение e-mail на {{.Hostname}}",
+			"Здравствуйте, {{.Name}}!\n\n" +
+				"Чтобы подтвердить e-mail вашей учётной записи на {{.Hostname}}, перейдите по ссылке:\n\n" +
+				"{{.Link}}\n\n" +
+				"Если вы не запрашивали подтверждение, просто проигнорируйте это письмо.\n",
+		},
+		mailPasswordReset: {
+			"Восстановление пароля на {{.Hostname}}",
+			"Здравствуйте, {{.Name}}!\n\n" +
+				"Кто-то, вероятно вы, запросил сброс пароля вашей учётной записи на {{.Hostname}}. " +
+				"Чтобы задать новый пароль, перейдите по ссылке:\n\n" +
+				"{{.Link}}\n\n" +
+				"Если вы не запрашивали сброс, проигнорируйте это письмо, ваш пароль останется прежним.\n",
+		},
+	},
+	"uk": {
+		mailEmailVerification: {
+			"Підтвердження e-mail на {{.Hostname}}",
+			"Вітаємо, {{.Name}}!\n\n" +
+				"Щоб підтвердити e-mail вашого облікового запису на {{.Hostname}}, перейдіть за посиланням:\n\n" +
+				"{{.Link}}\n\n" +
+				"Якщо ви не запитували підтвердження, просто проігноруйте цей лист.\n",
+		},
+		mailPasswordReset: {
+			"Відновлення пароля на {{.Hostname}}",
+			"Вітаємо, {{.Name}}!\n\n" +
+				"Хтось, імовірно ви, запросив скидання пароля вашого облікового запису на {{.Hostname}}. " +
+				"Щоб встановити новий пароль, перейдіть за посиланням:\n\n" +
+				"{{.Link}}\n\n" +
+				"Якщо ви не запитували скидання, проігноруйте цей лист, ваш пароль залишиться без змін.\n",
+		},
+	},
+	"be": {
+		mailEmailVerification: {
+			"Пацверджанне e-mail на {{.Hostname}}",
+			"Вітаем, {{.Name}}!\n\n" +
+				"Каб пацвердзіць e-mail вашага ўліковага запісу на {{.Hostname}}, перайдзіце па спасылцы:\n\n" +
+				"{{.Link}}\n\n" +
+				"Калі вы не запытвалі пацверджанне, проста праігнаруйце гэты ліст.\n",
+		},
+		mailPasswordReset: {
+			"Аднаўленне пароля на {{.Hostname}}",
+			"Вітаем, {{.Name}}!\n\n" +
+				"Нехта, магчыма вы, запытаў скід пароля вашага ўліковага запісу на {{.Hostname}}. " +
+				"Каб задаць новы пароль, перайдзіце па спасылцы:\n\n" +
+				"{{.Link}}\n\n" +
+				"Калі вы не запытвалі скід, праігнаруйце гэты ліст, ваш пароль застанецца ранейшым.\n",
+		},
+	},
+	"fr": {
+		mailEmailVerification: {
+			"Confirmation de votre e-mail sur {{.Hostname}}",
+			"Bonjour {{.Name}},\n\n" +
+				"Pour confirmer l'adresse e-mail de votre compte sur {{.Hostname}}, ouvrez le lien :\n\n" +
+				"{{.Link}}\n\n" +
+				"Si vous n'êtes pas à l'origine de cette demande, ignorez cet e-mail.\n",
+		},
+		mailPasswordReset: {
+			"Réinitialisation du mot de passe sur {{.Hostname}}",
+			"Bonjour {{.Name}},\n\n" +
+				"Quelqu'un, probablement vous, a demandé la réinitialisation du mot de passe de votre compte sur {{.Hostname}}. " +
+				"Pour définir un nouveau mot de passe, ouvrez le lien :\n\n" +
+				"{{.Link}}\n\n" +
+				"Si vous n'êtes pas à l'origine de cette demande, ignorez cet e-mail, votre mot de passe reste inchangé.\n",
+		},
+	},
+	"pt-br": {
+		mailEmailVerification: {
+			"Confirmação de e-mail em {{.Hostname}}",
+			"Olá, {{.Name}}!\n\n" +
+				"Para confirmar o e-mail da sua conta em {{.Hostname}}, abra o link:\n\n" +
+				"{{.Link}}\n\n" +
+				"Se você não fez esta solicitação, ignore este e-mail.\n",
+		},
+		mailPasswordReset: {
+			"Recuperação de senha em {{.Hostname}}",
+			"Olá, {{.Name}}!\n\n" +
+				"Alguém, provavelmente você, solicitou a redefinição da senha da sua conta em {{.Hostname}}. " +
+				"Para definir uma nova senha, abra o link:\n\n" +
+				"{{.Link}}\n\n" +
+				"Se você não fez esta solicitação, ignore este e-mail, sua senha continuará a mesma.\n",
+		},
+	},
+	"zh": {
+		mailEmailVerification: {
+			"确认您在 {{.Hostname}} 的电子邮件",
+			"{{.Name}}，您好！\n\n" +
+				"要确认您在 {{.Hostname}} 的账户的电子邮件，请打开以下链接：\n\n" +
+				"{{.Link}}\n\n" +
+				"如果这不是您本人的请求，请忽略此邮件。\n",
+		},
+		mailPasswordReset: {
+			"{{.Hostname}} 密码找回",
+			"{{.Name}}，您好！\n\n" +
+				"有人（可能是您）请求重置您在 {{.Hostname}} 的账户的密码。要设置新密码，请打开以下链接：\n\n" +
+				"{{.Link}}\n\n" +
+				"如果这不是您本人的请求，请忽略此邮件，您的密码将保持不变。\n",
+		},
+	},
+}
+
+type mailTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+var mailTemplates = parseMailTemplates()
+
+func parseMailTemplates() map[string]map[string]mailTemplate {
+	result := make(map[string]map[string]mailTemplate, len(mailTexts))
+	for language, texts := range mailTexts {
+		result[language] = make(map[string]mailTemplate, len(texts))
+		for name, text := range texts {
+			prefix := language + "/" + name
+			result[language][name] = mailTemplate{
+				subject: template.Must(template.New(prefix + "/subject").Parse(text[0])),
+				body:    template.Must(template.New(prefix + "/body").Parse(text[1])),
+			}
+		}
+	}
+	return result
+}
+
+// MailData template variables
+type MailData struct {
+	Name     string
+	Hostname string
+	Link     string
+}
+
+// renderMail renders the template in the language, english is used for the missing ones
+func renderMail(language string, name string, to string, data MailData) (MailMessage, error) {
+	tpl, ok := mailTemplates[language][name]
+	if !ok {
+		tpl, ok = mailTemplates[mailDefaultLanguage][name]
+	}
+	if !ok {
+		return MailMessage{}, fmt.Errorf("mail template `%s` not found", name)
+	}
+
+	var subject, body bytes.Buffer
+
+	err := tpl.subject.Execute(&subject, data)
+	if err != nil {
+		return MailMessage{}, err
+	}
+
+	err = tpl.body.Execute(&body, data)
+	if err != nil {
+		return MailMessage{}, err
+	}
+
+	return MailMessage{
+		To:      to,
+		Subject: subject.String(),
+		Body:    body.String(),
+	}, nil
+}
@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MailerConfig outgoing mail, driver is smtp, file or log.
+// The file driver writes the messages to Dir, the log one prints them, both are for the development and tests
+type MailerConfig struct {
+	Driver   string `yaml:"driver"   mapstructure:"driver"`
+	From     string `yaml:"from"     mapstructure:"from"`
+	Host     string `yaml:"host"     mapstructure:"host"`
+	Port     uint   `yaml:"port"     mapstructure:"port"`
+	Username string `yaml:"username" mapstructure:"username"`
+	Password string `yaml:"password" mapstructure:"password"`
+	Dir      string `yaml:"dir"      mapstructure:"dir"`
+}
+
+// MailMessage plain text email
+type MailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends the emails
+type Mailer interface {
+	Send(message MailMessage) error
+}
+
+// NewMailer creates the mailer by the driver name
+func NewMailer(config MailerConfig) (Mailer, error) {
+	from, err := mail.ParseAddress(config.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mail sender `%s`: %v", config.From, err)
+	}
+
+	switch config.Driver {
+	case "smtp":
+		return NewSMTPMailer(from, config.Host, config.Port, config.Username, config.Password), nil
+	case "file":
+		return NewFileMailer(from, config.Dir), nil
+	case "log":
+		return NewLogMailer(from), nil
+	}
+
+	return nil, fmt.Errorf("unexpected mail driver `%s`", config.Driver)
+}
+
+// encode RFC 5322 message with the quoted-printable UTF-8 body
+func (m MailMessage) encode(from *mail.Address) ([]byte, error) {
+	var buf bytes.Buffer
+
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	domain := "localhost"
+	if at := strings.LastIndexByte(from.Address, '@'); at >= 0 {
+		domain = from.Address[at+1:]
+	}
+
+	headers := [][2]string{
+		{"From", from.String()},
+		{"To", m.To},
+		{"Subject", mime.QEncoding.Encode("utf-8", m.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", "<" + hex.EncodeToString(id) + "@" + domain + ">"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	}
+	for _, header := range headers {
+		buf.WriteString(header[0] + ": " + header[1] + "\r\n")
+	}
+	buf.WriteString("\r\n")
+
+	w := quotedprintable.NewWriter(&buf)
+	_, err = w.Write([]byte(m.Body))
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// SMTPMailer sends through the SMTP server, STARTTLS is used when the server supports it
+type SMTPMailer struct {
+	from *mail.Address
+	addr string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer constructor, authentication is skipped without the username
+func NewSMTPMailer(from *mail.Address, host string, port uint, username, password string) *SMTPMailer {
+	if port == 0 {
+		port = 25
+	}
+
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return &SMTPMailer{
+		from: from,
+		addr: net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10)),
+		auth: auth,
+	}
+}
+
+// Send Send
+func (m *SMTPMailer) Send(message MailMessage) error {
+	data, err := message.encode(m.from)
+	if err != nil {
+		return err
+	}
+
+	return smtp.SendMail(m.addr, m.auth, m.from.Address, []string{message.To}, data)
+}
+
+// FileMailer writes each message to the separate .eml file
+type FileMailer struct {
+	from *mail.Address
+	dir  string
+}
+
+// NewFileMailer constructor
+func NewFileMailer(from *mail.Address, dir string) *FileMailer {
+	return &FileMailer{
+		from: from,
+		dir:  dir,
+	}
+}
+
+// Send Send
+func (m *FileMailer) Send(message MailMessage) error {
+	data, err := message.encode(m.from)
+	if err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), hex.EncodeToString(suffix))
+
+	return ioutil.WriteFile(filepath.Join(m.dir, name), data, 0600)
+}
+
+// LogMailer prints the messages to the log
+type LogMailer struct {
+	from *mail.Address
+}
+
+// NewLogMailer constructor
+func NewLogMailer(from *mail.Address) *LogMailer {
+	return &LogMailer{
+		from: from,
+	}
+}
+
+// Send Send
+func (m *LogMailer) Send(message MailMessage) error {
+	log.Printf("Mail from %s to %s: %s\n%s", m.from.Address, message.To, message.Subject, message.Body)
+	return nil
+}
@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/autowp/auth/oauth2server/errors"
+	"github.com/getsentry/sentry-go"
+	"github.com/gin-gonic/gin"
+)
+
+// MFAConfig TOTP second factor of the password grant, disabled when the key is empty.
+// EncryptionKey is base64 encoded 32 bytes key of the stored TOTP secrets,
+// Issuer is shown in the authenticator app, TokenTTL is the mfa_token lifetime in minutes
+// and MaxAttempts limits the codes checked per mfa_token and the wrong codes of the user
+// before the lockout of the codes in the password grant and the MFA management
+type MFAConfig struct {
+	EncryptionKey string `yaml:"encryption_key" mapstructure:"encryption_key"`
+	Issuer        string `yaml:"issuer"         mapstructure:"issuer"`
+	TokenTTL      uint   `yaml:"token_ttl"      mapstructure:"token_ttl"`
+	MaxAttempts   uint   `yaml:"max_attempts"   mapstructure:"max_attempts"`
+}
+
+type otpRequest struct {
+	OTP string `form:"otp" json:"otp" binding:"required"`
+}
+
+func (s *Service) mfaInternalError(c *gin.Context, err error) {
+	log.Println("MFA failed:", err.Error())
+	sentry.CaptureException(err)
+	c.Status(http.StatusInternalServerError)
+}
+
+// verifiedUserID authorizes the request by the access token and checks the code of the enabled TOTP
+func (s *Service) verifiedUserID(c *gin.Context) int64 {
+	ti := s.userToken(c)
+	if ti == nil {
+		return 0
+	}
+
+	var request otpRequest
+	err := c.ShouldBind(&request)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return 0
+	}
+
+	// the access token alone must not allow guessing the code
+	err = s.throttle.CheckMFA(ti.GetUserID())
+	if le, ok := err.(*errors.LockedError); ok {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(le.RetryAfter.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error":             errors.ErrTooManyAttempts.Error(),
+			"error_description": errors.Descriptions[errors.ErrTooManyAttempts],
+		})
+		return 0
+	}
+	if err != nil {
+		s.mfaInternalError(c, err)
+		return 0
+	}
+
+	ok, err := s.mfaStore.Verify(ti.GetUserID(), request.OTP)
+	if err != nil {
+		s.mfaInternalError(c, err)
+		return 0
+	}
+
+	if !ok {
+		err = s.throttle.FailMFA(ti.GetUserID(), s.config.OAuth.MFA.MaxAttempts)
+		if err != nil {
+			s.mfaInternalError(c, err)
+			return 0
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_otp"})
+		return 0
+	}
+
+	err = s.throttle.SuccessMFA(ti.GetUserID())
+	if err != nil {
+		s.mfaInternalError(c, err)
+		return 0
+	}
+
+	return ti.GetUserID()
+}
+
+func (s *Service) handleMFA(c *gin.Context) {
+	ti := s.userToken(c)
+	if ti == nil {
+		return
+	}
+
+	enabled, err := s.mfaStore.IsEnabled(ti.GetUserID())
+	if err != nil {
+		s.mfaInternalError(c, err)
+		return
+	}
+
+	left, err := s.mfaStore.RecoveryCodesLeft(ti.GetUserID())
+	if err != nil {
+		s.mfaInternalError(c, err)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"totp":                enabled,
+		"recovery_codes_left": left,
+	})
+}
+
+func (s *Service) handleTOTPBegin(c *gin.Context) {
+	ti := s.userToken(c)
+	if ti == nil {
+		return
+	}
+
+	user, err := s.userStore.GetUserByID(ti.GetUserID())
+	if err != nil {
+		s.mfaInternalError(c, err)
+		return
+	}
+	if user == nil {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	account := strconv.FormatInt(user.ID, 10)
+	if user.Login != nil && *user.Login != "" {
+		account = *user.Login
+	} else if user.EMail != nil && *user.EMail != "" {
+		account = *user.EMail
+	}
+
+	secret, err := s.mfaStore.BeginTOTP(user.ID)
+	if err == ErrTOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "totp_enabled"})
+		return
+	}
+	if err != nil {
+		s.mfaInternalError(c, err)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"secret":           totpEncoding.EncodeToString(secret),
+		"provisioning_uri": totpProvisioningURI(s.config.OAuth.MFA.Issuer, account, secret),
+	})
+}
+
+func (s *Service) handleTOTPConfirm(c *gin.Context) {
+	ti := s.userToken(c)
+	if ti == nil {
+		return
+	}
+
+	var request otpRequest
+	err := c.ShouldBind(&request)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	codes, err := s.mfaStore.ConfirmTOTP(ti.GetUserID(), request.OTP)
+	if err == ErrTOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "totp_enabled"})
+		return
+	}
+	if err != nil {
+		s.mfaInternalError(c, err)
+		return
+	}
+
+	if codes == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_otp"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"recovery_codes": codes,
+	})
+}
+
+func (s *Service) handleTOTPDisable(c *gin.Context) {
+	userID := s.verifiedUserID(c)
+	if userID == 0 {
+		return
+	}
+
+	err := s.mfaStore.Disable(userID)
+	if err != nil {
+		s.mfaInternalError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Service) handleRecoveryCodes(c *gin.Context) {
+	userID := s.verifiedUserID(c)
+	if userID == 0 {
+		return
+	}
+
+	codes, err := s.mfaStore.RegenerateRecoveryCodes(userID)
+	if err != nil {
+		s.mfaInternalError(c, err)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"recovery_codes": codes,
+	})
+}
+
+func (s *Service) setupMFARoutes(apiGroup *gin.RouterGroup) {
+	if s.mfaStore == nil {
+		return
+	}
+
+	apiGroup.GET("/mfa", s.handleMFA)
+	apiGroup.POST("/mfa/totp", s.handleTOTPBegin)
+	apiGroup.POST("/mfa/totp/confirm", s.handleTOTPConfirm)
+	apiGroup.POST("/mfa/totp/disable", s.handleTOTPDisable)
+	apiGroup.POST("/mfa/recovery-codes", s.handleRecoveryCodes)
+}
@@ -0,0 +1,398 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const recoveryCodesCount = 10
+
+// ErrTOTPEnabled TOTP is already enabled for the user
+var ErrTOTPEnabled = fmt.Errorf("TOTP is already enabled")
+
+// MFAStore TOTP secrets, recovery codes and pending second factor logins of the users
+type MFAStore struct {
+	db          *sql.DB
+	aead        cipher.AEAD
+	tokenTTL    time.Duration
+	maxAttempts uint
+	logger      *log.Logger
+	ticker      *time.Ticker
+}
+
+// NewMFAStore constructor, the key is base64 encoded 32 bytes AES-256 key of the TOTP secrets
+func NewMFAStore(db *sql.DB, config MFAConfig) (*MFAStore, error) {
+	key, err := base64.StdEncoding.DecodeString(config.EncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mfa encryption key: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("mfa encryption key must be 32 bytes long")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &MFAStore{
+		db:          db,
+		aead:        aead,
+		tokenTTL:    time.Duration(config.TokenTTL) * time.Minute,
+		maxAttempts: config.MaxAttempts,
+		logger:      log.New(os.Stderr, "[MFA-PG-ERROR]", log.LstdFlags),
+		ticker:      time.NewTicker(10 * time.Minute),
+	}
+	go s.gc()
+
+	return s, nil
+}
+
+func (s *MFAStore) gc() {
+	for range s.ticker.C {
+		_, err := s.db.Exec("DELETE FROM mfa_tokens WHERE expires_at <= $1", time.Now())
+		if err != nil {
+			s.logger.Printf("Error while cleaning out outdated mfa tokens: %+v", err)
+		}
+	}
+}
+
+// Close Close
+func (s *MFAStore) Close() error {
+	s.ticker.Stop()
+	return nil
+}
+
+// secret is bound to the user, so the row can't be copied to another account
+func (s *MFAStore) encrypt(userID int64, secret []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.aead.Seal(nonce, nonce, secret, []byte(strconv.FormatInt(userID, 10))), nil
+}
+
+func (s *MFAStore) decrypt(userID int64, data []byte) ([]byte, error) {
+	size := s.aead.NonceSize()
+	if len(data) < size {
+		return nil, fmt.Errorf("encrypted TOTP secret is too short")
+	}
+
+	return s.aead.Open(nil, data[:size], data[size:], []byte(strconv.FormatInt(userID, 10)))
+}
+
+func (s *MFAStore) secret(userID int64) ([]byte, bool, error) {
+	var data []byte
+	var enabled bool
+	err := s.db.QueryRow("SELECT secret, enabled FROM user_totp WHERE user_id = $1", userID).Scan(&data, &enabled)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	secret, err := s.decrypt(userID, data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return secret, enabled, nil
+}
+
+// IsEnabled the user has confirmed TOTP
+func (s *MFAStore) IsEnabled(userID int64) (bool, error) {
+	var enabled bool
+	err := s.db.QueryRow("SELECT enabled FROM user_totp WHERE user_id = $1", userID).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// RecoveryCodesLeft count of the unused recovery codes
+func (s *MFAStore) RecoveryCodesLeft(userID int64) (int, error) {
+	var count int
+	err := s.db.QueryRow(
+		"SELECT COUNT(1) FROM user_recovery_codes WHERE user_id = $1 AND used_at IS NULL",
+		userID,
+	).Scan(&count)
+	return count, err
+}
+
+// BeginTOTP generates the new secret, it is not used until confirmed by the code
+func (s *MFAStore) BeginTOTP(userID int64) ([]byte, error) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := s.encrypt(userID, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.db.Exec(`
+		INSERT INTO user_totp (user_id, secret, enabled, last_counter, created_at) VALUES ($1, $2, false, 0, $3)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, created_at = EXCLUDED.created_at
+		WHERE NOT user_totp.enabled
+	`, userID, data, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	if affected <= 0 {
+		return nil, ErrTOTPEnabled
+	}
+
+	return secret, nil
+}
+
+// ConfirmTOTP enables TOTP when the code matches the pending secret and returns the new recovery codes
+func (s *MFAStore) ConfirmTOTP(userID int64, otp string) ([]string, error) {
+	secret, enabled, err := s.secret(userID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrTOTPEnabled
+	}
+	if secret == nil {
+		return nil, nil
+	}
+
+	counter, ok := validateTOTP(secret, otp, time.Now())
+	if !ok {
+		return nil, nil
+	}
+
+	res, err := s.db.Exec(
+		"UPDATE user_totp SET enabled = true, last_counter = $1 WHERE user_id = $2 AND NOT enabled",
+		counter, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if affected <= 0 {
+		return nil, ErrTOTPEnabled
+	}
+
+	return s.RegenerateRecoveryCodes(userID)
+}
+
+// Verify checks the TOTP code or the recovery code. Each code is accepted only once
+func (s *MFAStore) Verify(userID int64, otp string) (bool, error) {
+	secret, enabled, err := s.secret(userID)
+	if err != nil || !enabled {
+		return false, err
+	}
+
+	counter, ok := validateTOTP(secret, otp, time.Now())
+	if !ok {
+		return s.useRecoveryCode(userID, otp)
+	}
+
+	res, err := s.db.Exec(
+		"UPDATE user_totp SET last_counter = $1 WHERE user_id = $2 AND enabled AND last_counter < $1",
+		counter, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+// Disable removes TOTP and the recovery codes of the user
+func (s *MFAStore) Disable(userID int64) error {
+	_, err := s.db.Exec("DELETE FROM user_recovery_codes WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec("DELETE FROM user_totp WHERE user_id = $1", userID)
+	return err
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user, only hashes are stored
+func (s *MFAStore) RegenerateRecoveryCodes(userID int64) ([]string, error) {
+	codes := make([]string, recoveryCodesCount)
+	for i := range codes {
+		buf := make([]byte, 5)
+		_, err := rand.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(buf))
+		codes[i] = code[:4] + "-" + code[4:]
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("DELETE FROM user_recovery_codes WHERE user_id = $1", userID)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	for _, code := range codes {
+		_, err = tx.Exec(
+			"INSERT INTO user_recovery_codes (user_id, code_hash) VALUES ($1, $2)",
+			userID, hashClientSecret(normalizeRecoveryCode(code)),
+		)
+		if err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+func (s *MFAStore) useRecoveryCode(userID int64, code string) (bool, error) {
+	code = normalizeRecoveryCode(code)
+	if code == "" {
+		return false, nil
+	}
+
+	res, err := s.db.Exec(
+		"UPDATE user_recovery_codes SET used_at = $1 WHERE user_id = $2 AND code_hash = $3 AND used_at IS NULL",
+		time.Now(), userID, hashClientSecret(code),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+// NewToken starts the second factor login of the user, returned token is exchanged with the code
+func (s *MFAStore) NewToken(userID int64) (string, error) {
+	token, err := randomBase64String(43)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = s.db.Exec(
+		"INSERT INTO mfa_tokens (token_hash, user_id, expires_at, attempts) VALUES ($1, $2, $3, 0)",
+		hashClientSecret(token), userID, time.Now().Add(s.tokenTTL),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// TokenUser returns the user of the not expired token, zero otherwise
+func (s *MFAStore) TokenUser(token string) (int64, error) {
+	if token == "" {
+		return 0, nil
+	}
+
+	var userID int64
+	err := s.db.QueryRow(
+		"SELECT user_id FROM mfa_tokens WHERE token_hash = $1 AND expires_at > $2",
+		hashClientSecret(token), time.Now(),
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return userID, err
+}
+
+// ConsumeToken returns the user of the token when the code is valid, zero otherwise.
+// Token is deleted on success or when its attempts are exhausted
+func (s *MFAStore) ConsumeToken(token string, otp string) (int64, error) {
+	if token == "" || otp == "" {
+		return 0, nil
+	}
+
+	tokenHash := hashClientSecret(token)
+
+	// counting the attempt before the check limits the guessing of the code
+	var userID int64
+	var attempts uint
+	err := s.db.QueryRow(
+		"UPDATE mfa_tokens SET attempts = attempts + 1 WHERE token_hash = $1 AND expires_at > $2 RETURNING user_id, attempts",
+		tokenHash, time.Now(),
+	).Scan(&userID, &attempts)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if attempts > s.maxAttempts {
+		_, err = s.db.Exec("DELETE FROM mfa_tokens WHERE token_hash = $1", tokenHash)
+		return 0, err
+	}
+
+	ok, err := s.Verify(userID, otp)
+	if err != nil || !ok {
+		return 0, err
+	}
+
+	// DELETE guarantees that only one of the concurrent requests succeeds
+	res, err := s.db.Exec("DELETE FROM mfa_tokens WHERE token_hash = $1", tokenHash)
+	if err != nil {
+		return 0, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil || affected <= 0 {
+		return 0, err
+	}
+
+	return userID, nil
+}
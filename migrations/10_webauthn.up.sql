@@ -0,0 +1,24 @@
+CREATE TABLE webauthn_credentials (
+  id           BYTEA       NOT NULL,
+  user_id      BIGINT      NOT NULL,
+  name         TEXT        NOT NULL,
+  public_key   BYTEA       NOT NULL,
+  sign_count   BIGINT      NOT NULL,
+  aaguid       BYTEA       NOT NULL,
+  created_at   TIMESTAMPTZ NOT NULL,
+  last_used_at TIMESTAMPTZ NULL,
+  CONSTRAINT webauthn_credentials_pkey PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_user_id ON webauthn_credentials (user_id);
+
+CREATE TABLE webauthn_challenges (
+  id         TEXT        NOT NULL,
+  purpose    TEXT        NOT NULL,
+  user_id    BIGINT      NOT NULL,
+  challenge  BYTEA       NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL,
+  CONSTRAINT webauthn_challenges_pkey PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_webauthn_challenges_expires_at ON webauthn_challenges (expires_at);
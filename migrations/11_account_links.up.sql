@@ -0,0 +1,13 @@
+CREATE TABLE account_links (
+  token_hash       TEXT        NOT NULL,
+  user_id          BIGINT      NOT NULL,
+  service_id       TEXT        NOT NULL,
+  external_id      TEXT        NOT NULL,
+  name             TEXT        NOT NULL,
+  link             TEXT        NOT NULL,
+  previous_user_id BIGINT      NOT NULL,
+  expires_at       TIMESTAMPTZ NOT NULL,
+  CONSTRAINT account_links_pkey PRIMARY KEY (token_hash)
+);
+
+CREATE INDEX IF NOT EXISTS idx_account_links_expires_at ON account_links (expires_at);
@@ -0,0 +1,8 @@
+CREATE TABLE states (
+  id         TEXT        NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL,
+  data       JSONB       NOT NULL,
+  CONSTRAINT states_pkey PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_states_expires_at ON states (expires_at);
@@ -0,0 +1,15 @@
+CREATE TABLE clients (
+  id                       TEXT        NOT NULL,
+  name                     TEXT        NOT NULL,
+  secret_hash              TEXT        NOT NULL DEFAULT '',
+  public                   BOOLEAN     NOT NULL DEFAULT FALSE,
+  domain                   TEXT        NOT NULL DEFAULT '',
+  redirect_uris            JSONB       NOT NULL DEFAULT '[]',
+  grant_types              JSONB       NOT NULL DEFAULT '[]',
+  scopes                   JSONB       NOT NULL DEFAULT '[]',
+  access_token_expires_in  INTEGER     NOT NULL DEFAULT 0,
+  refresh_token_expires_in INTEGER     NOT NULL DEFAULT 0,
+  disabled                 BOOLEAN     NOT NULL DEFAULT FALSE,
+  created_at               TIMESTAMPTZ NOT NULL,
+  CONSTRAINT clients_pkey PRIMARY KEY (id)
+);
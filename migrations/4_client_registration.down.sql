@@ -0,0 +1,3 @@
+ALTER TABLE clients
+  DROP COLUMN token_endpoint_auth_method,
+  DROP COLUMN registration_access_token_hash;
@@ -0,0 +1,3 @@
+ALTER TABLE clients
+  ADD COLUMN token_endpoint_auth_method     TEXT NOT NULL DEFAULT '',
+  ADD COLUMN registration_access_token_hash TEXT NOT NULL DEFAULT '';
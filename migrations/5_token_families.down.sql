@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_tokens_family;
+
+ALTER TABLE tokens
+  DROP COLUMN family,
+  DROP COLUMN rotated_at;
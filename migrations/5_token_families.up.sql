@@ -0,0 +1,5 @@
+ALTER TABLE tokens
+  ADD COLUMN family     TEXT        NOT NULL DEFAULT '',
+  ADD COLUMN rotated_at TIMESTAMPTZ NULL;
+
+CREATE INDEX IF NOT EXISTS idx_tokens_family ON tokens (family);
@@ -0,0 +1,4 @@
+-- hashed tokens can't be restored
+DELETE FROM tokens WHERE hashed;
+
+ALTER TABLE tokens DROP COLUMN hashed;
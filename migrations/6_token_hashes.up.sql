@@ -0,0 +1,3 @@
+-- code, access and refresh hold HMAC-SHA256 hex of the values since now.
+-- Existing rows are hashed by the service on startup, it's the only place that knows the key
+ALTER TABLE tokens ADD COLUMN hashed BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_tokens_user_id;
+
+ALTER TABLE tokens
+  DROP COLUMN user_id,
+  DROP COLUMN client_id,
+  DROP COLUMN ip,
+  DROP COLUMN user_agent;
@@ -0,0 +1,12 @@
+ALTER TABLE tokens
+  ADD COLUMN user_id    BIGINT NOT NULL DEFAULT 0,
+  ADD COLUMN client_id  TEXT   NOT NULL DEFAULT '',
+  ADD COLUMN ip         TEXT   NOT NULL DEFAULT '',
+  ADD COLUMN user_agent TEXT   NOT NULL DEFAULT '';
+
+UPDATE tokens SET user_id = COALESCE((data->>'UserID')::BIGINT, 0), client_id = COALESCE(data->>'ClientID', '');
+
+-- every refresh token is the session
+UPDATE tokens SET family = 'legacy-' || id WHERE family = '' AND refresh <> '';
+
+CREATE INDEX IF NOT EXISTS idx_tokens_user_id ON tokens (user_id);
@@ -0,0 +1,9 @@
+CREATE TABLE login_attempts (
+  key          TEXT        NOT NULL,
+  failures     INTEGER     NOT NULL,
+  failed_at    TIMESTAMPTZ NOT NULL,
+  locked_until TIMESTAMPTZ NULL,
+  CONSTRAINT login_attempts_pkey PRIMARY KEY (key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_attempts_failed_at ON login_attempts (failed_at);
@@ -0,0 +1,25 @@
+CREATE TABLE user_totp (
+  user_id      BIGINT      NOT NULL,
+  secret       BYTEA       NOT NULL,
+  enabled      BOOLEAN     NOT NULL,
+  last_counter BIGINT      NOT NULL,
+  created_at   TIMESTAMPTZ NOT NULL,
+  CONSTRAINT user_totp_pkey PRIMARY KEY (user_id)
+);
+
+CREATE TABLE user_recovery_codes (
+  user_id   BIGINT      NOT NULL,
+  code_hash TEXT        NOT NULL,
+  used_at   TIMESTAMPTZ NULL,
+  CONSTRAINT user_recovery_codes_pkey PRIMARY KEY (user_id, code_hash)
+);
+
+CREATE TABLE mfa_tokens (
+  token_hash TEXT        NOT NULL,
+  user_id    BIGINT      NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL,
+  attempts   INTEGER     NOT NULL,
+  CONSTRAINT mfa_tokens_pkey PRIMARY KEY (token_hash)
+);
+
+CREATE INDEX IF NOT EXISTS idx_mfa_tokens_expires_at ON mfa_tokens (expires_at);
@@ -1,15 +1,23 @@
 package oauth2server
 
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+)
+
 // ResponseType the type of authorization request
 type ResponseType string
 
 // define the type of authorization request
 const (
+	Code  ResponseType = "code"
 	Token ResponseType = "token"
 )
 
 func (rt ResponseType) String() string {
-	if rt == Token {
+	if rt == Code ||
+		rt == Token {
 		return string(rt)
 	}
 	return ""
@@ -20,16 +28,72 @@ type GrantType string
 
 // define authorization model
 const (
+	AuthorizationCode       GrantType = "authorization_code"
 	PasswordCredentials     GrantType = "password"
+	ClientCredentials       GrantType = "client_credentials"
 	Refreshing              GrantType = "refresh_token"
 	SocialAuthorizationCode GrantType = "social_authorization_code"
+	WebAuthn                GrantType = "webauthn"
 )
 
 func (gt GrantType) String() string {
-	if gt == PasswordCredentials ||
+	if gt == AuthorizationCode ||
+		gt == PasswordCredentials ||
+		gt == ClientCredentials ||
 		gt == SocialAuthorizationCode ||
+		gt == WebAuthn ||
 		gt == Refreshing {
 		return string(gt)
 	}
 	return ""
 }
+
+// TokenTypeHint the type of the token submitted for revocation or introspection
+// https://tools.ietf.org/html/rfc7009#section-2.1
+type TokenTypeHint string
+
+// define the token type hints
+const (
+	AccessTokenHint  TokenTypeHint = "access_token"
+	RefreshTokenHint TokenTypeHint = "refresh_token"
+)
+
+func (tth TokenTypeHint) String() string {
+	if tth == AccessTokenHint ||
+		tth == RefreshTokenHint {
+		return string(tth)
+	}
+	return ""
+}
+
+// CodeChallengeMethod PKCE method
+// https://tools.ietf.org/html/rfc7636#section-4.2
+type CodeChallengeMethod string
+
+// define the PKCE methods
+const (
+	CodeChallengePlain CodeChallengeMethod = "plain"
+	CodeChallengeS256  CodeChallengeMethod = "S256"
+)
+
+func (ccm CodeChallengeMethod) String() string {
+	if ccm == CodeChallengePlain ||
+		ccm == CodeChallengeS256 {
+		return string(ccm)
+	}
+	return ""
+}
+
+// Validate check the code verifier against the code challenge
+func (ccm CodeChallengeMethod) Validate(cc, ver string) bool {
+	switch ccm {
+	case CodeChallengePlain:
+		return subtle.ConstantTimeCompare([]byte(cc), []byte(ver)) == 1
+	case CodeChallengeS256:
+		s256 := sha256.Sum256([]byte(ver))
+		a := base64.RawURLEncoding.EncodeToString(s256[:])
+		return subtle.ConstantTimeCompare([]byte(cc), []byte(a)) == 1
+	default:
+		return false
+	}
+}
@@ -4,8 +4,14 @@ import "errors"
 
 // known errors
 var (
-	ErrInvalidAccessToken  = errors.New("invalid access token")
-	ErrInvalidRefreshToken = errors.New("invalid refresh token")
-	ErrExpiredAccessToken  = errors.New("expired access token")
-	ErrExpiredRefreshToken = errors.New("expired refresh token")
+	ErrInvalidRedirectURI   = errors.New("invalid redirect uri")
+	ErrInvalidAuthorizeCode = errors.New("invalid authorize code")
+	ErrInvalidAccessToken   = errors.New("invalid access token")
+	ErrInvalidRefreshToken  = errors.New("invalid refresh token")
+	ErrExpiredAccessToken   = errors.New("expired access token")
+	ErrExpiredRefreshToken  = errors.New("expired refresh token")
+	ErrMissingCodeVerifier  = errors.New("missing code verifier")
+	ErrMissingCodeChallenge = errors.New("missing code challenge")
+	ErrInvalidCodeChallenge = errors.New("invalid code challenge")
+	ErrUnsupportedByStore   = errors.New("unsupported by the token store")
 )
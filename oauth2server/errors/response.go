@@ -3,6 +3,7 @@ package errors
 import (
 	"errors"
 	"net/http"
+	"time"
 )
 
 // Response error response
@@ -13,6 +14,8 @@ type Response struct {
 	URI         string
 	StatusCode  int
 	Header      http.Header
+	// Fields extension fields of the error response
+	Fields map[string]interface{}
 }
 
 // https://tools.ietf.org/html/rfc6749#section-5.2
@@ -27,8 +30,54 @@ var (
 	ErrInvalidClient           = errors.New("invalid_client")
 	ErrInvalidGrant            = errors.New("invalid_grant")
 	ErrUnsupportedGrantType    = errors.New("unsupported_grant_type")
+
+	// https://tools.ietf.org/html/rfc7009#section-2.2.1
+	ErrUnsupportedTokenType = errors.New("unsupported_token_type")
+
+	// https://tools.ietf.org/html/rfc7636#section-4.4.1
+	ErrCodeChallengeRequired          = errors.New("invalid_request")
+	ErrUnsupportedCodeChallengeMethod = errors.New("invalid_request")
+	ErrInvalidCodeChallengeLen        = errors.New("invalid_request")
+
+	// too many failed attempts, see LockedError
+	ErrTooManyAttempts = errors.New("too_many_attempts")
+
+	// second factor is required, see MFARequiredError
+	ErrMFARequired = errors.New("mfa_required")
+
+	// social account belongs to the other user, see AccountConflictError
+	ErrAccountConflict = errors.New("account_conflict")
 )
 
+// MFARequiredError the password is correct, but the user has to pass the second factor.
+// Token is exchanged with the one-time password in the next password grant request
+type MFARequiredError struct {
+	Token string
+}
+
+func (e *MFARequiredError) Error() string {
+	return ErrMFARequired.Error()
+}
+
+// AccountConflictError the linked social account belongs to the other user.
+// Token confirms moving the account to the current user
+type AccountConflictError struct {
+	Token string
+}
+
+func (e *AccountConflictError) Error() string {
+	return ErrAccountConflict.Error()
+}
+
+// LockedError the credentials are temporarily locked after the failed attempts
+type LockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockedError) Error() string {
+	return ErrTooManyAttempts.Error()
+}
+
 // Descriptions error description
 var Descriptions = map[error]string{
 	ErrInvalidRequest:          "The request is missing a required parameter, includes an invalid parameter value, includes a parameter more than once, or is otherwise malformed",
@@ -41,6 +90,16 @@ var Descriptions = map[error]string{
 	ErrInvalidClient:           "Client authentication failed",
 	ErrInvalidGrant:            "The provided authorization grant (e.g., authorization code, resource owner credentials) or refresh token is invalid, expired, revoked, does not match the redirection URI used in the authorization request, or was issued to another client",
 	ErrUnsupportedGrantType:    "The authorization grant type is not supported by the authorization server",
+
+	ErrUnsupportedTokenType: "The authorization server does not support the revocation of the presented token type",
+
+	ErrCodeChallengeRequired:          "PKCE is required. code_challenge is missing",
+	ErrUnsupportedCodeChallengeMethod: "Selected code_challenge_method not supported",
+	ErrInvalidCodeChallengeLen:        "Code challenge length must be between 43 and 128 characters long",
+
+	ErrTooManyAttempts: "Too many failed attempts, try again later",
+	ErrMFARequired:     "Multi-factor authentication is required",
+	ErrAccountConflict: "The account is linked to another user, confirm the re-linking",
 }
 
 // StatusCodes response error HTTP status code
@@ -55,4 +114,14 @@ var StatusCodes = map[error]int{
 	ErrInvalidClient:           http.StatusUnauthorized,
 	ErrInvalidGrant:            http.StatusUnauthorized,
 	ErrUnsupportedGrantType:    http.StatusUnauthorized,
+
+	ErrUnsupportedTokenType: http.StatusBadRequest,
+
+	ErrCodeChallengeRequired:          http.StatusBadRequest,
+	ErrUnsupportedCodeChallengeMethod: http.StatusBadRequest,
+	ErrInvalidCodeChallengeLen:        http.StatusBadRequest,
+
+	ErrTooManyAttempts: http.StatusTooManyRequests,
+	ErrMFARequired:     http.StatusForbidden,
+	ErrAccountConflict: http.StatusConflict,
 }
@@ -2,21 +2,41 @@ package oauth2server
 
 import (
 	"net/http"
+	"strconv"
 	"time"
 )
 
 type (
 	// GenerateBasic provide the basis of the generated token data
 	GenerateBasic struct {
-		Client    ClientInfo
+		Client ClientInfo
+		// zero for the tokens issued to the client itself
 		UserID    int64
 		CreateAt  time.Time
 		TokenInfo TokenInfo
 		Request   *http.Request
 	}
 
+	// AuthorizeGenerate generate the authorization code interface
+	AuthorizeGenerate interface {
+		Token(data *GenerateBasic) (code string, err error)
+	}
+
 	// AccessGenerate generate the access and refresh tokens interface
 	AccessGenerate interface {
 		Token(data *GenerateBasic, isGenRefresh bool) (access, refresh string, err error)
 	}
 )
+
+// HasUser whether the token is issued on behalf of a user
+func (gb *GenerateBasic) HasUser() bool {
+	return gb.UserID != 0
+}
+
+// Subject the token subject: the user id, or the client id for the tokens without user
+func (gb *GenerateBasic) Subject() string {
+	if gb.HasUser() {
+		return strconv.FormatInt(gb.UserID, 10)
+	}
+	return gb.Client.GetID()
+}
@@ -0,0 +1,35 @@
+package generates
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	"github.com/autowp/auth/oauth2server"
+	"github.com/autowp/auth/oauth2server/utils/uuid"
+)
+
+// NewAuthorizeGenerate create to generate the authorize code instance
+func NewAuthorizeGenerate() *AuthorizeGenerate {
+	return &AuthorizeGenerate{}
+}
+
+// AuthorizeGenerate generate the authorize code
+type AuthorizeGenerate struct{}
+
+// Token based on the UUID generated token
+func (ag *AuthorizeGenerate) Token(data *oauth2server.GenerateBasic) (string, error) {
+	buf := bytes.NewBufferString(data.Client.GetID())
+	buf.WriteString(strconv.FormatInt(data.UserID, 10))
+	buf.WriteString(strconv.FormatInt(data.CreateAt.UnixNano(), 10))
+
+	token, err := uuid.NewMD5(uuid.Must(uuid.NewRandom()), buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+	code := base64.URLEncoding.EncodeToString(token.Bytes())
+	code = strings.ToUpper(strings.TrimRight(code, "="))
+
+	return code, nil
+}
@@ -2,7 +2,6 @@ package generates
 
 import (
 	"encoding/base64"
-	"strconv"
 	"strings"
 	"time"
 
@@ -14,9 +13,16 @@ import (
 	"github.com/dgrijalva/jwt-go"
 )
 
-// JWTAccessClaims jwt claims
+// JWTAccessClaims jwt claims.
+// Subject equals ClientID for the tokens issued to the client itself
 type JWTAccessClaims struct {
 	jwt.StandardClaims
+	ClientID string `json:"client_id,omitempty"`
+}
+
+// HasUser whether the token is issued on behalf of a user
+func (a *JWTAccessClaims) HasUser() bool {
+	return a.Subject != a.ClientID
 }
 
 // Valid claims verification
@@ -35,20 +41,118 @@ func NewJWTAccessGenerate(key []byte, method jwt.SigningMethod) *JWTAccessGenera
 	}
 }
 
+// NewJWTKeySetAccessGenerate create to generate the jwt access token instance signed by the rotated keys
+func NewJWTKeySetAccessGenerate(keys *JWTKeySet) *JWTAccessGenerate {
+	return &JWTAccessGenerate{
+		Keys: keys,
+	}
+}
+
 // JWTAccessGenerate generate the jwt access token
 type JWTAccessGenerate struct {
 	SignedKey    []byte
 	SignedMethod jwt.SigningMethod
+	// takes precedence over SignedKey and SignedMethod
+	Keys *JWTKeySet
+	// iss claim, omitted when empty
+	Issuer string
+}
+
+// IDTokenAlgorithms the asymmetric signing methods of the issued tokens, the id tokens are not signed by the shared secret
+func (a *JWTAccessGenerate) IDTokenAlgorithms() []string {
+	if a.Keys != nil {
+		return a.Keys.AsymmetricAlgorithms(time.Now())
+	}
+	if a.isHs() {
+		return []string{}
+	}
+	return []string{a.SignedMethod.Alg()}
 }
 
 // Token based on the UUID generated token
 func (a *JWTAccessGenerate) Token(data *oauth2server.GenerateBasic, isGenRefresh bool) (string, string, error) {
+	// jti keeps the tokens issued within the same second to the same subject distinct
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", "", err
+	}
+
 	claims := &JWTAccessClaims{
 		StandardClaims: jwt.StandardClaims{
 			Audience:  data.Client.GetID(),
-			Subject:   strconv.FormatInt(data.UserID, 10),
+			Issuer:    a.Issuer,
+			Subject:   data.Subject(),
+			Id:        id.String(),
+			IssuedAt:  data.TokenInfo.GetAccessCreateAt().Unix(),
 			ExpiresAt: data.TokenInfo.GetAccessCreateAt().Add(data.TokenInfo.GetAccessExpiresIn()).Unix(),
 		},
+		ClientID: data.Client.GetID(),
+	}
+
+	access, err := a.sign(claims)
+	if err != nil {
+		return "", "", err
+	}
+	refresh := ""
+
+	if isGenRefresh {
+		sha1, err := uuid.NewSHA1(uuid.Must(uuid.NewRandom()), []byte(access))
+		if err != nil {
+			return "", "", err
+		}
+		refresh = base64.URLEncoding.EncodeToString(sha1.Bytes())
+		refresh = strings.ToUpper(strings.TrimRight(refresh, "="))
+	}
+
+	return access, refresh, nil
+}
+
+// IDToken generate the OpenID Connect id token with the given user claims
+// https://openid.net/specs/openid-connect-core-1_0.html#IDToken
+func (a *JWTAccessGenerate) IDToken(data *oauth2server.GenerateBasic, nonce string, userClaims map[string]interface{}) (string, error) {
+	claims := jwt.MapClaims{}
+	for k, v := range userClaims {
+		claims[k] = v
+	}
+
+	claims["iss"] = a.Issuer
+	claims["sub"] = data.Subject()
+	claims["aud"] = data.Client.GetID()
+	claims["iat"] = data.CreateAt.Unix()
+	claims["exp"] = data.TokenInfo.GetAccessCreateAt().Add(data.TokenInfo.GetAccessExpiresIn()).Unix()
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+
+	// the client could forge the id token signed by the secret it verifies with
+	symmetric := a.isHs()
+	if a.Keys != nil {
+		key, err := a.Keys.SigningKey(time.Now())
+		if err != nil {
+			return "", err
+		}
+		symmetric = key.IsSymmetric()
+	}
+	if symmetric {
+		return "", errs.New("id token requires the asymmetric signing key")
+	}
+
+	return a.sign(claims)
+}
+
+func (a *JWTAccessGenerate) sign(claims jwt.Claims) (string, error) {
+	if a.Keys != nil {
+		key, err := a.Keys.SigningKey(time.Now())
+		if err != nil {
+			return "", err
+		}
+
+		token := jwt.NewWithClaims(key.Method, claims)
+		if key.ID != "" {
+			token.Header["kid"] = key.ID
+		}
+
+		return token.SignedString(key.Key)
 	}
 
 	token := jwt.NewWithClaims(a.SignedMethod, claims)
@@ -56,37 +160,22 @@ func (a *JWTAccessGenerate) Token(data *oauth2server.GenerateBasic, isGenRefresh
 	if a.isEs() {
 		v, err := jwt.ParseECPrivateKeyFromPEM(a.SignedKey)
 		if err != nil {
-			return "", "", err
+			return "", err
 		}
 		key = v
 	} else if a.isRsOrPS() {
 		v, err := jwt.ParseRSAPrivateKeyFromPEM(a.SignedKey)
 		if err != nil {
-			return "", "", err
+			return "", err
 		}
 		key = v
 	} else if a.isHs() {
 		key = a.SignedKey
 	} else {
-		return "", "", errs.New("unsupported sign method")
-	}
-
-	access, err := token.SignedString(key)
-	if err != nil {
-		return "", "", err
-	}
-	refresh := ""
-
-	if isGenRefresh {
-		sha1, err := uuid.NewSHA1(uuid.Must(uuid.NewRandom()), []byte(access))
-		if err != nil {
-			return "", "", err
-		}
-		refresh = base64.URLEncoding.EncodeToString(sha1.Bytes())
-		refresh = strings.ToUpper(strings.TrimRight(refresh, "="))
+		return "", errs.New("unsupported sign method")
 	}
 
-	return access, refresh, nil
+	return token.SignedString(key)
 }
 
 func (a *JWTAccessGenerate) isEs() bool {
@@ -0,0 +1,68 @@
+package generates
+
+import (
+	"crypto/ed25519"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// SigningMethodEdDSA implements the EdDSA signing method, Ed25519 keys only
+// https://tools.ietf.org/html/rfc8037
+type SigningMethodEdDSA struct{}
+
+// SigningMethodEd25519 EdDSA signing method instance
+var SigningMethodEd25519 *SigningMethodEdDSA
+
+func init() {
+	SigningMethodEd25519 = &SigningMethodEdDSA{}
+	jwt.RegisterSigningMethod(SigningMethodEd25519.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEd25519
+	})
+}
+
+// Alg algorithm name
+func (m *SigningMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+// Verify the signature with ed25519.PublicKey or ed25519.PrivateKey
+func (m *SigningMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	var publicKey ed25519.PublicKey
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		publicKey = k
+	case ed25519.PrivateKey:
+		publicKey = k.Public().(ed25519.PublicKey)
+	default:
+		return jwt.ErrInvalidKeyType
+	}
+
+	if len(publicKey) != ed25519.PublicKeySize {
+		return jwt.ErrInvalidKey
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+
+	return nil
+}
+
+// Sign the string with ed25519.PrivateKey
+func (m *SigningMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return "", jwt.ErrInvalidKey
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
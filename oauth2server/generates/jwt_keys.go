@@ -0,0 +1,191 @@
+package generates
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	errs "errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// JWTKey the jwt signing key
+type JWTKey struct {
+	// kid header, empty for the legacy tokens signed without it
+	ID     string
+	Method jwt.SigningMethod
+	// []byte for HS, *rsa.PrivateKey for RS and PS, *ecdsa.PrivateKey for ES, ed25519.PrivateKey for EdDSA
+	Key interface{}
+	// the key signs the new tokens since this moment until the next key becomes active
+	NotBefore time.Time
+}
+
+// NewJWTKey parses the key for the signing method. HS keys are taken as is, others are PEM encoded private keys
+func NewJWTKey(id string, method jwt.SigningMethod, data []byte, notBefore time.Time) (*JWTKey, error) {
+	alg := method.Alg()
+
+	var key interface{}
+	var err error
+	switch {
+	case strings.HasPrefix(alg, "HS"):
+		key = data
+	case strings.HasPrefix(alg, "ES"):
+		key, err = jwt.ParseECPrivateKeyFromPEM(data)
+	case strings.HasPrefix(alg, "RS"), strings.HasPrefix(alg, "PS"):
+		key, err = jwt.ParseRSAPrivateKeyFromPEM(data)
+	case alg == SigningMethodEd25519.Alg():
+		key, err = parseEd25519PrivateKeyFromPEM(data)
+	default:
+		err = errs.New("unsupported sign method")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("key `%s`: %v", id, err)
+	}
+
+	return &JWTKey{
+		ID:        id,
+		Method:    method,
+		Key:       key,
+		NotBefore: notBefore,
+	}, nil
+}
+
+func parseEd25519PrivateKeyFromPEM(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, jwt.ErrKeyMustBePEMEncoded
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errs.New("key is not a valid Ed25519 private key")
+	}
+
+	return key, nil
+}
+
+// IsSymmetric whether the key is a shared secret, that is never published
+func (k *JWTKey) IsSymmetric() bool {
+	_, ok := k.Key.([]byte)
+	return ok
+}
+
+// PublicKey the verification key, nil for the symmetric keys
+func (k *JWTKey) PublicKey() crypto.PublicKey {
+	switch v := k.Key.(type) {
+	case *rsa.PrivateKey:
+		return &v.PublicKey
+	case *ecdsa.PrivateKey:
+		return &v.PublicKey
+	case ed25519.PrivateKey:
+		return v.Public()
+	}
+	return nil
+}
+
+// NewJWTKeySet creates the key set.
+// retention is how long the superseded key stays published, should cover the lifetime of the tokens
+func NewJWTKeySet(retention time.Duration, keys ...*JWTKey) (*JWTKeySet, error) {
+	if len(keys) == 0 {
+		return nil, errs.New("at least one key is required")
+	}
+
+	ids := make(map[string]bool)
+	for _, key := range keys {
+		if ids[key.ID] {
+			return nil, fmt.Errorf("duplicate key id `%s`", key.ID)
+		}
+		ids[key.ID] = true
+	}
+
+	sorted := make([]*JWTKey, len(keys))
+	copy(sorted, keys)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].NotBefore.Before(sorted[j].NotBefore)
+	})
+
+	return &JWTKeySet{
+		keys:      sorted,
+		retention: retention,
+	}, nil
+}
+
+// JWTKeySet the rotated signing keys.
+// The keys are activated by their NotBefore time, so every replica switches to the new key at the same moment.
+// A staged key (NotBefore in the future) is published in advance, so the verifiers can cache it before the switch.
+// A superseded key stays published during the retention period, until the tokens it signed expire
+type JWTKeySet struct {
+	// ordered by NotBefore
+	keys      []*JWTKey
+	retention time.Duration
+}
+
+// SigningKey the key for the new tokens
+func (ks *JWTKeySet) SigningKey(now time.Time) (*JWTKey, error) {
+	var active *JWTKey
+	for _, key := range ks.keys {
+		if key.NotBefore.After(now) {
+			break
+		}
+		active = key
+	}
+
+	if active == nil {
+		return nil, errs.New("no active signing key")
+	}
+
+	return active, nil
+}
+
+// ValidKeys the keys accepted for the verification: staged, active, and superseded during the retention
+func (ks *JWTKeySet) ValidKeys(now time.Time) []*JWTKey {
+	result := make([]*JWTKey, 0, len(ks.keys))
+	for i, key := range ks.keys {
+		if i+1 < len(ks.keys) {
+			next := ks.keys[i+1]
+			if !next.NotBefore.After(now) && next.NotBefore.Add(ks.retention).Before(now) {
+				// superseded and its tokens are expired already
+				continue
+			}
+		}
+		result = append(result, key)
+	}
+	return result
+}
+
+// PublishedKeys the asymmetric valid keys
+func (ks *JWTKeySet) PublishedKeys(now time.Time) []*JWTKey {
+	result := make([]*JWTKey, 0, len(ks.keys))
+	for _, key := range ks.ValidKeys(now) {
+		if !key.IsSymmetric() {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+// AsymmetricAlgorithms the signing methods of the published keys
+func (ks *JWTKeySet) AsymmetricAlgorithms(now time.Time) []string {
+	seen := make(map[string]bool)
+	result := make([]string, 0)
+	for _, key := range ks.PublishedKeys(now) {
+		alg := key.Method.Alg()
+		if !seen[alg] {
+			seen[alg] = true
+			result = append(result, alg)
+		}
+	}
+	return result
+}
@@ -7,14 +7,19 @@ import (
 
 // TokenGenerateRequest provide to generate the token request parameters
 type TokenGenerateRequest struct {
-	ClientID       string
-	ClientSecret   string
-	UserID         int64
-	Scope          string
-	Code           string
-	Refresh        string
-	AccessTokenExp time.Duration
-	Request        *http.Request
+	ClientID            string
+	ClientSecret        string
+	UserID              int64
+	RedirectURI         string
+	Scope               string
+	Nonce               string
+	Code                string
+	CodeChallenge       string
+	CodeChallengeMethod CodeChallengeMethod
+	CodeVerifier        string
+	Refresh             string
+	AccessTokenExp      time.Duration
+	Request             *http.Request
 }
 
 // Manager authorization management interface
@@ -22,6 +27,12 @@ type Manager interface {
 	// get the client information
 	GetClient(clientID string) (cli ClientInfo, err error)
 
+	// check the redirect uri is allowed for the client
+	ValidateRedirectURI(clientID, redirectURI string) (err error)
+
+	// generate the authorization token(code)
+	GenerateAuthToken(rt ResponseType, tgr *TokenGenerateRequest) (authToken TokenInfo, err error)
+
 	// generate the access token
 	GenerateAccessToken(rt GrantType, tgr *TokenGenerateRequest) (accessToken TokenInfo, err error)
 
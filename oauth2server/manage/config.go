@@ -26,12 +26,18 @@ type RefreshingConfig struct {
 	IsRemoveAccess bool
 	// whether to remove refreshing token
 	IsRemoveRefreshing bool
+	// the rotated out refresh token is accepted again within this interval, so the concurrent refreshes don't fail.
+	// Later replay revokes the whole token family. Applies only to the TokenFamilyStore
+	ReuseGraceWindow time.Duration
 }
 
 // default configs
 var (
-	DefaultCodeExp          = time.Minute * 10
-	DefaultPasswordTokenCfg = &Config{AccessTokenExp: time.Hour * 2, RefreshTokenExp: time.Hour * 24 * 7, IsGenerateRefresh: true}
-	DefaultSocialTokenCfg   = &Config{AccessTokenExp: time.Hour * 2, RefreshTokenExp: time.Hour * 24 * 7, IsGenerateRefresh: true}
-	DefaultRefreshTokenCfg  = &RefreshingConfig{IsGenerateRefresh: true, IsRemoveAccess: true, IsRemoveRefreshing: true}
+	DefaultCodeExp               = time.Minute * 10
+	DefaultAuthorizeCodeTokenCfg = &Config{AccessTokenExp: time.Hour * 2, RefreshTokenExp: time.Hour * 24 * 7, IsGenerateRefresh: true}
+	DefaultPasswordTokenCfg      = &Config{AccessTokenExp: time.Hour * 2, RefreshTokenExp: time.Hour * 24 * 7, IsGenerateRefresh: true}
+	DefaultClientTokenCfg        = &Config{AccessTokenExp: time.Hour * 2, IsGenerateRefresh: false}
+	DefaultSocialTokenCfg        = &Config{AccessTokenExp: time.Hour * 2, RefreshTokenExp: time.Hour * 24 * 7, IsGenerateRefresh: true}
+	DefaultWebAuthnTokenCfg      = &Config{AccessTokenExp: time.Hour * 2, RefreshTokenExp: time.Hour * 24 * 7, IsGenerateRefresh: true}
+	DefaultRefreshTokenCfg       = &RefreshingConfig{IsGenerateRefresh: true, IsRemoveAccess: true, IsRemoveRefreshing: true}
 )
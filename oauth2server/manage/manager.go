@@ -7,12 +7,14 @@ import (
 	"github.com/autowp/auth/oauth2server/errors"
 	"github.com/autowp/auth/oauth2server/generates"
 	"github.com/autowp/auth/oauth2server/models"
+	"github.com/autowp/auth/oauth2server/utils/uuid"
 )
 
 // NewDefaultManager create to default authorization management instance
 func NewDefaultManager() *Manager {
 	m := NewManager()
 	// default implementation
+	m.MapAuthorizeGenerate(generates.NewAuthorizeGenerate())
 	m.MapAccessGenerate(generates.NewAccessGenerate())
 
 	return m
@@ -21,17 +23,25 @@ func NewDefaultManager() *Manager {
 // NewManager create to authorization management instance
 func NewManager() *Manager {
 	return &Manager{
-		gtcfg: make(map[oauth2server.GrantType]*Config),
+		gtcfg:       make(map[oauth2server.GrantType]*Config),
+		validateURI: DefaultValidateURI,
+		requestIP:   DefaultRequestIP,
 	}
 }
 
 // Manager provide authorization management
 type Manager struct {
-	gtcfg          map[oauth2server.GrantType]*Config
-	rcfg           *RefreshingConfig
-	accessGenerate oauth2server.AccessGenerate
-	tokenStore     oauth2server.TokenStore
-	clientStore    oauth2server.ClientStore
+	codeExp           time.Duration
+	gtcfg             map[oauth2server.GrantType]*Config
+	rcfg              *RefreshingConfig
+	validateURI       ValidateURIHandler
+	authorizeGenerate oauth2server.AuthorizeGenerate
+	accessGenerate    oauth2server.AccessGenerate
+	tokenStore        oauth2server.TokenStore
+	clientStore       oauth2server.ClientStore
+	reuseHandler      RefreshTokenReuseHandler
+	userActive        UserActiveHandler
+	requestIP         RequestIPHandler
 }
 
 // get grant type config
@@ -40,29 +50,80 @@ func (m *Manager) grantConfig(gt oauth2server.GrantType) *Config {
 		return c
 	}
 	switch gt {
+	case oauth2server.AuthorizationCode:
+		return DefaultAuthorizeCodeTokenCfg
 	case oauth2server.SocialAuthorizationCode:
 		return DefaultSocialTokenCfg
+	case oauth2server.WebAuthn:
+		return DefaultWebAuthnTokenCfg
 	case oauth2server.PasswordCredentials:
 		return DefaultPasswordTokenCfg
+	case oauth2server.ClientCredentials:
+		return DefaultClientTokenCfg
 	}
 	return &Config{}
 }
 
+// SetAuthorizeCodeExp set the authorization code expiration time
+func (m *Manager) SetAuthorizeCodeExp(exp time.Duration) {
+	m.codeExp = exp
+}
+
+// SetAuthorizeCodeTokenCfg set the authorization code grant token config
+func (m *Manager) SetAuthorizeCodeTokenCfg(cfg *Config) {
+	m.gtcfg[oauth2server.AuthorizationCode] = cfg
+}
+
 // SetPasswordTokenCfg set the password grant token config
 func (m *Manager) SetPasswordTokenCfg(cfg *Config) {
 	m.gtcfg[oauth2server.PasswordCredentials] = cfg
 }
 
+// SetClientTokenCfg set the client grant token config
+func (m *Manager) SetClientTokenCfg(cfg *Config) {
+	m.gtcfg[oauth2server.ClientCredentials] = cfg
+}
+
 // SetSocialTokenCfg set the social grant token config
 func (m *Manager) SetSocialTokenCfg(cfg *Config) {
 	m.gtcfg[oauth2server.SocialAuthorizationCode] = cfg
 }
 
+// SetWebAuthnTokenCfg set the passkey grant token config
+func (m *Manager) SetWebAuthnTokenCfg(cfg *Config) {
+	m.gtcfg[oauth2server.WebAuthn] = cfg
+}
+
+// SetRefreshTokenReuseHandler set the handler of the security event when the family is revoked
+func (m *Manager) SetRefreshTokenReuseHandler(handler RefreshTokenReuseHandler) {
+	m.reuseHandler = handler
+}
+
+// SetUserActiveHandler set the check of the user, applied to every loaded access and refresh token
+func (m *Manager) SetUserActiveHandler(handler UserActiveHandler) {
+	m.userActive = handler
+}
+
+// SetRequestIPHandler set the client address resolver of the issued tokens
+func (m *Manager) SetRequestIPHandler(handler RequestIPHandler) {
+	m.requestIP = handler
+}
+
 // SetRefreshTokenCfg set the refreshing token config
 func (m *Manager) SetRefreshTokenCfg(cfg *RefreshingConfig) {
 	m.rcfg = cfg
 }
 
+// SetValidateURIHandler set the validates that RedirectURI is contained in the domain
+func (m *Manager) SetValidateURIHandler(handler ValidateURIHandler) {
+	m.validateURI = handler
+}
+
+// MapAuthorizeGenerate mapping the authorize code generate interface
+func (m *Manager) MapAuthorizeGenerate(gen oauth2server.AuthorizeGenerate) {
+	m.authorizeGenerate = gen
+}
+
 // MapAccessGenerate mapping the access token generate interface
 func (m *Manager) MapAccessGenerate(gen oauth2server.AccessGenerate) {
 	m.accessGenerate = gen
@@ -105,19 +166,193 @@ func (m *Manager) GetClient(clientID string) (cli oauth2server.ClientInfo, err e
 	return
 }
 
+// ValidateRedirectURI check the redirect uri is allowed for the client
+func (m *Manager) ValidateRedirectURI(clientID, redirectURI string) error {
+	cli, err := m.GetClient(clientID)
+	if err != nil {
+		return err
+	}
+
+	if redirectURI == "" {
+		return errors.ErrInvalidRedirectURI
+	}
+
+	return m.validateURI(cli, redirectURI)
+}
+
+// GenerateAuthToken generate the authorization token(code)
+func (m *Manager) GenerateAuthToken(rt oauth2server.ResponseType, tgr *oauth2server.TokenGenerateRequest) (oauth2server.TokenInfo, error) {
+	if rt != oauth2server.Code {
+		return nil, errors.ErrUnsupportedResponseType
+	}
+
+	cli, err := m.GetClient(tgr.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	if tgr.RedirectURI == "" {
+		return nil, errors.ErrInvalidRedirectURI
+	}
+	if err := m.validateURI(cli, tgr.RedirectURI); err != nil {
+		return nil, err
+	}
+
+	ti := models.NewToken()
+	ti.SetClientID(tgr.ClientID)
+	ti.SetUserID(tgr.UserID)
+	ti.SetRedirectURI(tgr.RedirectURI)
+	ti.SetScope(tgr.Scope)
+	ti.SetNonce(tgr.Nonce)
+
+	createAt := time.Now()
+	codeExp := m.codeExp
+	if codeExp == 0 {
+		codeExp = DefaultCodeExp
+	}
+	ti.SetCodeCreateAt(createAt)
+	ti.SetCodeExpiresIn(codeExp)
+	if exp := tgr.AccessTokenExp; exp > 0 {
+		ti.SetAccessExpiresIn(exp)
+	}
+	if tgr.CodeChallenge != "" {
+		ti.SetCodeChallenge(tgr.CodeChallenge)
+		ti.SetCodeChallengeMethod(tgr.CodeChallengeMethod)
+	}
+	m.setRequestInfo(ti, tgr.Request)
+
+	td := &oauth2server.GenerateBasic{
+		Client:    cli,
+		UserID:    tgr.UserID,
+		CreateAt:  createAt,
+		TokenInfo: ti,
+		Request:   tgr.Request,
+	}
+
+	tv, err := m.authorizeGenerate.Token(td)
+	if err != nil {
+		return nil, err
+	}
+	ti.SetCode(tv)
+
+	err = m.tokenStore.Create(ti)
+	if err != nil {
+		return nil, err
+	}
+
+	return ti, nil
+}
+
+// get authorization code data
+func (m *Manager) getAuthorizationCode(code string) (oauth2server.TokenInfo, error) {
+	ti, err := m.tokenStore.GetByCode(code)
+	if err != nil {
+		return nil, err
+	} else if ti == nil || ti.GetCode() != code || ti.GetCodeCreateAt().Add(ti.GetCodeExpiresIn()).Before(time.Now()) {
+		return nil, errors.ErrInvalidAuthorizeCode
+	}
+	return ti, nil
+}
+
+// delete authorization code data
+func (m *Manager) delAuthorizationCode(code string) error {
+	return m.tokenStore.RemoveByCode(code)
+}
+
+// get and delete authorization code data
+func (m *Manager) getAndDelAuthorizationCode(tgr *oauth2server.TokenGenerateRequest) (oauth2server.TokenInfo, error) {
+	code := tgr.Code
+	ti, err := m.getAuthorizationCode(code)
+	if err != nil {
+		return nil, err
+	}
+
+	// the code is single-use: consume it before any other check,
+	// so a rejected attempt also burns the code
+	err = m.delAuthorizationCode(code)
+	if err != nil {
+		return nil, err
+	}
+
+	if ti.GetClientID() != tgr.ClientID {
+		return nil, errors.ErrInvalidAuthorizeCode
+	} else if codeURI := ti.GetRedirectURI(); codeURI != "" && codeURI != tgr.RedirectURI {
+		return nil, errors.ErrInvalidAuthorizeCode
+	}
+
+	return ti, nil
+}
+
+func (m *Manager) validateCodeChallenge(ti oauth2server.TokenInfo, ver string) error {
+	cc := ti.GetCodeChallenge()
+	// early return
+	if cc == "" && ver == "" {
+		return nil
+	}
+	if cc == "" {
+		return errors.ErrMissingCodeChallenge
+	}
+	if ver == "" {
+		return errors.ErrMissingCodeVerifier
+	}
+	ccm := ti.GetCodeChallengeMethod()
+	if ccm.String() == "" {
+		ccm = oauth2server.CodeChallengePlain
+	}
+	if !ccm.Validate(cc, ver) {
+		return errors.ErrInvalidCodeChallenge
+	}
+	return nil
+}
+
 // GenerateAccessToken generate the access token
 func (m *Manager) GenerateAccessToken(gt oauth2server.GrantType, tgr *oauth2server.TokenGenerateRequest) (oauth2server.TokenInfo, error) {
 	cli, err := m.GetClient(tgr.ClientID)
 	if err != nil {
 		return nil, err
-	} else if tgr.ClientSecret != cli.GetSecret() {
+	} else if !oauth2server.VerifyClientSecret(cli, tgr.ClientSecret) {
 		return nil, errors.ErrInvalidClient
 	}
 
+	// code exchange comes from the client backend, so the user agent is taken from the authorize request
+	var codeInfo oauth2server.TokenInfo
+	if gt == oauth2server.AuthorizationCode {
+		ti, err := m.getAndDelAuthorizationCode(tgr)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.validateCodeChallenge(ti, tgr.CodeVerifier); err != nil {
+			return nil, err
+		}
+		// the code may be issued outside the authorize endpoint, e.g. by the social login
+		if !oauth2server.ClientScopeAllowed(cli, ti.GetScope()) {
+			return nil, errors.ErrInvalidScope
+		}
+		tgr.UserID = ti.GetUserID()
+		tgr.Scope = ti.GetScope()
+		tgr.Nonce = ti.GetNonce()
+		if exp := ti.GetAccessExpiresIn(); exp > 0 {
+			tgr.AccessTokenExp = exp
+		}
+		codeInfo = ti
+	}
+
+	if gt == oauth2server.ClientCredentials {
+		// the client acts on its own behalf
+		tgr.UserID = 0
+	}
+
 	ti := models.NewToken()
 	ti.SetClientID(tgr.ClientID)
 	ti.SetUserID(tgr.UserID)
 	ti.SetScope(tgr.Scope)
+	ti.SetNonce(tgr.Nonce)
+	if codeInfo != nil && codeInfo.GetIP() != "" {
+		ti.SetIP(codeInfo.GetIP())
+		ti.SetUserAgent(codeInfo.GetUserAgent())
+	} else {
+		m.setRequestInfo(ti, tgr.Request)
+	}
 
 	createAt := time.Now()
 	ti.SetAccessCreateAt(createAt)
@@ -125,13 +360,21 @@ func (m *Manager) GenerateAccessToken(gt oauth2server.GrantType, tgr *oauth2serv
 	// set access token expires
 	gcfg := m.grantConfig(gt)
 	aexp := gcfg.AccessTokenExp
+	if exp := cli.GetAccessTokenExp(); exp > 0 {
+		aexp = exp
+	}
 	if exp := tgr.AccessTokenExp; exp > 0 {
 		aexp = exp
 	}
 	ti.SetAccessExpiresIn(aexp)
 	if gcfg.IsGenerateRefresh {
+		ti.SetFamily(newFamily())
+		rexp := gcfg.RefreshTokenExp
+		if exp := cli.GetRefreshTokenExp(); exp > 0 {
+			rexp = exp
+		}
 		ti.SetRefreshCreateAt(createAt)
-		ti.SetRefreshExpiresIn(gcfg.RefreshTokenExp)
+		ti.SetRefreshExpiresIn(rexp)
 	}
 
 	td := &oauth2server.GenerateBasic{
@@ -165,11 +408,11 @@ func (m *Manager) RefreshAccessToken(tgr *oauth2server.TokenGenerateRequest) (oa
 	cli, err := m.GetClient(tgr.ClientID)
 	if err != nil {
 		return nil, err
-	} else if tgr.ClientSecret != cli.GetSecret() {
+	} else if !oauth2server.VerifyClientSecret(cli, tgr.ClientSecret) {
 		return nil, errors.ErrInvalidClient
 	}
 
-	ti, err := m.LoadRefreshToken(tgr.Refresh)
+	ti, err := m.loadRefreshToken(tgr.Refresh, true)
 	if err != nil {
 		return nil, err
 	} else if ti.GetClientID() != tgr.ClientID {
@@ -178,6 +421,26 @@ func (m *Manager) RefreshAccessToken(tgr *oauth2server.TokenGenerateRequest) (oa
 
 	oldAccess, oldRefresh := ti.GetAccess(), ti.GetRefresh()
 
+	rcfg := DefaultRefreshTokenCfg
+	if v := m.rcfg; v != nil {
+		rcfg = v
+	}
+
+	familyStore, rotation := m.tokenStore.(oauth2server.TokenFamilyStore)
+	rotation = rotation && rcfg.IsGenerateRefresh
+	if rotation {
+		if ti.GetFamily() == "" {
+			// issued before the families were introduced,
+			// derived from the refresh token so the replay finds the same family
+			ti.SetFamily(uuid.Must(uuid.NewSHA1(uuid.Nil, []byte(oldRefresh))).String())
+		}
+
+		err = m.rotateRefresh(familyStore, ti, rcfg.ReuseGraceWindow)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	td := &oauth2server.GenerateBasic{
 		Client:    cli,
 		UserID:    ti.GetUserID(),
@@ -186,19 +449,22 @@ func (m *Manager) RefreshAccessToken(tgr *oauth2server.TokenGenerateRequest) (oa
 		Request:   tgr.Request,
 	}
 
-	rcfg := DefaultRefreshTokenCfg
-	if v := m.rcfg; v != nil {
-		rcfg = v
-	}
-
+	m.setRequestInfo(ti, tgr.Request)
 	ti.SetAccessCreateAt(td.CreateAt)
 	if v := rcfg.AccessTokenExp; v > 0 {
 		ti.SetAccessExpiresIn(v)
 	}
 
+	if v := cli.GetAccessTokenExp(); v > 0 {
+		ti.SetAccessExpiresIn(v)
+	}
+
 	if v := rcfg.RefreshTokenExp; v > 0 {
 		ti.SetRefreshExpiresIn(v)
 	}
+	if v := cli.GetRefreshTokenExp(); v > 0 {
+		ti.SetRefreshExpiresIn(v)
+	}
 
 	if rcfg.IsResetRefreshTime {
 		ti.SetRefreshCreateAt(td.CreateAt)
@@ -222,6 +488,11 @@ func (m *Manager) RefreshAccessToken(tgr *oauth2server.TokenGenerateRequest) (oa
 		return nil, err
 	}
 
+	if rotation {
+		// the old token is already rotated out and stays for the reuse detection
+		return ti, nil
+	}
+
 	if rcfg.IsRemoveAccess {
 		// remove the old access token
 		if err := m.tokenStore.RemoveByAccess(oldAccess); err != nil {
@@ -273,18 +544,64 @@ func (m *Manager) LoadAccessToken(access string) (oauth2server.TokenInfo, error)
 		return nil, err
 	} else if ti == nil || ti.GetAccess() != access {
 		return nil, errors.ErrInvalidAccessToken
-	} else if ti.GetRefresh() != "" && ti.GetRefreshExpiresIn() != 0 &&
+	} else if !ti.GetRefreshCreateAt().IsZero() && ti.GetRefreshExpiresIn() != 0 && // store can omit the refresh value
 		ti.GetRefreshCreateAt().Add(ti.GetRefreshExpiresIn()).Before(ct) {
 		return nil, errors.ErrExpiredRefreshToken
 	} else if ti.GetAccessExpiresIn() != 0 &&
 		ti.GetAccessCreateAt().Add(ti.GetAccessExpiresIn()).Before(ct) {
 		return nil, errors.ErrExpiredAccessToken
 	}
+
+	active, err := m.isUserActive(ti)
+	if err != nil {
+		return nil, err
+	} else if !active {
+		return nil, errors.ErrInvalidAccessToken
+	}
+
 	return ti, nil
 }
 
 // LoadRefreshToken according to the refresh token for corresponding token information
 func (m *Manager) LoadRefreshToken(refresh string) (oauth2server.TokenInfo, error) {
+	return m.loadRefreshToken(refresh, false)
+}
+
+// rotateRefresh marks the presented refresh token as rotated out.
+// Replay of the already rotated token outside of the grace window revokes the whole family
+func (m *Manager) rotateRefresh(store oauth2server.TokenFamilyStore, ti oauth2server.TokenInfo, grace time.Duration) error {
+	now := time.Now()
+
+	rotatedAt := ti.GetRefreshRotatedAt()
+	if rotatedAt.IsZero() {
+		rotated, err := store.RotateRefresh(ti.GetRefresh(), now)
+		if err != nil {
+			return err
+		}
+		if rotated {
+			return nil
+		}
+		// concurrent request has rotated it just now
+		rotatedAt = now
+	}
+
+	if grace > 0 && now.Sub(rotatedAt) <= grace {
+		return nil
+	}
+
+	err := store.RemoveFamily(ti.GetFamily())
+	if err != nil {
+		return err
+	}
+
+	if fn := m.reuseHandler; fn != nil {
+		fn(ti)
+	}
+
+	return errors.ErrInvalidRefreshToken
+}
+
+func (m *Manager) loadRefreshToken(refresh string, allowRotated bool) (oauth2server.TokenInfo, error) {
 	if refresh == "" {
 		return nil, errors.ErrInvalidRefreshToken
 	}
@@ -294,9 +611,53 @@ func (m *Manager) LoadRefreshToken(refresh string) (oauth2server.TokenInfo, erro
 		return nil, err
 	} else if ti == nil || ti.GetRefresh() != refresh {
 		return nil, errors.ErrInvalidRefreshToken
+	} else if !allowRotated && !ti.GetRefreshRotatedAt().IsZero() {
+		return nil, errors.ErrInvalidRefreshToken
 	} else if ti.GetRefreshExpiresIn() != 0 && // refresh token set to not expire
 		ti.GetRefreshCreateAt().Add(ti.GetRefreshExpiresIn()).Before(time.Now()) {
 		return nil, errors.ErrExpiredRefreshToken
 	}
+
+	active, err := m.isUserActive(ti)
+	if err != nil {
+		return nil, err
+	} else if !active {
+		return nil, errors.ErrInvalidRefreshToken
+	}
+
 	return ti, nil
 }
+
+// isUserActive the tokens of the deleted user are revoked on the first use
+func (m *Manager) isUserActive(ti oauth2server.TokenInfo) (bool, error) {
+	userID := ti.GetUserID()
+	if userID == 0 || m.userActive == nil {
+		return true, nil
+	}
+
+	active, err := m.userActive(userID)
+	if err != nil || active {
+		return active, err
+	}
+
+	err = m.RevokeAllForUser(userID)
+	if err != nil && err != errors.ErrUnsupportedByStore {
+		return false, err
+	}
+
+	return false, nil
+}
+
+// RevokeAllForUser deletes all the tokens issued to the user, e.g. after the password change or ban
+func (m *Manager) RevokeAllForUser(userID int64) error {
+	store, ok := m.tokenStore.(oauth2server.TokenSessionStore)
+	if !ok {
+		return errors.ErrUnsupportedByStore
+	}
+
+	return store.RemoveByUser(userID)
+}
+
+func newFamily() string {
+	return uuid.Must(uuid.NewRandom()).String()
+}
@@ -0,0 +1,76 @@
+package manage
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/autowp/auth/oauth2server"
+	"github.com/autowp/auth/oauth2server/errors"
+)
+
+type (
+	// ValidateURIHandler validates that redirectURI is allowed for the client
+	ValidateURIHandler func(cli oauth2server.ClientInfo, redirectURI string) error
+
+	// RefreshTokenReuseHandler notified when the replay of the rotated refresh token revoked its family
+	RefreshTokenReuseHandler func(ti oauth2server.TokenInfo)
+
+	// UserActiveHandler checks that the user is not deleted or banned since the token was issued
+	UserActiveHandler func(userID int64) (bool, error)
+
+	// RequestIPHandler resolves the client address of the request
+	RequestIPHandler func(r *http.Request) string
+)
+
+// DefaultValidateURI validates that redirectURI is contained in the client domain
+func DefaultValidateURI(cli oauth2server.ClientInfo, redirectURI string) error {
+	base, err := url.Parse(cli.GetDomain())
+	if err != nil {
+		return err
+	}
+
+	redirect, err := url.Parse(redirectURI)
+	if err != nil {
+		return err
+	}
+
+	if base.Scheme != redirect.Scheme || redirect.Fragment != "" {
+		return errors.ErrInvalidRedirectURI
+	}
+
+	if redirect.Host != base.Host && !strings.HasSuffix(redirect.Host, "."+base.Host) {
+		return errors.ErrInvalidRedirectURI
+	}
+
+	return nil
+}
+
+// maxUserAgentLength limits the stored user agent
+const maxUserAgentLength = 512
+
+// setRequestInfo remembers the user agent the token is issued to
+func (m *Manager) setRequestInfo(ti oauth2server.TokenInfo, r *http.Request) {
+	if r == nil {
+		return
+	}
+
+	ti.SetIP(m.requestIP(r))
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	ti.SetUserAgent(userAgent)
+}
+
+// DefaultRequestIP the peer address, the forwarding headers are not trusted
+func DefaultRequestIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return ip
+}
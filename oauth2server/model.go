@@ -1,6 +1,8 @@
 package oauth2server
 
 import (
+	"crypto/subtle"
+	"strings"
 	"time"
 )
 
@@ -11,9 +13,26 @@ type (
 		GetSecret() string
 		GetDomain() string
 		GetUserID() string
+		GetRedirectURIs() []string
+		// GetGrantTypes allowed grant types, empty means all grant types enabled on the server
+		GetGrantTypes() []GrantType
+		// GetScopes allowed scopes, empty means any scope
+		GetScopes() []string
+		// GetAccessTokenExp overrides the access token lifetime when not zero
+		GetAccessTokenExp() time.Duration
+		// GetRefreshTokenExp overrides the refresh token lifetime when not zero
+		GetRefreshTokenExp() time.Duration
+		// IsPublic the client without secret
+		IsPublic() bool
 	}
 
-	// TokenInfo the token information model interface
+	// ClientPasswordVerifier the client which stores the secret hashed, verifies the secret by itself
+	ClientPasswordVerifier interface {
+		VerifyPassword(string) bool
+	}
+
+	// TokenInfo the token information model interface.
+	// The user id is zero for the tokens issued to the client itself
 	TokenInfo interface {
 		New() TokenInfo
 
@@ -23,6 +42,10 @@ type (
 		SetUserID(int64)
 		GetScope() string
 		SetScope(string)
+		GetNonce() string
+		SetNonce(string)
+		GetRedirectURI() string
+		SetRedirectURI(string)
 
 		GetCode() string
 		SetCode(string)
@@ -30,6 +53,10 @@ type (
 		SetCodeCreateAt(time.Time)
 		GetCodeExpiresIn() time.Duration
 		SetCodeExpiresIn(time.Duration)
+		GetCodeChallenge() string
+		SetCodeChallenge(string)
+		GetCodeChallengeMethod() CodeChallengeMethod
+		SetCodeChallengeMethod(CodeChallengeMethod)
 
 		GetAccess() string
 		SetAccess(string)
@@ -44,6 +71,17 @@ type (
 		SetRefreshCreateAt(time.Time)
 		GetRefreshExpiresIn() time.Duration
 		SetRefreshExpiresIn(time.Duration)
+		// GetFamily the refresh token rotation chain
+		GetFamily() string
+		SetFamily(string)
+		// GetRefreshRotatedAt zero while the refresh token is not rotated out
+		GetRefreshRotatedAt() time.Time
+		SetRefreshRotatedAt(time.Time)
+		// GetIP the address of the user agent the token was issued to
+		GetIP() string
+		SetIP(string)
+		GetUserAgent() string
+		SetUserAgent(string)
 	}
 
 	// PasswordCredentialsData ...
@@ -60,6 +98,13 @@ type (
 		State string `form:"state" json:"state"`
 	}
 
+	// AuthorizationCodeData ...
+	AuthorizationCodeData struct {
+		Code         string `form:"code"          json:"code"`
+		RedirectURI  string `form:"redirect_uri"  json:"redirect_uri"`
+		CodeVerifier string `form:"code_verifier" json:"code_verifier"`
+	}
+
 	// TokenRequestData ...
 	TokenRequestData struct {
 		GrantType    string `form:"grant_type"    json:"grant_type"`
@@ -68,9 +113,61 @@ type (
 		Username     string `form:"username"      json:"username"`
 		Password     string `form:"password"      json:"password"`
 		Code         string `form:"code"          json:"code"`
+		RedirectURI  string `form:"redirect_uri"  json:"redirect_uri"`
+		CodeVerifier string `form:"code_verifier" json:"code_verifier"`
 		State        string `form:"state"         json:"state"`
 		Scope        string `form:"scope"         json:"scope"`
 		RefreshToken string `form:"refresh_token" json:"refresh_token"`
-		ClientIP     string
+		MFAToken     string `form:"mfa_token"     json:"mfa_token"`
+		OTP          string `form:"otp"           json:"otp"`
+		ChallengeID  string `form:"challenge_id"  json:"challenge_id"`
+		Credential   string `form:"credential"    json:"credential"`
+		// ClientIP the address of the user agent, set by the handler
+		ClientIP string `form:"-" json:"-"`
+	}
+
+	// RevocationRequestData ...
+	RevocationRequestData struct {
+		Token         string `form:"token"           json:"token"`
+		TokenTypeHint string `form:"token_type_hint" json:"token_type_hint"`
+	}
+
+	// IntrospectionRequestData ...
+	IntrospectionRequestData struct {
+		Token         string `form:"token"           json:"token"`
+		TokenTypeHint string `form:"token_type_hint" json:"token_type_hint"`
 	}
 )
+
+// VerifyClientSecret checks the client secret in constant time.
+// Public client must not send any secret
+func VerifyClientSecret(cli ClientInfo, secret string) bool {
+	if cli.IsPublic() {
+		return secret == ""
+	}
+	if verifier, ok := cli.(ClientPasswordVerifier); ok {
+		return verifier.VerifyPassword(secret)
+	}
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(cli.GetSecret())) == 1
+}
+
+// ClientScopeAllowed checks that each of the requested scopes is allowed for the client
+func ClientScopeAllowed(cli ClientInfo, scope string) bool {
+	allowed := cli.GetScopes()
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, requested := range strings.Fields(scope) {
+		found := false
+		for _, as := range allowed {
+			if as == requested {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
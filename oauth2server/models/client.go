@@ -1,11 +1,28 @@
 package models
 
+import (
+	"time"
+
+	"github.com/autowp/auth/oauth2server"
+)
+
 // Client client model
 type Client struct {
 	ID     string
+	Name   string
 	Secret string
 	Domain string
 	UserID string
+	// Public client can not keep the secret, so it authenticates by id only and must use PKCE
+	Public bool
+	// RedirectURIs registered redirect uris, {hostname} matches each of the configured hosts
+	RedirectURIs []string `yaml:"redirect_uris" mapstructure:"redirect_uris"`
+	GrantTypes   []string `yaml:"grant_types"   mapstructure:"grant_types"`
+	Scopes       []string `yaml:"scopes"        mapstructure:"scopes"`
+	// AccessTokenExpiresIn in minutes, zero for the server default
+	AccessTokenExpiresIn uint `yaml:"access_token_expires_in" mapstructure:"access_token_expires_in"`
+	// RefreshTokenExpiresIn in minutes, zero for the server default
+	RefreshTokenExpiresIn uint `yaml:"refresh_token_expires_in" mapstructure:"refresh_token_expires_in"`
 }
 
 // GetID client id
@@ -18,6 +35,11 @@ func (c *Client) GetSecret() string {
 	return c.Secret
 }
 
+// GetName client name
+func (c *Client) GetName() string {
+	return c.Name
+}
+
 // GetDomain client domain
 func (c *Client) GetDomain() string {
 	return c.Domain
@@ -27,3 +49,37 @@ func (c *Client) GetDomain() string {
 func (c *Client) GetUserID() string {
 	return c.UserID
 }
+
+// GetRedirectURIs registered redirect uris
+func (c *Client) GetRedirectURIs() []string {
+	return c.RedirectURIs
+}
+
+// GetGrantTypes allowed grant types
+func (c *Client) GetGrantTypes() []oauth2server.GrantType {
+	result := make([]oauth2server.GrantType, len(c.GrantTypes))
+	for i, gt := range c.GrantTypes {
+		result[i] = oauth2server.GrantType(gt)
+	}
+	return result
+}
+
+// GetScopes allowed scopes
+func (c *Client) GetScopes() []string {
+	return c.Scopes
+}
+
+// GetAccessTokenExp access token lifetime
+func (c *Client) GetAccessTokenExp() time.Duration {
+	return time.Duration(c.AccessTokenExpiresIn) * time.Minute
+}
+
+// GetRefreshTokenExp refresh token lifetime
+func (c *Client) GetRefreshTokenExp() time.Duration {
+	return time.Duration(c.RefreshTokenExpiresIn) * time.Minute
+}
+
+// IsPublic the client has no secret
+func (c *Client) IsPublic() bool {
+	return c.Public
+}
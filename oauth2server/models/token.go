@@ -13,18 +13,26 @@ func NewToken() *Token {
 
 // Token token model
 type Token struct {
-	ClientID         string        `bson:"ClientID"`
-	UserID           int64         `bson:"UserID"`
-	Scope            string        `bson:"Scope"`
-	Code             string        `bson:"Code"`
-	CodeCreateAt     time.Time     `bson:"CodeCreateAt"`
-	CodeExpiresIn    time.Duration `bson:"CodeExpiresIn"`
-	Access           string        `bson:"Access"`
-	AccessCreateAt   time.Time     `bson:"AccessCreateAt"`
-	AccessExpiresIn  time.Duration `bson:"AccessExpiresIn"`
-	Refresh          string        `bson:"Refresh"`
-	RefreshCreateAt  time.Time     `bson:"RefreshCreateAt"`
-	RefreshExpiresIn time.Duration `bson:"RefreshExpiresIn"`
+	ClientID            string        `bson:"ClientID"`
+	UserID              int64         `bson:"UserID"`
+	RedirectURI         string        `bson:"RedirectURI"`
+	Scope               string        `bson:"Scope"`
+	Nonce               string        `bson:"Nonce"`
+	Code                string        `bson:"Code"`
+	CodeChallenge       string        `bson:"CodeChallenge"`
+	CodeChallengeMethod string        `bson:"CodeChallengeMethod"`
+	CodeCreateAt        time.Time     `bson:"CodeCreateAt"`
+	CodeExpiresIn       time.Duration `bson:"CodeExpiresIn"`
+	Access              string        `bson:"Access"`
+	AccessCreateAt      time.Time     `bson:"AccessCreateAt"`
+	AccessExpiresIn     time.Duration `bson:"AccessExpiresIn"`
+	Refresh             string        `bson:"Refresh"`
+	RefreshCreateAt     time.Time     `bson:"RefreshCreateAt"`
+	RefreshExpiresIn    time.Duration `bson:"RefreshExpiresIn"`
+	Family              string        `bson:"Family"`
+	RefreshRotatedAt    time.Time     `bson:"-" json:"-"`
+	IP                  string        `bson:"IP"`
+	UserAgent           string        `bson:"UserAgent"`
 }
 
 // New create to token model instance
@@ -42,7 +50,7 @@ func (t *Token) SetClientID(clientID string) {
 	t.ClientID = clientID
 }
 
-// GetUserID the user id
+// GetUserID the user id, zero when the token has no user
 func (t *Token) GetUserID() int64 {
 	return t.UserID
 }
@@ -52,6 +60,16 @@ func (t *Token) SetUserID(userID int64) {
 	t.UserID = userID
 }
 
+// GetRedirectURI redirect URI
+func (t *Token) GetRedirectURI() string {
+	return t.RedirectURI
+}
+
+// SetRedirectURI redirect URI
+func (t *Token) SetRedirectURI(redirectURI string) {
+	t.RedirectURI = redirectURI
+}
+
 // GetScope get scope of authorization
 func (t *Token) GetScope() string {
 	return t.Scope
@@ -62,6 +80,16 @@ func (t *Token) SetScope(scope string) {
 	t.Scope = scope
 }
 
+// GetNonce OpenID Connect nonce of the authorization request
+func (t *Token) GetNonce() string {
+	return t.Nonce
+}
+
+// SetNonce OpenID Connect nonce of the authorization request
+func (t *Token) SetNonce(nonce string) {
+	t.Nonce = nonce
+}
+
 // GetCode authorization code
 func (t *Token) GetCode() string {
 	return t.Code
@@ -92,6 +120,26 @@ func (t *Token) SetCodeExpiresIn(exp time.Duration) {
 	t.CodeExpiresIn = exp
 }
 
+// GetCodeChallenge challenge code
+func (t *Token) GetCodeChallenge() string {
+	return t.CodeChallenge
+}
+
+// SetCodeChallenge challenge code
+func (t *Token) SetCodeChallenge(code string) {
+	t.CodeChallenge = code
+}
+
+// GetCodeChallengeMethod challenge method
+func (t *Token) GetCodeChallengeMethod() oauth2server.CodeChallengeMethod {
+	return oauth2server.CodeChallengeMethod(t.CodeChallengeMethod)
+}
+
+// SetCodeChallengeMethod challenge method
+func (t *Token) SetCodeChallengeMethod(method oauth2server.CodeChallengeMethod) {
+	t.CodeChallengeMethod = string(method)
+}
+
 // GetAccess access Token
 func (t *Token) GetAccess() string {
 	return t.Access
@@ -151,3 +199,43 @@ func (t *Token) GetRefreshExpiresIn() time.Duration {
 func (t *Token) SetRefreshExpiresIn(exp time.Duration) {
 	t.RefreshExpiresIn = exp
 }
+
+// GetFamily the refresh token rotation chain
+func (t *Token) GetFamily() string {
+	return t.Family
+}
+
+// SetFamily the refresh token rotation chain
+func (t *Token) SetFamily(family string) {
+	t.Family = family
+}
+
+// GetRefreshRotatedAt the time when the refresh token was rotated out
+func (t *Token) GetRefreshRotatedAt() time.Time {
+	return t.RefreshRotatedAt
+}
+
+// SetRefreshRotatedAt the time when the refresh token was rotated out
+func (t *Token) SetRefreshRotatedAt(rotatedAt time.Time) {
+	t.RefreshRotatedAt = rotatedAt
+}
+
+// GetIP the address of the user agent the token was issued to
+func (t *Token) GetIP() string {
+	return t.IP
+}
+
+// SetIP the address of the user agent the token was issued to
+func (t *Token) SetIP(ip string) {
+	t.IP = ip
+}
+
+// GetUserAgent the user agent the token was issued to
+func (t *Token) GetUserAgent() string {
+	return t.UserAgent
+}
+
+// SetUserAgent the user agent the token was issued to
+func (t *Token) SetUserAgent(userAgent string) {
+	t.UserAgent = userAgent
+}
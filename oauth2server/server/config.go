@@ -9,20 +9,35 @@ import (
 
 // Config configuration parameters
 type Config struct {
+	// allowed grant types, all are allowed when empty
+	AllowedGrantTypes []oauth2server.GrantType
+	// allowed PKCE methods
+	AllowedCodeChallengeMethods []oauth2server.CodeChallengeMethod
+	// whether authorization requests without code_challenge are rejected
+	ForcePKCE bool
 }
 
 // NewConfig create to configuration instance
 func NewConfig() *Config {
-	return &Config{}
+	return &Config{
+		AllowedCodeChallengeMethods: []oauth2server.CodeChallengeMethod{
+			oauth2server.CodeChallengePlain,
+			oauth2server.CodeChallengeS256,
+		},
+	}
 }
 
 // AuthorizeRequest authorization request
 type AuthorizeRequest struct {
-	ResponseType   oauth2server.ResponseType
-	ClientID       string
-	Scope          string
-	State          string
-	UserID         string
-	AccessTokenExp time.Duration
-	Request        *http.Request
+	ResponseType        oauth2server.ResponseType
+	ClientID            string
+	Scope               string
+	Nonce               string
+	RedirectURI         string
+	State               string
+	UserID              int64
+	CodeChallenge       string
+	CodeChallengeMethod oauth2server.CodeChallengeMethod
+	AccessTokenExp      time.Duration
+	Request             *http.Request
 }
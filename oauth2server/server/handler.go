@@ -1,7 +1,9 @@
 package server
 
 import (
+	"context"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/autowp/auth/oauth2server"
@@ -9,6 +11,9 @@ import (
 )
 
 type (
+	// ClientInfoHandler get client info from request
+	ClientInfoHandler func(r *http.Request) (clientID, clientSecret string, err error)
+
 	// ClientScopeHandler check the client allows to use scope
 	ClientScopeHandler func(clientID, scope string) (allowed bool, err error)
 
@@ -16,10 +21,16 @@ type (
 	UserAuthorizationHandler func(w http.ResponseWriter, r *http.Request) (userID int64, err error)
 
 	// PasswordAuthorizationHandler get user id from username and password
-	PasswordAuthorizationHandler func(username, password string) (userID int64, err error)
+	PasswordAuthorizationHandler func(username, password, remoteAddr string) (userID int64, err error)
+
+	// MFAAuthorizationHandler get user id from the token of the mfa_required error and the one-time password
+	MFAAuthorizationHandler func(mfaToken, otp, remoteAddr string) (userID int64, err error)
+
+	// WebAuthnAuthorizationHandler get user id from the assertion of the issued challenge
+	WebAuthnAuthorizationHandler func(challengeID, credential, remoteAddr string) (userID int64, err error)
 
 	// SocialAuthorizationHandler ...
-	SocialAuthorizationHandler func(code, stateID, remoteAddr string) (int64, string, error)
+	SocialAuthorizationHandler func(ctx context.Context, code, stateID, remoteAddr string) (int64, string, error)
 
 	// RefreshingScopeHandler check the scope of the refreshing token
 	RefreshingScopeHandler func(newScope, oldScope string) (allowed bool, err error)
@@ -36,3 +47,41 @@ type (
 	// ExtensionFieldsHandler in response to the access token with the extension of the field
 	ExtensionFieldsHandler func(ti oauth2server.TokenInfo) (fieldsValue map[string]interface{})
 )
+
+// ClientFormHandler get client data from form
+func ClientFormHandler(r *http.Request) (string, string, error) {
+	clientID := r.PostFormValue("client_id")
+	if clientID == "" {
+		return "", "", errors.ErrInvalidClient
+	}
+	clientSecret := r.PostFormValue("client_secret")
+	return clientID, clientSecret, nil
+}
+
+// ClientBasicHandler get client data from basic authorization
+func ClientBasicHandler(r *http.Request) (string, string, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return "", "", errors.ErrInvalidClient
+	}
+
+	clientID, err := url.QueryUnescape(username)
+	if err != nil {
+		return "", "", errors.ErrInvalidClient
+	}
+
+	clientSecret, err := url.QueryUnescape(password)
+	if err != nil {
+		return "", "", errors.ErrInvalidClient
+	}
+
+	return clientID, clientSecret, nil
+}
+
+// ClientBasicOrFormHandler get client data from basic authorization, falls back to the form
+func ClientBasicOrFormHandler(r *http.Request) (string, string, error) {
+	if r.Header.Get("Authorization") != "" {
+		return ClientBasicHandler(r)
+	}
+	return ClientFormHandler(r)
+}
@@ -1,7 +1,12 @@
 package server
 
 import (
+	"context"
+	"fmt"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,19 +23,28 @@ func NewDefaultServer(manager oauth2server.Manager) *Server {
 // NewServer create authorization server
 func NewServer(cfg *Config, manager oauth2server.Manager) *Server {
 	srv := &Server{
-		Config:  cfg,
-		Manager: manager,
+		Config:            cfg,
+		Manager:           manager,
+		ClientInfoHandler: ClientBasicOrFormHandler,
 	}
 
 	srv.UserAuthorizationHandler = func(w http.ResponseWriter, r *http.Request) (int64, error) {
 		return 0, errors.ErrAccessDenied
 	}
 
-	srv.PasswordAuthorizationHandler = func(username, password string) (int64, error) {
+	srv.PasswordAuthorizationHandler = func(username, password, remoteAddr string) (int64, error) {
 		return 0, errors.ErrAccessDenied
 	}
 
-	srv.SocialAuthorizationHandler = func(code, stateID, remoteAddr string) (int64, string, error) {
+	srv.MFAAuthorizationHandler = func(mfaToken, otp, remoteAddr string) (int64, error) {
+		return 0, errors.ErrAccessDenied
+	}
+
+	srv.WebAuthnAuthorizationHandler = func(challengeID, credential, remoteAddr string) (int64, error) {
+		return 0, errors.ErrAccessDenied
+	}
+
+	srv.SocialAuthorizationHandler = func(ctx context.Context, code, stateID, remoteAddr string) (int64, string, error) {
 		return 0, "", errors.ErrAccessDenied
 	}
 
@@ -41,9 +55,12 @@ func NewServer(cfg *Config, manager oauth2server.Manager) *Server {
 type Server struct {
 	Config                       *Config
 	Manager                      oauth2server.Manager
+	ClientInfoHandler            ClientInfoHandler
 	ClientScopeHandler           ClientScopeHandler
 	UserAuthorizationHandler     UserAuthorizationHandler
 	PasswordAuthorizationHandler PasswordAuthorizationHandler
+	MFAAuthorizationHandler      MFAAuthorizationHandler
+	WebAuthnAuthorizationHandler WebAuthnAuthorizationHandler
 	SocialAuthorizationHandler   SocialAuthorizationHandler
 	RefreshingScopeHandler       RefreshingScopeHandler
 	ResponseErrorHandler         ResponseErrorHandler
@@ -52,6 +69,242 @@ type Server struct {
 	AccessTokenExpHandler        AccessTokenExpHandler
 }
 
+// CheckGrantType check allows grant type
+func (s *Server) CheckGrantType(gt oauth2server.GrantType) bool {
+	if len(s.Config.AllowedGrantTypes) == 0 {
+		return true
+	}
+	for _, agt := range s.Config.AllowedGrantTypes {
+		if agt == gt {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckClientGrantType checks that the grant type is allowed for the client
+func (s *Server) CheckClientGrantType(cli oauth2server.ClientInfo, gt oauth2server.GrantType) bool {
+	allowed := cli.GetGrantTypes()
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, agt := range allowed {
+		if agt == gt {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckClientScope checks that each of the requested scopes is allowed for the client
+func (s *Server) CheckClientScope(cli oauth2server.ClientInfo, scope string) bool {
+	return oauth2server.ClientScopeAllowed(cli, scope)
+}
+
+// CheckCodeChallengeMethod checks for allowed code challenge method
+func (s *Server) CheckCodeChallengeMethod(ccm oauth2server.CodeChallengeMethod) bool {
+	for _, c := range s.Config.AllowedCodeChallengeMethods {
+		if c == ccm {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRedirectURI get redirect uri
+func (s *Server) GetRedirectURI(req *AuthorizeRequest, data map[string]interface{}) (string, error) {
+	u, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	if req.State != "" {
+		q.Set("state", req.State)
+	}
+
+	for k, v := range data {
+		q.Set(k, fmt.Sprint(v))
+	}
+
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+func (s *Server) redirectError(c *gin.Context, req *AuthorizeRequest, err error) error {
+	if req == nil {
+		return err
+	}
+	data, _, _ := s.GetErrorData(err)
+	return s.redirect(c, req, data)
+}
+
+func (s *Server) redirect(c *gin.Context, req *AuthorizeRequest, data map[string]interface{}) error {
+	uri, err := s.GetRedirectURI(req, data)
+	if err != nil {
+		return err
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+	c.Redirect(http.StatusFound, uri)
+	return nil
+}
+
+// ValidationAuthorizeRequest the authorization request validation.
+// Errors detected before the redirect uri is verified are returned without the request,
+// so they are never sent to an unverified location
+func (s *Server) ValidationAuthorizeRequest(r *http.Request) (*AuthorizeRequest, error) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		return nil, errors.ErrInvalidRequest
+	}
+
+	clientID := r.FormValue("client_id")
+	redirectURI := r.FormValue("redirect_uri")
+	if clientID == "" || redirectURI == "" {
+		return nil, errors.ErrInvalidRequest
+	}
+
+	err := s.Manager.ValidateRedirectURI(clientID, redirectURI)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &AuthorizeRequest{
+		RedirectURI:  redirectURI,
+		ResponseType: oauth2server.ResponseType(r.FormValue("response_type")),
+		ClientID:     clientID,
+		State:        r.FormValue("state"),
+		Scope:        r.FormValue("scope"),
+		Nonce:        r.FormValue("nonce"),
+		Request:      r,
+	}
+
+	if req.ResponseType != oauth2server.Code || !s.CheckGrantType(oauth2server.AuthorizationCode) {
+		return req, errors.ErrUnsupportedResponseType
+	}
+
+	cli, err := s.Manager.GetClient(clientID)
+	if err != nil {
+		return req, err
+	}
+
+	if !s.CheckClientGrantType(cli, oauth2server.AuthorizationCode) {
+		return req, errors.ErrUnauthorizedClient
+	}
+
+	if !s.CheckClientScope(cli, req.Scope) {
+		return req, errors.ErrInvalidScope
+	}
+
+	cc := r.FormValue("code_challenge")
+	ccm, err := s.ValidateCodeChallenge(cc, oauth2server.CodeChallengeMethod(r.FormValue("code_challenge_method")))
+	if err != nil {
+		return req, err
+	}
+
+	if cli.IsPublic() && cc == "" {
+		return req, errors.ErrCodeChallengeRequired
+	}
+
+	req.CodeChallenge = cc
+	req.CodeChallengeMethod = ccm
+
+	return req, nil
+}
+
+// ValidateCodeChallenge validates the PKCE parameters and returns the effective method,
+// empty method means that the challenge is not used
+func (s *Server) ValidateCodeChallenge(cc string, ccm oauth2server.CodeChallengeMethod) (oauth2server.CodeChallengeMethod, error) {
+	if cc == "" {
+		if s.Config.ForcePKCE {
+			return "", errors.ErrCodeChallengeRequired
+		}
+		return "", nil
+	}
+
+	if len(cc) < 43 || len(cc) > 128 {
+		return "", errors.ErrInvalidCodeChallengeLen
+	}
+
+	// https://tools.ietf.org/html/rfc7636#section-4.3
+	if ccm == "" {
+		ccm = oauth2server.CodeChallengePlain
+	}
+	if ccm.String() == "" || !s.CheckCodeChallengeMethod(ccm) {
+		return "", errors.ErrUnsupportedCodeChallengeMethod
+	}
+
+	return ccm, nil
+}
+
+// GetAuthorizeToken get authorization token(code)
+func (s *Server) GetAuthorizeToken(req *AuthorizeRequest) (oauth2server.TokenInfo, error) {
+	// check the client allows to use scope
+	if fn := s.ClientScopeHandler; fn != nil {
+		allowed, err := fn(req.ClientID, req.Scope)
+		if err != nil {
+			return nil, err
+		} else if !allowed {
+			return nil, errors.ErrInvalidScope
+		}
+	}
+
+	tgr := &oauth2server.TokenGenerateRequest{
+		ClientID:            req.ClientID,
+		UserID:              req.UserID,
+		RedirectURI:         req.RedirectURI,
+		Scope:               req.Scope,
+		Nonce:               req.Nonce,
+		AccessTokenExp:      req.AccessTokenExp,
+		CodeChallenge:       req.CodeChallenge,
+		CodeChallengeMethod: req.CodeChallengeMethod,
+		Request:             req.Request,
+	}
+	return s.Manager.GenerateAuthToken(req.ResponseType, tgr)
+}
+
+// GetAuthorizeData get authorization response data
+func (s *Server) GetAuthorizeData(ti oauth2server.TokenInfo) map[string]interface{} {
+	return map[string]interface{}{
+		"code": ti.GetCode(),
+	}
+}
+
+// HandleAuthorizeRequest the authorization request handling
+func (s *Server) HandleAuthorizeRequest(c *gin.Context) error {
+	req, err := s.ValidationAuthorizeRequest(c.Request)
+	if err != nil {
+		return s.redirectError(c, req, err)
+	}
+
+	// user authorization
+	userID, err := s.UserAuthorizationHandler(c.Writer, c.Request)
+	if err != nil {
+		return s.redirectError(c, req, err)
+	} else if userID == 0 {
+		// the handler has already written the response, e.g. redirected to the login page
+		return nil
+	}
+	req.UserID = userID
+
+	if fn := s.AccessTokenExpHandler; fn != nil {
+		exp, err := fn(c.Writer, c.Request)
+		if err != nil {
+			return err
+		}
+		req.AccessTokenExp = exp
+	}
+
+	ti, err := s.GetAuthorizeToken(req)
+	if err != nil {
+		return s.redirectError(c, req, err)
+	}
+
+	return s.redirect(c, req, s.GetAuthorizeData(ti))
+}
+
 // TokenError ...
 func (s *Server) TokenError(c *gin.Context, err error) {
 	data, statusCode, header := s.GetErrorData(err)
@@ -83,17 +336,35 @@ func (s *Server) ValidationTokenRequest(c *gin.Context, trd *oauth2server.TokenR
 	}
 
 	gt := oauth2server.GrantType(trd.GrantType)
-	if gt.String() == "" {
+	if gt.String() == "" || !s.CheckGrantType(gt) {
 		return "", nil, "", errors.ErrUnsupportedGrantType
 	}
 
-	if trd.ClientID == "" || trd.ClientSecret == "" {
+	clientID, clientSecret := trd.ClientID, trd.ClientSecret
+	if clientID == "" {
+		var err error
+		clientID, clientSecret, err = s.ClientInfoHandler(c.Request)
+		if err != nil {
+			return "", nil, "", err
+		}
+	}
+
+	cli, err := s.Manager.GetClient(clientID)
+	if err != nil || cli == nil || !oauth2server.VerifyClientSecret(cli, clientSecret) {
 		return "", nil, "", errors.ErrInvalidClient
 	}
 
+	if !s.CheckClientGrantType(cli, gt) || (cli.IsPublic() && gt == oauth2server.ClientCredentials) {
+		return "", nil, "", errors.ErrUnauthorizedClient
+	}
+
+	if !s.CheckClientScope(cli, trd.Scope) {
+		return "", nil, "", errors.ErrInvalidScope
+	}
+
 	tgr := &oauth2server.TokenGenerateRequest{
-		ClientID:     trd.ClientID,
-		ClientSecret: trd.ClientSecret,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
 		Request:      c.Request,
 	}
 
@@ -101,10 +372,43 @@ func (s *Server) ValidationTokenRequest(c *gin.Context, trd *oauth2server.TokenR
 
 	switch gt {
 
+	case oauth2server.AuthorizationCode:
+		tgr.RedirectURI = trd.RedirectURI
+		tgr.Code = trd.Code
+		tgr.CodeVerifier = trd.CodeVerifier
+		if tgr.RedirectURI == "" || tgr.Code == "" {
+			return "", nil, "", errors.ErrInvalidRequest
+		}
+		if (s.Config.ForcePKCE || cli.IsPublic()) && tgr.CodeVerifier == "" {
+			return "", nil, "", errors.ErrInvalidRequest
+		}
 	case oauth2server.PasswordCredentials:
 		tgr.Scope = trd.Scope
 
-		userID, err := s.PasswordAuthorizationHandler(trd.Username, trd.Password)
+		var userID int64
+		var err error
+		if trd.MFAToken != "" {
+			// second step after the mfa_required error
+			userID, err = s.MFAAuthorizationHandler(trd.MFAToken, trd.OTP, trd.ClientIP)
+		} else {
+			userID, err = s.PasswordAuthorizationHandler(trd.Username, trd.Password, trd.ClientIP)
+		}
+		if err != nil {
+			return "", nil, "", err
+		} else if userID == 0 {
+			return "", nil, "", errors.ErrInvalidGrant
+		}
+		tgr.UserID = userID
+	case oauth2server.ClientCredentials:
+		tgr.Scope = trd.Scope
+	case oauth2server.WebAuthn:
+		tgr.Scope = trd.Scope
+
+		if trd.ChallengeID == "" || trd.Credential == "" {
+			return "", nil, "", errors.ErrInvalidRequest
+		}
+
+		userID, err := s.WebAuthnAuthorizationHandler(trd.ChallengeID, trd.Credential, trd.ClientIP)
 		if err != nil {
 			return "", nil, "", err
 		} else if userID == 0 {
@@ -117,7 +421,7 @@ func (s *Server) ValidationTokenRequest(c *gin.Context, trd *oauth2server.TokenR
 		var userID int64
 		var err error
 
-		userID, redirectURI, err = s.SocialAuthorizationHandler(trd.Code, trd.State, trd.ClientIP)
+		userID, redirectURI, err = s.SocialAuthorizationHandler(c.Request.Context(), trd.Code, trd.State, trd.ClientIP)
 		if err != nil {
 			return "", nil, "", err
 		} else if userID == 0 {
@@ -138,7 +442,21 @@ func (s *Server) ValidationTokenRequest(c *gin.Context, trd *oauth2server.TokenR
 func (s *Server) GetAccessToken(gt oauth2server.GrantType, tgr *oauth2server.TokenGenerateRequest) (oauth2server.TokenInfo, error) {
 	switch gt {
 
-	case oauth2server.PasswordCredentials, oauth2server.SocialAuthorizationCode:
+	case oauth2server.AuthorizationCode:
+		ti, err := s.Manager.GenerateAccessToken(gt, tgr)
+		if err != nil {
+			switch err {
+			case errors.ErrInvalidAuthorizeCode,
+				errors.ErrInvalidCodeChallenge,
+				errors.ErrMissingCodeChallenge,
+				errors.ErrMissingCodeVerifier:
+				return nil, errors.ErrInvalidGrant
+			}
+			return nil, err
+		}
+		return ti, nil
+	case oauth2server.PasswordCredentials, oauth2server.ClientCredentials, oauth2server.SocialAuthorizationCode,
+		oauth2server.WebAuthn:
 		if fn := s.ClientScopeHandler; fn != nil {
 			allowed, err := fn(tgr.ClientID, tgr.Scope)
 			if err != nil {
@@ -180,6 +498,177 @@ func (s *Server) GetAccessToken(gt oauth2server.GrantType, tgr *oauth2server.Tok
 	}
 }
 
+// AuthenticateClient identifies the client of the request and checks its credentials
+func (s *Server) AuthenticateClient(r *http.Request) (oauth2server.ClientInfo, error) {
+	clientID, clientSecret, err := s.ClientInfoHandler(r)
+	if err != nil {
+		return nil, err
+	}
+
+	cli, err := s.Manager.GetClient(clientID)
+	if err != nil || cli == nil || !oauth2server.VerifyClientSecret(cli, clientSecret) {
+		return nil, errors.ErrInvalidClient
+	}
+
+	return cli, nil
+}
+
+// HandleRevocationRequest the token revocation request handling
+// https://tools.ietf.org/html/rfc7009
+func (s *Server) HandleRevocationRequest(c *gin.Context) error {
+	if c.Request.Method != http.MethodPost {
+		return errors.ErrInvalidRequest
+	}
+
+	cli, err := s.AuthenticateClient(c.Request)
+	if err != nil {
+		return err
+	}
+
+	rrd := oauth2server.RevocationRequestData{}
+	err = c.ShouldBind(&rrd)
+	if err != nil || rrd.Token == "" {
+		return errors.ErrInvalidRequest
+	}
+
+	hint := oauth2server.TokenTypeHint(rrd.TokenTypeHint)
+	if hint != "" && hint.String() == "" {
+		return errors.ErrUnsupportedTokenType
+	}
+
+	err = s.RevokeToken(cli, rrd.Token, hint)
+	if err != nil {
+		return err
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+	c.Status(http.StatusOK)
+
+	return nil
+}
+
+// LoadToken finds the token, trying the hinted type first.
+// Returns nil for unknown, invalid and expired tokens
+func (s *Server) LoadToken(token string, hint oauth2server.TokenTypeHint) (oauth2server.TokenInfo, oauth2server.TokenTypeHint, error) {
+	types := []oauth2server.TokenTypeHint{oauth2server.AccessTokenHint, oauth2server.RefreshTokenHint}
+	if hint == oauth2server.RefreshTokenHint {
+		types = []oauth2server.TokenTypeHint{oauth2server.RefreshTokenHint, oauth2server.AccessTokenHint}
+	}
+
+	for _, tt := range types {
+		var ti oauth2server.TokenInfo
+		var err error
+		if tt == oauth2server.RefreshTokenHint {
+			ti, err = s.Manager.LoadRefreshToken(token)
+		} else {
+			ti, err = s.Manager.LoadAccessToken(token)
+		}
+
+		switch err {
+		case nil:
+			return ti, tt, nil
+		case errors.ErrInvalidAccessToken, errors.ErrExpiredAccessToken,
+			errors.ErrInvalidRefreshToken, errors.ErrExpiredRefreshToken:
+			continue
+		default:
+			return nil, "", err
+		}
+	}
+
+	return nil, "", nil
+}
+
+// RevokeToken removes the token issued to the client.
+// Unknown, invalid and expired tokens are ignored, as the RFC 7009 requires
+func (s *Server) RevokeToken(cli oauth2server.ClientInfo, token string, hint oauth2server.TokenTypeHint) error {
+	ti, tt, err := s.LoadToken(token, hint)
+	if err != nil {
+		return err
+	}
+
+	if ti != nil {
+		if ti.GetClientID() != cli.GetID() {
+			return errors.ErrUnauthorizedClient
+		}
+
+		if tt == oauth2server.RefreshTokenHint {
+			return s.Manager.RemoveRefreshToken(token)
+		}
+		return s.Manager.RemoveAccessToken(token)
+	}
+
+	return nil
+}
+
+// HandleIntrospectionRequest the token introspection request handling
+// https://tools.ietf.org/html/rfc7662
+func (s *Server) HandleIntrospectionRequest(c *gin.Context) error {
+	if c.Request.Method != http.MethodPost {
+		return errors.ErrInvalidRequest
+	}
+
+	_, err := s.AuthenticateClient(c.Request)
+	if err != nil {
+		return err
+	}
+
+	ird := oauth2server.IntrospectionRequestData{}
+	err = c.ShouldBind(&ird)
+	if err != nil || ird.Token == "" {
+		return errors.ErrInvalidRequest
+	}
+
+	ti, tt, err := s.LoadToken(ird.Token, oauth2server.TokenTypeHint(ird.TokenTypeHint))
+	if err != nil {
+		return err
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+	c.JSON(http.StatusOK, s.GetIntrospectionData(ti, tt))
+
+	return nil
+}
+
+// GetIntrospectionData introspection response data, inactive for the nil token
+func (s *Server) GetIntrospectionData(ti oauth2server.TokenInfo, tt oauth2server.TokenTypeHint) map[string]interface{} {
+	if ti == nil {
+		return map[string]interface{}{
+			"active": false,
+		}
+	}
+
+	sub := ti.GetClientID()
+	if userID := ti.GetUserID(); userID != 0 {
+		sub = strconv.FormatInt(userID, 10)
+	}
+
+	data := map[string]interface{}{
+		"active":    true,
+		"sub":       sub,
+		"client_id": ti.GetClientID(),
+	}
+
+	if scope := ti.GetScope(); scope != "" {
+		data["scope"] = scope
+	}
+
+	createAt, expiresIn := ti.GetAccessCreateAt(), ti.GetAccessExpiresIn()
+	data["token_type"] = "Bearer"
+	if tt == oauth2server.RefreshTokenHint {
+		createAt, expiresIn = ti.GetRefreshCreateAt(), ti.GetRefreshExpiresIn()
+		data["token_type"] = string(oauth2server.RefreshTokenHint)
+	}
+
+	data["iat"] = createAt.Unix()
+	if expiresIn > 0 {
+		data["exp"] = createAt.Add(expiresIn).Unix()
+	}
+
+	return data
+}
+
 // GetTokenData token data
 func (s *Server) GetTokenData(ti oauth2server.TokenInfo) map[string]interface{} {
 	data := map[string]interface{}{
@@ -211,7 +700,27 @@ func (s *Server) GetTokenData(ti oauth2server.TokenInfo) map[string]interface{}
 // GetErrorData get error response data
 func (s *Server) GetErrorData(err error) (map[string]interface{}, int, http.Header) {
 	var re errors.Response
-	if v, ok := errors.Descriptions[err]; ok {
+	if le, ok := err.(*errors.LockedError); ok {
+		re.Error = errors.ErrTooManyAttempts
+		re.Description = errors.Descriptions[errors.ErrTooManyAttempts]
+		re.StatusCode = errors.StatusCodes[errors.ErrTooManyAttempts]
+		re.Header = make(http.Header)
+		re.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(le.RetryAfter.Seconds()))))
+	} else if me, ok := err.(*errors.MFARequiredError); ok {
+		re.Error = errors.ErrMFARequired
+		re.Description = errors.Descriptions[errors.ErrMFARequired]
+		re.StatusCode = errors.StatusCodes[errors.ErrMFARequired]
+		re.Fields = map[string]interface{}{
+			"mfa_token": me.Token,
+		}
+	} else if ae, ok := err.(*errors.AccountConflictError); ok {
+		re.Error = errors.ErrAccountConflict
+		re.Description = errors.Descriptions[errors.ErrAccountConflict]
+		re.StatusCode = errors.StatusCodes[errors.ErrAccountConflict]
+		re.Fields = map[string]interface{}{
+			"link_token": ae.Token,
+		}
+	} else if v, ok := errors.Descriptions[err]; ok {
 		re.Error = err
 		re.Description = v
 		re.StatusCode = errors.StatusCodes[err]
@@ -234,6 +743,14 @@ func (s *Server) GetErrorData(err error) (map[string]interface{}, int, http.Head
 		fn(&re)
 	}
 
+	// https://tools.ietf.org/html/rfc6749#section-5.2
+	if re.Error == errors.ErrInvalidClient {
+		if re.Header == nil {
+			re.Header = make(http.Header)
+		}
+		re.Header.Set("WWW-Authenticate", `Basic realm="oauth2"`)
+	}
+
 	data := make(map[string]interface{})
 	if err := re.Error; err != nil {
 		data["error"] = err.Error()
@@ -251,6 +768,10 @@ func (s *Server) GetErrorData(err error) (map[string]interface{}, int, http.Head
 		data["error_uri"] = v
 	}
 
+	for k, v := range re.Fields {
+		data[k] = v
+	}
+
 	statusCode := http.StatusInternalServerError
 	if v := re.StatusCode; v > 0 {
 		statusCode = v
@@ -1,5 +1,10 @@
 package server
 
+// SetClientInfoHandler get client info from request
+func (s *Server) SetClientInfoHandler(handler ClientInfoHandler) {
+	s.ClientInfoHandler = handler
+}
+
 // SetClientScopeHandler check the client allows to use scope
 func (s *Server) SetClientScopeHandler(handler ClientScopeHandler) {
 	s.ClientScopeHandler = handler
@@ -15,6 +20,16 @@ func (s *Server) SetPasswordAuthorizationHandler(handler PasswordAuthorizationHa
 	s.PasswordAuthorizationHandler = handler
 }
 
+// SetMFAAuthorizationHandler get user id from mfa token and one-time password
+func (s *Server) SetMFAAuthorizationHandler(handler MFAAuthorizationHandler) {
+	s.MFAAuthorizationHandler = handler
+}
+
+// SetWebAuthnAuthorizationHandler get user id from the passkey assertion
+func (s *Server) SetWebAuthnAuthorizationHandler(handler WebAuthnAuthorizationHandler) {
+	s.WebAuthnAuthorizationHandler = handler
+}
+
 // SetSocialAuthorizationHandler get user id from social network
 func (s *Server) SetSocialAuthorizationHandler(handler SocialAuthorizationHandler) {
 	s.SocialAuthorizationHandler = handler
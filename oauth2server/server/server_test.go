@@ -0,0 +1,82 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/autowp/auth/oauth2server"
+	"github.com/autowp/auth/oauth2server/errors"
+)
+
+// https://tools.ietf.org/html/rfc7636#appendix-B
+const (
+	testCodeVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	testCodeChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+func TestValidateCodeChallenge(t *testing.T) {
+	cases := []struct {
+		name      string
+		forcePKCE bool
+		allowed   []oauth2server.CodeChallengeMethod
+		cc        string
+		ccm       oauth2server.CodeChallengeMethod
+		method    oauth2server.CodeChallengeMethod
+		err       error
+	}{
+		{name: "without challenge", cc: "", method: ""},
+		{name: "required challenge", forcePKCE: true, cc: "", err: errors.ErrCodeChallengeRequired},
+		{name: "S256", cc: testCodeChallenge, ccm: oauth2server.CodeChallengeS256, method: oauth2server.CodeChallengeS256},
+		{name: "default plain", cc: testCodeVerifier, ccm: "", method: oauth2server.CodeChallengePlain},
+		{name: "short", cc: testCodeChallenge[:42], ccm: oauth2server.CodeChallengeS256, err: errors.ErrInvalidCodeChallengeLen},
+		{name: "long", cc: strings.Repeat("a", 129), ccm: oauth2server.CodeChallengePlain, err: errors.ErrInvalidCodeChallengeLen},
+		{name: "unknown method", cc: testCodeChallenge, ccm: "S512", err: errors.ErrUnsupportedCodeChallengeMethod},
+		{
+			name:    "disallowed method",
+			allowed: []oauth2server.CodeChallengeMethod{oauth2server.CodeChallengeS256},
+			cc:      testCodeVerifier,
+			ccm:     oauth2server.CodeChallengePlain,
+			err:     errors.ErrUnsupportedCodeChallengeMethod,
+		},
+	}
+
+	for _, tc := range cases {
+		cfg := NewConfig()
+		cfg.ForcePKCE = tc.forcePKCE
+		if tc.allowed != nil {
+			cfg.AllowedCodeChallengeMethods = tc.allowed
+		}
+		srv := NewServer(cfg, nil)
+
+		method, err := srv.ValidateCodeChallenge(tc.cc, tc.ccm)
+		if err != tc.err {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+			continue
+		}
+		if method != tc.method {
+			t.Errorf("%s: expected method `%s`, got `%s`", tc.name, tc.method, method)
+		}
+	}
+}
+
+func TestCodeChallengeMethodValidate(t *testing.T) {
+	cases := []struct {
+		ccm   oauth2server.CodeChallengeMethod
+		cc    string
+		ver   string
+		valid bool
+	}{
+		{oauth2server.CodeChallengeS256, testCodeChallenge, testCodeVerifier, true},
+		{oauth2server.CodeChallengeS256, testCodeChallenge, testCodeVerifier[1:], false},
+		{oauth2server.CodeChallengeS256, testCodeVerifier, testCodeVerifier, false},
+		{oauth2server.CodeChallengePlain, testCodeVerifier, testCodeVerifier, true},
+		{oauth2server.CodeChallengePlain, testCodeChallenge, testCodeVerifier, false},
+		{"S512", testCodeChallenge, testCodeVerifier, false},
+	}
+
+	for _, tc := range cases {
+		if valid := tc.ccm.Validate(tc.cc, tc.ver); valid != tc.valid {
+			t.Errorf("%s: expected %v for verifier `%s`, got %v", tc.ccm, tc.valid, tc.ver, valid)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package oauth2server
+
+import "time"
+
+// Session the chain of the tokens issued by the single login, identified by the token family
+type Session struct {
+	ID         string    `json:"id"`
+	ClientID   string    `json:"client_id"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
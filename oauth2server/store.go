@@ -1,5 +1,7 @@
 package oauth2server
 
+import "time"
+
 type (
 	// ClientStore the client information storage interface
 	ClientStore interface {
@@ -30,4 +32,27 @@ type (
 		// use the refresh token for token information data
 		GetByRefresh(refresh string) (TokenInfo, error)
 	}
+
+	// TokenFamilyStore the token store which keeps the rotated out refresh tokens until they expire,
+	// so the replay of the rotated token can be detected
+	TokenFamilyStore interface {
+		// mark the refresh token as rotated out and drop its access token,
+		// false when the token is already rotated
+		RotateRefresh(refresh string, rotatedAt time.Time) (bool, error)
+
+		// delete all the tokens of the family
+		RemoveFamily(family string) error
+	}
+
+	// TokenSessionStore the token store which can list and revoke the grants of the user
+	TokenSessionStore interface {
+		// list the active sessions of the user, the most recently used first
+		GetSessionsByUser(userID int64) ([]Session, error)
+
+		// delete all the tokens of the user session, false when the session is not found
+		RemoveUserSession(userID int64, id string) (bool, error)
+
+		// delete all the tokens issued to the user
+		RemoveByUser(userID int64) error
+	}
 )
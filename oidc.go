@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/autowp/auth/oauth2server"
+	"github.com/getsentry/sentry-go"
+	"github.com/gin-gonic/gin"
+)
+
+// OpenID Connect scopes
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+func hasScope(scope string, value string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Service) userClaims(userID int64, scope string) (map[string]interface{}, error) {
+	user, err := s.userStore.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		return nil, fmt.Errorf("User %d not found", userID)
+	}
+
+	claims := map[string]interface{}{}
+
+	if hasScope(scope, ScopeProfile) {
+		claims["name"] = user.Name
+		if user.Login != nil {
+			claims["preferred_username"] = *user.Login
+		}
+	}
+
+	if hasScope(scope, ScopeEmail) && user.EMail != nil {
+		claims["email"] = *user.EMail
+		claims["email_verified"] = true
+	}
+
+	return claims, nil
+}
+
+func (s *Service) idTokenFields(ti oauth2server.TokenInfo) map[string]interface{} {
+	if ti.GetUserID() == 0 || !hasScope(ti.GetScope(), ScopeOpenID) {
+		return nil
+	}
+
+	// without the asymmetric keys the id tokens are not issued
+	if len(s.accessGenerate.IDTokenAlgorithms()) == 0 {
+		return nil
+	}
+
+	idToken, err := s.idToken(ti)
+	if err != nil {
+		log.Println("Failed to issue id_token:", err.Error())
+		sentry.CaptureException(err)
+		return nil
+	}
+
+	return map[string]interface{}{
+		"id_token": idToken,
+	}
+}
+
+func (s *Service) idToken(ti oauth2server.TokenInfo) (string, error) {
+	cli, err := s.oauthServer.Manager.GetClient(ti.GetClientID())
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := s.userClaims(ti.GetUserID(), ti.GetScope())
+	if err != nil {
+		return "", err
+	}
+
+	return s.accessGenerate.IDToken(&oauth2server.GenerateBasic{
+		Client:    cli,
+		UserID:    ti.GetUserID(),
+		CreateAt:  ti.GetAccessCreateAt(),
+		TokenInfo: ti,
+	}, ti.GetNonce(), claims)
+}
+
+func (s *Service) handleUserInfo(c *gin.Context) {
+	ti, err := s.oauthServer.ValidationBearerToken(c.Request)
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	if ti.GetUserID() == 0 || !hasScope(ti.GetScope(), ScopeOpenID) {
+		c.Header("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+		c.Status(http.StatusForbidden)
+		return
+	}
+
+	claims, err := s.userClaims(ti.GetUserID(), ti.GetScope())
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	claims["sub"] = strconv.FormatInt(ti.GetUserID(), 10)
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, claims)
+}
+
+func (s *Service) handleOpenIDConfiguration(c *gin.Context) {
+	issuer := strings.TrimRight(s.config.OAuth.Issuer, "/")
+
+	grantTypes := make([]string, 0)
+	for _, gt := range []oauth2server.GrantType{
+		oauth2server.AuthorizationCode,
+		oauth2server.PasswordCredentials,
+		oauth2server.ClientCredentials,
+		oauth2server.Refreshing,
+		oauth2server.SocialAuthorizationCode,
+		oauth2server.WebAuthn,
+	} {
+		if s.oauthServer.CheckGrantType(gt) {
+			grantTypes = append(grantTypes, gt.String())
+		}
+	}
+
+	responseTypes := make([]string, 0)
+	if s.oauthServer.CheckGrantType(oauth2server.AuthorizationCode) {
+		responseTypes = append(responseTypes, oauth2server.Code.String())
+	}
+
+	codeChallengeMethods := make([]string, 0)
+	for _, ccm := range s.oauthServer.Config.AllowedCodeChallengeMethods {
+		codeChallengeMethods = append(codeChallengeMethods, ccm.String())
+	}
+
+	authMethods := []string{AuthMethodClientSecretBasic, AuthMethodClientSecretPost}
+	tokenAuthMethods := append([]string{AuthMethodNone}, authMethods...)
+
+	data := gin.H{
+		"issuer":                                issuer,
+		"token_endpoint":                        issuer + "/api/oauth/token",
+		"userinfo_endpoint":                     issuer + "/api/oauth/userinfo",
+		"revocation_endpoint":                   issuer + "/api/oauth/revoke",
+		"introspection_endpoint":                issuer + "/api/oauth/introspect",
+		"response_types_supported":              responseTypes,
+		"grant_types_supported":                 grantTypes,
+		"subject_types_supported":               []string{"public"},
+		"jwks_uri":                              issuer + "/.well-known/jwks.json",
+		"id_token_signing_alg_values_supported": s.accessGenerate.IDTokenAlgorithms(),
+		"scopes_supported":                      []string{ScopeOpenID, ScopeProfile, ScopeEmail},
+		"claims_supported": []string{
+			"iss", "sub", "aud", "exp", "iat", "nonce",
+			"name", "preferred_username", "email", "email_verified",
+		},
+		"token_endpoint_auth_methods_supported":         tokenAuthMethods,
+		"revocation_endpoint_auth_methods_supported":    authMethods,
+		"introspection_endpoint_auth_methods_supported": authMethods,
+		"code_challenge_methods_supported":              codeChallengeMethods,
+	}
+
+	if len(responseTypes) > 0 {
+		data["authorization_endpoint"] = issuer + "/api/oauth/authorize"
+	}
+
+	if s.config.OAuth.Registration.Enabled {
+		data["registration_endpoint"] = issuer + "/register"
+	}
+
+	c.JSON(http.StatusOK, data)
+}
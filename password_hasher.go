@@ -0,0 +1,266 @@
+package auth
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasherConfig PasswordHasherConfig
+type PasswordHasherConfig struct {
+	Algorithm     string `yaml:"algorithm"      mapstructure:"algorithm"`
+	BcryptCost    int    `yaml:"bcrypt_cost"    mapstructure:"bcrypt_cost"`
+	Argon2Time    uint32 `yaml:"argon2_time"    mapstructure:"argon2_time"`
+	Argon2Memory  uint32 `yaml:"argon2_memory"  mapstructure:"argon2_memory"`
+	Argon2Threads uint8  `yaml:"argon2_threads" mapstructure:"argon2_threads"`
+}
+
+// PasswordHasher hashes and verifies passwords of one format
+type PasswordHasher interface {
+	// Hash returns the encoded hash of the password
+	Hash(password string) (string, error)
+	// Supports reports whether the hash is of this hasher format
+	Supports(hash string) bool
+	// Verify compares the password with the hash in constant time
+	Verify(hash string, password string) bool
+	// NeedsRehash reports whether the hash was produced with other parameters
+	NeedsRehash(hash string) bool
+}
+
+// Argon2idHasher argon2id in the PHC string format
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+}
+
+const argon2idPrefix = "$argon2id$"
+
+type argon2idHash struct {
+	version int
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2idHash(hash string) (*argon2idHash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, fmt.Errorf("invalid argon2id hash")
+	}
+
+	h := &argon2idHash{}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &h.version); err != nil {
+		return nil, err
+	}
+	if h.version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2 version %d", h.version)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, err
+	}
+
+	var err error
+	h.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, err
+	}
+	h.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// Hash Hash
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+
+	return fmt.Sprintf(
+		"%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, argon2.Version, h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Supports Supports
+func (h *Argon2idHasher) Supports(hash string) bool {
+	return strings.HasPrefix(hash, argon2idPrefix)
+}
+
+// Verify Verify
+func (h *Argon2idHasher) Verify(hash string, password string) bool {
+	parsed, err := parseArgon2idHash(hash)
+	if err != nil {
+		return false
+	}
+
+	key := argon2.IDKey([]byte(password), parsed.salt, parsed.time, parsed.memory, parsed.threads, uint32(len(parsed.key)))
+
+	return subtle.ConstantTimeCompare(key, parsed.key) == 1
+}
+
+// NeedsRehash NeedsRehash
+func (h *Argon2idHasher) NeedsRehash(hash string) bool {
+	parsed, err := parseArgon2idHash(hash)
+	if err != nil {
+		return true
+	}
+
+	return parsed.time != h.Time || parsed.memory != h.Memory || parsed.threads != h.Threads ||
+		uint32(len(parsed.key)) != h.KeyLen || uint32(len(parsed.salt)) != h.SaltLen
+}
+
+// BcryptHasher BcryptHasher
+type BcryptHasher struct {
+	Cost int
+}
+
+// Hash Hash
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// Supports Supports
+func (h *BcryptHasher) Supports(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// Verify Verify
+func (h *BcryptHasher) Verify(hash string, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// NeedsRehash NeedsRehash
+func (h *BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return true
+	}
+
+	return cost != h.Cost
+}
+
+// LegacyMD5Hasher verifies hashes stored as MD5(CONCAT(salt, password)).
+// It is never used to produce new hashes
+type LegacyMD5Hasher struct {
+	Salt string
+}
+
+func (h *LegacyMD5Hasher) sum(password string) string {
+	sum := md5.Sum([]byte(h.Salt + password))
+	return hex.EncodeToString(sum[:])
+}
+
+// Hash Hash
+func (h *LegacyMD5Hasher) Hash(password string) (string, error) {
+	return h.sum(password), nil
+}
+
+// Supports Supports
+func (h *LegacyMD5Hasher) Supports(hash string) bool {
+	if len(hash) != md5.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// Verify Verify
+func (h *LegacyMD5Hasher) Verify(hash string, password string) bool {
+	return subtle.ConstantTimeCompare([]byte(strings.ToLower(hash)), []byte(h.sum(password))) == 1
+}
+
+// NeedsRehash NeedsRehash
+func (h *LegacyMD5Hasher) NeedsRehash(hash string) bool {
+	return true
+}
+
+// Passwords picks the hasher by the stored hash format and hashes new passwords with the current one
+type Passwords struct {
+	current PasswordHasher
+	hashers []PasswordHasher
+	dummy   string
+}
+
+// NewPasswords constructor
+func NewPasswords(config PasswordHasherConfig, legacySalt string) (*Passwords, error) {
+	argon2id := &Argon2idHasher{
+		Time:    config.Argon2Time,
+		Memory:  config.Argon2Memory,
+		Threads: config.Argon2Threads,
+		KeyLen:  32,
+		SaltLen: 16,
+	}
+	bcryptHasher := &BcryptHasher{Cost: config.BcryptCost}
+
+	var current PasswordHasher
+	switch config.Algorithm {
+	case "argon2id":
+		current = argon2id
+	case "bcrypt":
+		current = bcryptHasher
+	default:
+		return nil, fmt.Errorf("Unsupported password hash algorithm `%s`", config.Algorithm)
+	}
+
+	p := &Passwords{
+		current: current,
+		hashers: []PasswordHasher{argon2id, bcryptHasher, &LegacyMD5Hasher{Salt: legacySalt}},
+	}
+
+	dummy, err := current.Hash("dummy")
+	if err != nil {
+		return nil, err
+	}
+	p.dummy = dummy
+
+	return p, nil
+}
+
+// Hash hashes the password with the current hasher
+func (p *Passwords) Hash(password string) (string, error) {
+	return p.current.Hash(password)
+}
+
+// Verify verifies the password and reports whether the hash should be replaced with the current one
+func (p *Passwords) Verify(hash string, password string) (bool, bool) {
+	for _, hasher := range p.hashers {
+		if hasher.Supports(hash) {
+			if !hasher.Verify(hash, password) {
+				return false, false
+			}
+			return true, hasher != p.current || hasher.NeedsRehash(hash)
+		}
+	}
+
+	return false, false
+}
+
+// VerifyDummy spends the same time as the real verification, so unknown users can not be detected by timing
+func (p *Passwords) VerifyDummy(password string) {
+	p.current.Verify(p.dummy, password)
+}
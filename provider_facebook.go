@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/facebook"
+)
+
+func init() {
+	RegisterSocialProviderType("facebook", newFacebookProvider)
+}
+
+// FacebookUser ...
+type FacebookUser struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type facebookProvider struct {
+	oauth2Provider
+}
+
+func newFacebookProvider(config ServiceConfig, redirectURI string) (SocialProvider, error) {
+	return &facebookProvider{newOAuth2Provider(config, redirectURI, facebook.Endpoint)}, nil
+}
+
+// UserInfo UserInfo
+func (p *facebookProvider) UserInfo(ctx context.Context, token *oauth2.Token, state *State) (*UserInfo, error) {
+	httpClient := p.config.Client(ctx, token)
+
+	resp, err := httpClient.Get("https://graph.facebook.com/v6.0/me?fields=id,name")
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := readOKBody(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	fbUser := FacebookUser{}
+	err = json.Unmarshal(body, &fbUser)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UserInfo{
+		ID:   fbUser.ID,
+		Name: fbUser.Name,
+		URL:  "",
+	}, nil
+}
@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"context"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	goauth2 "google.golang.org/api/oauth2/v2"
+	"google.golang.org/api/option"
+)
+
+func init() {
+	RegisterSocialProviderType("google", newGoogleProvider)
+}
+
+type googleProvider struct {
+	oauth2Provider
+}
+
+func newGoogleProvider(config ServiceConfig, redirectURI string) (SocialProvider, error) {
+	return &googleProvider{newOAuth2Provider(config, redirectURI, google.Endpoint)}, nil
+}
+
+// UserInfo UserInfo
+func (p *googleProvider) UserInfo(ctx context.Context, token *oauth2.Token, state *State) (*UserInfo, error) {
+	httpClient := p.config.Client(ctx, token)
+
+	goauth2Service, err := goauth2.NewService(ctx, option.WithHTTPClient(httpClient))
+	if err != nil {
+		return nil, err
+	}
+
+	gUserInfo, err := goauth2Service.Userinfo.V2.Me.Get().Do()
+	if err != nil {
+		return nil, err
+	}
+
+	return &UserInfo{
+		ID:   gUserInfo.Id,
+		Name: gUserInfo.Name,
+		URL:  gUserInfo.Link,
+	}, nil
+}
@@ -0,0 +1,325 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/autowp/auth/oauth2server/generates"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/tidwall/gjson"
+	"golang.org/x/oauth2"
+)
+
+// jwksRefreshInterval limits refetching of the upstream keys on unknown kid
+const jwksRefreshInterval = time.Minute
+
+func init() {
+	RegisterSocialProviderType("oidc", newOIDCProvider)
+}
+
+// oidcDiscovery subset of the OpenID Provider Metadata
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider generic upstream provider.
+// With issuer configured the endpoints are discovered and the id_token is required,
+// otherwise it is the plain OAuth2 provider with the profile taken from the userinfo endpoint
+type oidcProvider struct {
+	serviceConfig ServiceConfig
+	redirectURI   string
+	claims        ServiceClaimsConfig
+
+	mutex         sync.Mutex
+	config        *oauth2.Config
+	userInfoURL   string
+	jwksURL       string
+	jwks          *generates.JWKSet
+	jwksFetchedAt time.Time
+}
+
+func newOIDCProvider(config ServiceConfig, redirectURI string) (SocialProvider, error) {
+	if config.Issuer == "" && (config.AuthURL == "" || config.TokenURL == "" || config.UserInfoURL == "") {
+		return nil, fmt.Errorf("issuer or auth_url, token_url and userinfo_url are required")
+	}
+
+	claims := config.Claims
+	if claims.ID == "" {
+		claims.ID = "sub"
+	}
+	if claims.Name == "" {
+		claims.Name = "name"
+	}
+	if claims.URL == "" {
+		claims.URL = "profile"
+	}
+
+	return &oidcProvider{
+		serviceConfig: config,
+		redirectURI:   redirectURI,
+		claims:        claims,
+	}, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	body, err := readOKBody(resp)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// endpoints discovers the upstream once, failed discovery is retried on the next request
+func (p *oidcProvider) endpoints(ctx context.Context) (*oauth2.Config, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.config != nil {
+		return p.config, nil
+	}
+
+	discovery := oidcDiscovery{}
+	if p.serviceConfig.Issuer != "" {
+		url := strings.TrimSuffix(p.serviceConfig.Issuer, "/") + "/.well-known/openid-configuration"
+		err := getJSON(ctx, socialHTTPClient, url, &discovery)
+		if err != nil {
+			return nil, err
+		}
+		if discovery.Issuer != p.serviceConfig.Issuer {
+			return nil, fmt.Errorf("Issuer mismatch: `%s`", discovery.Issuer)
+		}
+	}
+
+	override := func(explicit, discovered string) string {
+		if explicit != "" {
+			return explicit
+		}
+		return discovered
+	}
+
+	scopes := p.serviceConfig.Scopes
+	if p.serviceConfig.Issuer != "" && !hasScope(strings.Join(scopes, " "), ScopeOpenID) {
+		scopes = append([]string{ScopeOpenID}, scopes...)
+	}
+
+	p.config = &oauth2.Config{
+		ClientID:     p.serviceConfig.ClientID,
+		ClientSecret: p.serviceConfig.ClientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  override(p.serviceConfig.AuthURL, discovery.AuthorizationEndpoint),
+			TokenURL: override(p.serviceConfig.TokenURL, discovery.TokenEndpoint),
+		},
+		Scopes:      scopes,
+		RedirectURL: p.redirectURI,
+	}
+	p.userInfoURL = override(p.serviceConfig.UserInfoURL, discovery.UserInfoEndpoint)
+	p.jwksURL = override(p.serviceConfig.JWKSURL, discovery.JWKSURI)
+
+	return p.config, nil
+}
+
+// AuthCodeURL AuthCodeURL
+func (p *oidcProvider) AuthCodeURL(ctx context.Context, stateID string, state *State) (string, error) {
+	config, err := p.endpoints(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	opts := []oauth2.AuthCodeOption{oauth2.AccessTypeOnline}
+
+	if p.serviceConfig.Issuer != "" {
+		nonce, err := randomBase64String(32)
+		if err != nil {
+			return "", err
+		}
+		state.Nonce = nonce
+		opts = append(opts, oauth2.SetAuthURLParam("nonce", nonce))
+	}
+
+	return config.AuthCodeURL(stateID, opts...), nil
+}
+
+// Exchange Exchange
+func (p *oidcProvider) Exchange(ctx context.Context, code string, state *State) (*oauth2.Token, error) {
+	config, err := p.endpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return config.Exchange(ctx, code)
+}
+
+// UserInfo UserInfo
+func (p *oidcProvider) UserInfo(ctx context.Context, token *oauth2.Token, state *State) (*UserInfo, error) {
+	config, err := p.endpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var profile []byte
+	subject := ""
+
+	if p.serviceConfig.Issuer != "" {
+		rawIDToken, _ := token.Extra("id_token").(string)
+		if rawIDToken == "" {
+			return nil, fmt.Errorf("id_token is missing")
+		}
+
+		claims, err := p.verifyIDToken(ctx, rawIDToken, state.Nonce)
+		if err != nil {
+			return nil, err
+		}
+
+		subject, _ = claims["sub"].(string)
+
+		profile, err = json.Marshal(claims)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.userInfoURL != "" {
+		var userInfo json.RawMessage
+		err = getJSON(ctx, config.Client(ctx, token), p.userInfoURL, &userInfo)
+		if err != nil {
+			return nil, err
+		}
+
+		// userinfo response must belong to the id_token subject
+		if subject != "" && gjson.GetBytes(userInfo, "sub").String() != subject {
+			return nil, fmt.Errorf("userinfo sub mismatch")
+		}
+
+		profile = userInfo
+	}
+
+	return &UserInfo{
+		ID:   gjson.GetBytes(profile, p.claims.ID).String(),
+		Name: gjson.GetBytes(profile, p.claims.Name).String(),
+		URL:  gjson.GetBytes(profile, p.claims.URL).String(),
+	}, nil
+}
+
+func (p *oidcProvider) verifyIDToken(ctx context.Context, rawIDToken string, nonce string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(rawIDToken, func(token *jwt.Token) (interface{}, error) {
+		return p.verificationKey(ctx, token)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, fmt.Errorf("invalid id_token claims")
+	}
+
+	if !claims.VerifyIssuer(p.serviceConfig.Issuer, true) {
+		return nil, fmt.Errorf("invalid id_token issuer")
+	}
+
+	if !audienceContains(claims["aud"], p.serviceConfig.ClientID) {
+		return nil, fmt.Errorf("invalid id_token audience")
+	}
+
+	if _, ok := claims["exp"]; !ok {
+		return nil, fmt.Errorf("id_token exp is missing")
+	}
+
+	tokenNonce, _ := claims["nonce"].(string)
+	if nonce == "" || subtle.ConstantTimeCompare([]byte(tokenNonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("invalid id_token nonce")
+	}
+
+	return claims, nil
+}
+
+func audienceContains(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok && s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *oidcProvider) verificationKey(ctx context.Context, token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		// symmetric id_token is signed with the client secret
+		return []byte(p.serviceConfig.ClientSecret), nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+
+	key, err := p.findKey(ctx, kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if !key.Accepts(token.Method) {
+		return nil, fmt.Errorf("Key `%s` does not accept %s", kid, token.Method.Alg())
+	}
+
+	return key.PublicKey()
+}
+
+// findKey looks up the upstream key, refetching the set when the key is unknown
+func (p *oidcProvider) findKey(ctx context.Context, kid string) (*generates.JWK, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.jwks != nil {
+		if key := p.jwks.Find(kid); key != nil {
+			return key, nil
+		}
+		if time.Since(p.jwksFetchedAt) < jwksRefreshInterval {
+			return nil, fmt.Errorf("Unknown key `%s`", kid)
+		}
+	}
+
+	if p.jwksURL == "" {
+		return nil, fmt.Errorf("jwks_uri is not known")
+	}
+
+	jwks := &generates.JWKSet{}
+	err := getJSON(ctx, socialHTTPClient, p.jwksURL, jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	p.jwks = jwks
+	p.jwksFetchedAt = time.Now()
+
+	key := p.jwks.Find(kid)
+	if key == nil {
+		return nil, fmt.Errorf("Unknown key `%s`", kid)
+	}
+
+	return key, nil
+}
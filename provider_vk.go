@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/vk"
+)
+
+func init() {
+	RegisterSocialProviderType("vk", newVKProvider)
+}
+
+// VKGetUsers ...
+type VKGetUsers struct {
+	Response []VKUser `json:"response"`
+}
+
+// VKUser ...
+type VKUser struct {
+	ID         int64  `json:"id"`
+	FirstName  string `json:"first_name"`
+	LastName   string `json:"last_name"`
+	ScreenName string `json:"screen_name"`
+}
+
+type vkProvider struct {
+	oauth2Provider
+}
+
+func newVKProvider(config ServiceConfig, redirectURI string) (SocialProvider, error) {
+	return &vkProvider{newOAuth2Provider(config, redirectURI, vk.Endpoint)}, nil
+}
+
+// UserInfo UserInfo
+func (p *vkProvider) UserInfo(ctx context.Context, token *oauth2.Token, state *State) (*UserInfo, error) {
+	u, err := url.Parse("https://api.vk.com/method/users.get")
+	if err != nil {
+		return nil, err
+	}
+
+	q := u.Query()
+	q.Set("fields", "id,first_name,last_name,screen_name")
+	q.Set("v", "5.103")
+	q.Set("lang", state.Language)
+	q.Set("access_token", token.AccessToken)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := socialHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := readOKBody(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	vkUsers := VKGetUsers{}
+	err = json.Unmarshal(body, &vkUsers)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(vkUsers.Response) <= 0 {
+		return nil, fmt.Errorf("Empty response")
+	}
+
+	vkUser := vkUsers.Response[0]
+
+	return &UserInfo{
+		ID:   strconv.FormatInt(vkUser.ID, 10),
+		Name: strings.TrimSpace(vkUser.FirstName + " " + vkUser.LastName),
+		URL:  "http://vk.com/" + vkUser.ScreenName,
+	}, nil
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/autowp/auth/oauth2server"
+	"github.com/autowp/auth/oauth2server/errors"
+	"github.com/autowp/auth/oauth2server/manage"
+)
+
+// hostnamePlaceholder in the registered redirect uri matches each of the configured hosts
+const hostnamePlaceholder = "{hostname}"
+
+// NewRedirectURIValidator accepts only the redirect uris registered for the client
+func NewRedirectURIValidator(hosts []Host) manage.ValidateURIHandler {
+	return func(cli oauth2server.ClientInfo, redirectURI string) error {
+		u, err := url.Parse(redirectURI)
+		if err != nil || !u.IsAbs() || u.Fragment != "" {
+			return errors.ErrInvalidRedirectURI
+		}
+
+		for _, registered := range cli.GetRedirectURIs() {
+			if !strings.Contains(registered, hostnamePlaceholder) {
+				if registered == redirectURI {
+					return nil
+				}
+				continue
+			}
+
+			for _, host := range hosts {
+				if strings.Replace(registered, hostnamePlaceholder, host.Hostname, -1) == redirectURI {
+					return nil
+				}
+			}
+		}
+
+		return errors.ErrInvalidRedirectURI
+	}
+}
+
+// InvalidRedirectURIError the redirect uri of the client is malformed
+type InvalidRedirectURIError struct {
+	URI    string
+	Reason string
+}
+
+func (e *InvalidRedirectURIError) Error() string {
+	return fmt.Sprintf("Invalid redirect uri `%s`: %s", e.URI, e.Reason)
+}
+
+// isPrivateUseScheme the reverse domain name scheme of the native app (RFC 8252), the host is not required
+func isPrivateUseScheme(scheme string) bool {
+	return strings.Contains(scheme, ".")
+}
+
+func validateRegisteredRedirectURI(uri string) error {
+	u, err := url.Parse(strings.Replace(uri, hostnamePlaceholder, "example.com", -1))
+	if err != nil {
+		return &InvalidRedirectURIError{URI: uri, Reason: "malformed uri"}
+	}
+
+	if !u.IsAbs() || (u.Host == "" && !isPrivateUseScheme(u.Scheme)) {
+		return &InvalidRedirectURIError{URI: uri, Reason: "absolute uri expected"}
+	}
+
+	if u.Fragment != "" {
+		return &InvalidRedirectURIError{URI: uri, Reason: "fragment is not allowed"}
+	}
+
+	return nil
+}
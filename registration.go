@@ -0,0 +1,413 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/autowp/auth/oauth2server"
+	"github.com/getsentry/sentry-go"
+	"github.com/gin-gonic/gin"
+)
+
+// RegistrationConfig dynamic client registration
+type RegistrationConfig struct {
+	Enabled bool `yaml:"enabled" mapstructure:"enabled"`
+	// InitialAccessTokens required to register, registration is open when empty
+	InitialAccessTokens []string `yaml:"initial_access_tokens" mapstructure:"initial_access_tokens"`
+	// Scopes the clients can register, the client without the scopes would get any scope
+	Scopes []string `yaml:"scopes" mapstructure:"scopes"`
+	// DefaultScopes of the client registered without the scope
+	DefaultScopes []string `yaml:"default_scopes" mapstructure:"default_scopes"`
+}
+
+// token endpoint authentication methods
+const (
+	AuthMethodNone              = "none"
+	AuthMethodClientSecretBasic = "client_secret_basic"
+	AuthMethodClientSecretPost  = "client_secret_post"
+)
+
+// ClientMetadata RFC 7591 client metadata
+type ClientMetadata struct {
+	RedirectURIs            []string `json:"redirect_uris,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+	GrantTypes              []string `json:"grant_types,omitempty"`
+	ResponseTypes           []string `json:"response_types,omitempty"`
+	ClientName              string   `json:"client_name,omitempty"`
+	ClientURI               string   `json:"client_uri,omitempty"`
+	Scope                   string   `json:"scope,omitempty"`
+}
+
+// ClientInformation RFC 7591 client information response
+type ClientInformation struct {
+	ClientMetadata
+	ClientID                string `json:"client_id"`
+	ClientSecret            string `json:"client_secret,omitempty"`
+	ClientIDIssuedAt        int64  `json:"client_id_issued_at"`
+	ClientSecretExpiresAt   *int64 `json:"client_secret_expires_at,omitempty"`
+	RegistrationAccessToken string `json:"registration_access_token,omitempty"`
+	RegistrationClientURI   string `json:"registration_client_uri"`
+}
+
+type clientUpdateRequest struct {
+	ClientMetadata
+	ClientID string `json:"client_id"`
+}
+
+// registrationError RFC 7591 section 3.2.2
+type registrationError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+func invalidClientMetadata(description string) *registrationError {
+	return &registrationError{Error: "invalid_client_metadata", ErrorDescription: description}
+}
+
+func invalidRedirectURI(description string) *registrationError {
+	return &registrationError{Error: "invalid_redirect_uri", ErrorDescription: description}
+}
+
+// registrableGrantTypes grants available for the third party clients
+var registrableGrantTypes = []oauth2server.GrantType{
+	oauth2server.AuthorizationCode,
+	oauth2server.Refreshing,
+	oauth2server.ClientCredentials,
+}
+
+func registrableScope(config RegistrationConfig, scope string) bool {
+	for _, rs := range config.Scopes {
+		if rs == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRegistrationRedirectURI https, loopback http, or private-use scheme of the native apps (RFC 8252)
+func validateRegistrationRedirectURI(uri string) *registrationError {
+	if strings.Contains(uri, hostnamePlaceholder) {
+		return invalidRedirectURI("placeholders are not allowed")
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() {
+		return invalidRedirectURI("absolute uri expected")
+	}
+
+	if u.Fragment != "" {
+		return invalidRedirectURI("fragment is not allowed")
+	}
+
+	switch u.Scheme {
+	case "https":
+		if u.Host == "" {
+			return invalidRedirectURI("host is required")
+		}
+	case "http":
+		host := u.Hostname()
+		ip := net.ParseIP(host)
+		if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return invalidRedirectURI("http is allowed only for the loopback interface")
+		}
+	default:
+		if !isPrivateUseScheme(u.Scheme) {
+			return invalidRedirectURI("private-use scheme must be a reverse domain name")
+		}
+	}
+
+	return nil
+}
+
+// applyClientMetadata validates the metadata and fills the client with it
+func (s *Service) applyClientMetadata(client *StoredClient, metadata *ClientMetadata) *registrationError {
+	if metadata.TokenEndpointAuthMethod == "" {
+		metadata.TokenEndpointAuthMethod = AuthMethodClientSecretBasic
+	}
+	switch metadata.TokenEndpointAuthMethod {
+	case AuthMethodNone, AuthMethodClientSecretBasic, AuthMethodClientSecretPost:
+	default:
+		return invalidClientMetadata("unsupported token_endpoint_auth_method")
+	}
+	public := metadata.TokenEndpointAuthMethod == AuthMethodNone
+	if client.CreatedAt.IsZero() {
+		client.Public = public
+	} else if client.Public != public {
+		return invalidClientMetadata("token_endpoint_auth_method can not switch between public and confidential")
+	}
+
+	if len(metadata.GrantTypes) == 0 {
+		metadata.GrantTypes = []string{oauth2server.AuthorizationCode.String()}
+	}
+
+	hasAuthorizationCode := false
+	for _, gt := range metadata.GrantTypes {
+		allowed := false
+		for _, rgt := range registrableGrantTypes {
+			if rgt.String() == gt && s.oauthServer.CheckGrantType(rgt) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return invalidClientMetadata("grant type `" + gt + "` is not available")
+		}
+		if gt == oauth2server.ClientCredentials.String() && public {
+			return invalidClientMetadata("public client can not use client_credentials")
+		}
+		if gt == oauth2server.AuthorizationCode.String() {
+			hasAuthorizationCode = true
+		}
+	}
+
+	if len(metadata.ResponseTypes) == 0 && hasAuthorizationCode {
+		metadata.ResponseTypes = []string{oauth2server.Code.String()}
+	}
+	for _, rt := range metadata.ResponseTypes {
+		if rt != oauth2server.Code.String() || !hasAuthorizationCode {
+			return invalidClientMetadata("response_types do not match grant_types")
+		}
+	}
+
+	if hasAuthorizationCode && len(metadata.RedirectURIs) == 0 {
+		return invalidRedirectURI("redirect_uris are required for authorization_code")
+	}
+	for _, uri := range metadata.RedirectURIs {
+		if rerr := validateRegistrationRedirectURI(uri); rerr != nil {
+			return rerr
+		}
+	}
+
+	if metadata.ClientURI != "" {
+		u, err := url.Parse(metadata.ClientURI)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return invalidClientMetadata("invalid client_uri")
+		}
+	}
+
+	scopes := strings.Fields(metadata.Scope)
+	if len(scopes) == 0 {
+		scopes = s.config.OAuth.Registration.DefaultScopes
+	}
+	for _, scope := range scopes {
+		if !registrableScope(s.config.OAuth.Registration, scope) {
+			return invalidClientMetadata("scope `" + scope + "` is not available")
+		}
+	}
+
+	client.Name = metadata.ClientName
+	client.Domain = metadata.ClientURI
+	client.RedirectURIs = metadata.RedirectURIs
+	client.GrantTypes = metadata.GrantTypes
+	client.Scopes = scopes
+	client.TokenEndpointAuthMethod = metadata.TokenEndpointAuthMethod
+
+	return nil
+}
+
+func (s *Service) clientInformation(client *StoredClient) *ClientInformation {
+	responseTypes := make([]string, 0)
+	for _, gt := range client.GrantTypes {
+		if gt == oauth2server.AuthorizationCode.String() {
+			responseTypes = append(responseTypes, oauth2server.Code.String())
+		}
+	}
+
+	return &ClientInformation{
+		ClientMetadata: ClientMetadata{
+			RedirectURIs:            client.RedirectURIs,
+			TokenEndpointAuthMethod: client.TokenEndpointAuthMethod,
+			GrantTypes:              client.GrantTypes,
+			ResponseTypes:           responseTypes,
+			ClientName:              client.Name,
+			ClientURI:               client.Domain,
+			Scope:                   strings.Join(client.Scopes, " "),
+		},
+		ClientID:              client.ID,
+		ClientIDIssuedAt:      client.CreatedAt.Unix(),
+		RegistrationClientURI: strings.TrimRight(s.config.OAuth.Issuer, "/") + "/register/" + client.ID,
+	}
+}
+
+// registrationStoreError responds invalid_redirect_uri to the rejected uri, the other errors are internal
+func (s *Service) registrationStoreError(c *gin.Context, err error) {
+	if e, ok := err.(*InvalidRedirectURIError); ok {
+		c.JSON(http.StatusBadRequest, invalidRedirectURI(e.Reason))
+		return
+	}
+
+	log.Println("Client registration failed:", err.Error())
+	sentry.CaptureException(err)
+	c.Status(http.StatusInternalServerError)
+}
+
+func (s *Service) checkInitialAccessToken(c *gin.Context) bool {
+	tokens := s.config.OAuth.Registration.InitialAccessTokens
+	if len(tokens) == 0 {
+		return true
+	}
+
+	token, ok := s.oauthServer.BearerAuth(c.Request)
+	if !ok {
+		return false
+	}
+
+	valid := false
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			valid = true
+		}
+	}
+
+	return valid
+}
+
+// handleRegister RFC 7591 client registration
+func (s *Service) handleRegister(c *gin.Context) {
+	if !s.checkInitialAccessToken(c) {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	metadata := ClientMetadata{}
+	err := c.ShouldBindJSON(&metadata)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, invalidClientMetadata(err.Error()))
+		return
+	}
+
+	client := &StoredClient{}
+	if rerr := s.applyClientMetadata(client, &metadata); rerr != nil {
+		c.JSON(http.StatusBadRequest, rerr)
+		return
+	}
+
+	registrationToken, registrationTokenHash, err := NewRegistrationAccessToken()
+	if err != nil {
+		s.registrationStoreError(c, err)
+		return
+	}
+	client.RegistrationAccessTokenHash = registrationTokenHash
+
+	secret, err := s.clientStore.Create(client)
+	if err != nil {
+		s.registrationStoreError(c, err)
+		return
+	}
+
+	info := s.clientInformation(client)
+	info.RegistrationAccessToken = registrationToken
+	if !client.Public {
+		var neverExpires int64
+		info.ClientSecret = secret
+		info.ClientSecretExpiresAt = &neverExpires
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+	c.JSON(http.StatusCreated, info)
+}
+
+// registeredClient authorizes the RFC 7592 management request by the registration access token
+func (s *Service) registeredClient(c *gin.Context) *StoredClient {
+	token, ok := s.oauthServer.BearerAuth(c.Request)
+	if !ok {
+		c.Header("WWW-Authenticate", `Bearer`)
+		c.Status(http.StatusUnauthorized)
+		return nil
+	}
+
+	client, err := s.clientStore.GetStored(c.Param("client_id"))
+	if err != nil {
+		s.registrationStoreError(c, err)
+		return nil
+	}
+
+	// unknown client and wrong token are not distinguished
+	if client == nil || !client.VerifyRegistrationAccessToken(token) {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.Status(http.StatusUnauthorized)
+		return nil
+	}
+
+	return client
+}
+
+// handleRegisteredClientRead RFC 7592 section 2.1
+func (s *Service) handleRegisteredClientRead(c *gin.Context) {
+	client := s.registeredClient(c)
+	if client == nil {
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+	c.JSON(http.StatusOK, s.clientInformation(client))
+}
+
+// handleRegisteredClientUpdate RFC 7592 section 2.2
+func (s *Service) handleRegisteredClientUpdate(c *gin.Context) {
+	client := s.registeredClient(c)
+	if client == nil {
+		return
+	}
+
+	request := clientUpdateRequest{}
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, invalidClientMetadata(err.Error()))
+		return
+	}
+
+	if request.ClientID != client.ID {
+		c.JSON(http.StatusBadRequest, invalidClientMetadata("client_id mismatch"))
+		return
+	}
+
+	if rerr := s.applyClientMetadata(client, &request.ClientMetadata); rerr != nil {
+		c.JSON(http.StatusBadRequest, rerr)
+		return
+	}
+
+	err = s.clientStore.UpdateMetadata(client)
+	if err != nil {
+		s.registrationStoreError(c, err)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+	c.JSON(http.StatusOK, s.clientInformation(client))
+}
+
+// handleRegisteredClientDelete RFC 7592 section 2.3
+func (s *Service) handleRegisteredClientDelete(c *gin.Context) {
+	client := s.registeredClient(c)
+	if client == nil {
+		return
+	}
+
+	err := s.clientStore.Disable(client.ID)
+	if err != nil {
+		s.registrationStoreError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Service) setupRegistrationRoutes(r *gin.Engine) {
+	if !s.config.OAuth.Registration.Enabled {
+		return
+	}
+
+	r.POST("/register", s.handleRegister)
+	r.GET("/register/:client_id", s.handleRegisteredClientRead)
+	r.PUT("/register/:client_id", s.handleRegisteredClientUpdate)
+	r.DELETE("/register/:client_id", s.handleRegisteredClientDelete)
+}
@@ -5,17 +5,13 @@ import (
 	"crypto/rand"
 	"database/sql"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
@@ -26,23 +22,14 @@ import (
 
 	"github.com/autowp/auth/oauth2server/server"
 
-	"github.com/autowp/auth/oauth2server/store"
-
 	"github.com/autowp/auth/oauth2server/manage"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/autowp/auth/webauthn"
+
 	"github.com/getsentry/sentry-go"
 	"github.com/gin-gonic/gin"
-	"github.com/mitchellh/mapstructure"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/facebook"
-	"golang.org/x/oauth2/google"
-	"golang.org/x/oauth2/vk"
-
-	goauth2 "google.golang.org/api/oauth2/v2"
-	"google.golang.org/api/option"
 
-	_ "github.com/go-sql-driver/mysql" // enable mysql driver
+	"github.com/go-sql-driver/mysql"   // mysql driver
 	_ "github.com/jackc/pgx/v4/stdlib" // postgresql driver
 
 	"github.com/golang-migrate/migrate"
@@ -52,16 +39,30 @@ import (
 
 // Service Main Object
 type Service struct {
-	config      Config
-	db          *sql.DB
-	usersDB     *sql.DB
-	oauthServer *server.Server
-	Loc         *time.Location
-	waitGroup   *sync.WaitGroup
-	httpServer  *http.Server
-	router      *gin.Engine
-	logger      *log.Logger
-	stateMap    *StateMap
+	config          Config
+	db              *sql.DB
+	usersDB         *sql.DB
+	userStore       *UserStore
+	clientStore     *ClientStore
+	tokenStore      *TokenStore
+	oauthServer     *server.Server
+	accessGenerate  *generates.JWTAccessGenerate
+	Loc             *time.Location
+	waitGroup       *sync.WaitGroup
+	httpServer      *http.Server
+	router          *gin.Engine
+	logger          *log.Logger
+	stateStore      StateStore
+	throttleStore   ThrottleStore
+	throttle        *Throttle
+	mfaStore        *MFAStore
+	webAuthn        *webauthn.WebAuthn
+	webAuthnStore   *WebAuthnStore
+	signUpHooks     signUpHooks
+	mailer          Mailer
+	linkStore       *AccountLinkStore
+	socialProviders SocialProviders
+	proxies         *TrustedProxies
 }
 
 // NewService constructor
@@ -95,184 +96,122 @@ func NewService(wg *sync.WaitGroup, config Config) (*Service, error) {
 		return nil, err
 	}
 
-	userStore := NewUserStore(usersDB, config.OAuth.UserStore)
-
-	oauthServer := initOAuthServer(db, userStore, config.OAuth)
-	// defer tokenStore.Close()
-
-	s := &Service{
-		config:      config,
-		db:          db,
-		usersDB:     usersDB,
-		oauthServer: oauthServer,
-		Loc:         loc,
-		waitGroup:   wg,
-		stateMap:    NewStateMap(time.Hour),
+	userStore, err := NewUserStore(usersDB, config.OAuth.UserStore)
+	if err != nil {
+		return nil, err
 	}
 
-	oauthServer.SetSocialAuthorizationHandler(func(code, stateID, remoteAddr string) (int64, string, error) {
-
-		if stateID == "" {
-			return 0, "", errors.ErrInvalidRequest
-		}
-
-		state := s.stateMap.Get(stateID)
-		if state == nil {
-			return 0, "", errors.ErrInvalidRequest
-		}
-
-		var userID int64
-
-		userInfo := UserInfo{}
-
-		switch state.Service {
-		case Google:
-
-			var config = &oauth2.Config{
-				ClientID:     s.config.Services.Google.ClientID,
-				ClientSecret: s.config.Services.Google.ClientSecret,
-				Endpoint:     google.Endpoint,
-				Scopes:       s.config.Services.Google.Scopes,
-				RedirectURL:  s.config.Services.RedirectURI,
-			}
-			token, err := config.Exchange(context.Background(), code)
-			if err != nil {
-				return 0, "", err
-			}
-
-			httpClient := config.Client(context.Background(), token)
-
-			goauth2Service, err := goauth2.NewService(context.Background(), option.WithHTTPClient(httpClient))
-			if err != nil {
-				return 0, "", err
-			}
-
-			gUserInfo, err := goauth2Service.Userinfo.V2.Me.Get().Do()
-			if err != nil {
-				return 0, "", err
-			}
-
-			userInfo.ID = gUserInfo.Id
-			userInfo.Name = gUserInfo.Name
-			userInfo.URL = gUserInfo.Link
-
-		case Facebook:
-			var config = &oauth2.Config{
-				ClientID:     s.config.Services.Facebook.ClientID,
-				ClientSecret: s.config.Services.Facebook.ClientSecret,
-				Endpoint:     facebook.Endpoint,
-				Scopes:       s.config.Services.Facebook.Scopes,
-				RedirectURL:  s.config.Services.RedirectURI,
-			}
-			token, err := config.Exchange(context.Background(), code)
-			if err != nil {
-				return 0, "", err
-			}
-
-			httpClient := config.Client(context.Background(), token)
-
-			resp, err := httpClient.Get("https://graph.facebook.com/v6.0/me?fields=id,name")
-			if err != nil {
-				return 0, "", err
-			}
-
-			defer resp.Body.Close()
-
-			if resp.StatusCode != http.StatusOK {
-				return 0, "", fmt.Errorf("Unexpected status code %d", resp.StatusCode)
-			}
-
-			body, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				return 0, "", err
-			}
-
-			fbUser := FacebookUser{}
-			err = json.Unmarshal(body, &fbUser)
-			if err != nil {
-				return 0, "", err
-			}
-
-			userInfo.ID = fbUser.ID
-			userInfo.Name = fbUser.Name
-			userInfo.URL = ""
-
-		case VK:
-			var config = &oauth2.Config{
-				ClientID:     s.config.Services.VK.ClientID,
-				ClientSecret: s.config.Services.VK.ClientSecret,
-				Endpoint:     vk.Endpoint,
-				Scopes:       s.config.Services.VK.Scopes,
-				RedirectURL:  s.config.Services.RedirectURI,
-			}
-			token, err := config.Exchange(context.Background(), code)
-			if err != nil {
-				return 0, "", err
-			}
+	proxies, err := NewTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
 
-			url, err := url.Parse("https://api.vk.com/method/users.get")
-			if err != nil {
-				return 0, "", err
-			}
+	keySet, err := NewJWTKeySet(config.OAuth)
+	if err != nil {
+		return nil, err
+	}
 
-			q := url.Query()
-			q.Set("fields", "id,first_name,last_name,screen_name")
-			q.Set("v", "5.103")
-			q.Set("lang", state.Language)
-			q.Set("access_token", token.AccessToken)
-			url.RawQuery = q.Encode()
+	accessGenerate := generates.NewJWTKeySetAccessGenerate(keySet)
+	accessGenerate.Issuer = config.OAuth.Issuer
 
-			resp, err := http.Get(url.String())
-			if err != nil {
-				return 0, "", err
-			}
+	socialProviders, err := NewSocialProviders(config.Services)
+	if err != nil {
+		return nil, err
+	}
 
-			defer resp.Body.Close()
+	clientStore, err := NewClientStore(db, config.OAuth.Clients)
+	if err != nil {
+		return nil, err
+	}
 
-			if resp.StatusCode != http.StatusOK {
-				return 0, "", fmt.Errorf("Unexpected status code %d", resp.StatusCode)
-			}
+	tokenStore, err := NewTokenStore(
+		db,
+		WithTokenStoreGCInterval(time.Minute),
+		WithTokenStoreHashKey(config.OAuth.TokenHashSecret()),
+	)
+	if err != nil {
+		return nil, err
+	}
 
-			body, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				return 0, "", err
-			}
+	throttleStore := NewThrottleStore(
+		config.OAuth.Throttle.Store,
+		db,
+		time.Duration(config.OAuth.Throttle.Window)*time.Minute,
+	)
+	throttle := NewThrottle(throttleStore, config.OAuth.Throttle)
 
-			vkUsers := VKGetUsers{}
-			err = json.Unmarshal(body, &vkUsers)
-			if err != nil {
-				return 0, "", err
-			}
+	var mfaStore *MFAStore
+	if config.OAuth.MFA.EncryptionKey != "" {
+		mfaStore, err = NewMFAStore(db, config.OAuth.MFA)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-			if len(vkUsers.Response) <= 0 {
-				return 0, "", fmt.Errorf("Empty response")
-			}
+	oauthServer := initOAuthServer(
+		tokenStore, userStore, clientStore, throttle, mfaStore, accessGenerate, proxies, config.OAuth, config.Hosts,
+	)
 
-			vkUser := vkUsers.Response[0]
+	s := &Service{
+		config:          config,
+		db:              db,
+		usersDB:         usersDB,
+		userStore:       userStore,
+		clientStore:     clientStore,
+		tokenStore:      tokenStore,
+		oauthServer:     oauthServer,
+		accessGenerate:  accessGenerate,
+		Loc:             loc,
+		waitGroup:       wg,
+		stateStore:      NewStateStore(config.Services.StateStore, db, time.Duration(config.Services.StateTTL)*time.Minute),
+		linkStore:       NewAccountLinkStore(db, time.Duration(config.Services.LinkTTL)*time.Minute),
+		socialProviders: socialProviders,
+		throttleStore:   throttleStore,
+		throttle:        throttle,
+		mfaStore:        mfaStore,
+		proxies:         proxies,
+	}
 
-			userInfo.ID = strconv.FormatInt(vkUser.ID, 10)
-			userInfo.Name = strings.TrimSpace(vkUser.FirstName + " " + vkUser.LastName)
-			userInfo.URL = "http://vk.com/" + vkUser.ScreenName
+	oauthServer.SetExtensionFieldsHandler(s.idTokenFields)
+	oauthServer.SetUserAuthorizationHandler(s.authorizeUser)
 
-		default:
-			return 0, "", fmt.Errorf("Unexpected service %s", state.Service)
+	if config.OAuth.WebAuthn.Enabled {
+		s.webAuthn, err = webauthn.New(webauthn.Config{
+			RPID:                    config.OAuth.WebAuthn.RPID,
+			RPName:                  config.OAuth.WebAuthn.RPName,
+			Origins:                 config.OAuth.WebAuthn.Origins,
+			RequireUserVerification: config.OAuth.WebAuthn.UserVerification,
+			Timeout:                 time.Duration(config.OAuth.WebAuthn.ChallengeTTL) * time.Minute,
+		})
+		if err != nil {
+			return nil, err
 		}
+		s.webAuthnStore = NewWebAuthnStore(db, time.Duration(config.OAuth.WebAuthn.ChallengeTTL)*time.Minute)
 
-		if userInfo.ID == "" {
-			return 0, "", fmt.Errorf("Failed to get user id")
-		}
+		oauthServer.SetWebAuthnAuthorizationHandler(s.webAuthnLogin)
+	}
 
-		if userInfo.Name == "" {
-			return 0, "", fmt.Errorf("Failed to get user name")
+	if config.OAuth.EmailFlows.Enabled {
+		s.mailer, err = NewMailer(config.Mail)
+		if err != nil {
+			return nil, err
 		}
+	}
+
+	if config.OAuth.SignUp.IPLimit > 0 {
+		s.AddSignUpHook(signUpRateLimitHook(
+			throttleStore,
+			config.OAuth.SignUp.IPLimit,
+			time.Duration(config.OAuth.SignUp.IPWindow)*time.Minute,
+		))
+	}
 
-		userID, err = s.registerUser(&userInfo, state, "Europe/Moscow", remoteAddr)
+	oauthServer.SetSocialAuthorizationHandler(func(ctx context.Context, code, stateID, remoteAddr string) (int64, string, error) {
+		userID, state, err := s.socialLogin(ctx, code, stateID, remoteAddr)
 		if err != nil {
 			return 0, "", err
 		}
 
-		s.stateMap.Delete(stateID)
-
 		return userID, state.RedirectURI, nil
 	})
 
@@ -315,47 +254,159 @@ func connectDb(driverName string, dsn string) (*sql.DB, error) {
 	return db, nil
 }
 
-func initOAuthServer(db *sql.DB, userStore *UserStore, config OAuthConfig) *server.Server {
+func initOAuthServer(
+	tokenStore *TokenStore,
+	userStore *UserStore,
+	clientStore *ClientStore,
+	throttle *Throttle,
+	mfaStore *MFAStore,
+	accessGenerate oauth2server.AccessGenerate,
+	proxies *TrustedProxies,
+	config OAuthConfig,
+	hosts []Host,
+) *server.Server {
 	manager := manage.NewManager()
+	manager.SetRequestIPHandler(proxies.ClientIP)
+	manager.SetValidateURIHandler(NewRedirectURIValidator(hosts))
+	manager.SetAuthorizeCodeTokenCfg(&manage.Config{
+		AccessTokenExp:    time.Duration(config.AccessTokenExpiresIn) * time.Minute,
+		RefreshTokenExp:   time.Duration(config.RefreshTokenExpiresIn) * time.Minute,
+		IsGenerateRefresh: true,
+	})
 	manager.SetPasswordTokenCfg(&manage.Config{
 		AccessTokenExp:    time.Duration(config.AccessTokenExpiresIn) * time.Minute,
 		RefreshTokenExp:   time.Duration(config.RefreshTokenExpiresIn) * time.Minute,
 		IsGenerateRefresh: true,
 	})
+	manager.SetWebAuthnTokenCfg(&manage.Config{
+		AccessTokenExp:    time.Duration(config.AccessTokenExpiresIn) * time.Minute,
+		RefreshTokenExp:   time.Duration(config.RefreshTokenExpiresIn) * time.Minute,
+		IsGenerateRefresh: true,
+	})
+	manager.SetClientTokenCfg(&manage.Config{
+		AccessTokenExp:    time.Duration(config.AccessTokenExpiresIn) * time.Minute,
+		IsGenerateRefresh: false,
+	})
+	manager.SetRefreshTokenCfg(&manage.RefreshingConfig{
+		IsGenerateRefresh:  true,
+		IsRemoveAccess:     true,
+		IsRemoveRefreshing: true,
+		ReuseGraceWindow:   time.Duration(config.RefreshTokenReuseGrace) * time.Second,
+	})
+	manager.SetRefreshTokenReuseHandler(func(ti oauth2server.TokenInfo) {
+		msg := fmt.Sprintf(
+			"refresh token reuse detected: client %s, user %d, family %s revoked",
+			ti.GetClientID(), ti.GetUserID(), ti.GetFamily(),
+		)
+		log.Println(msg)
+		sentry.CaptureMessage(msg)
+	})
 	// default implementation
-	manager.MapAccessGenerate(
-		&generates.JWTAccessGenerate{
-			SignedKey:    []byte(config.Secret),
-			SignedMethod: jwt.SigningMethodHS512,
-		},
-	)
+	manager.MapAuthorizeGenerate(generates.NewAuthorizeGenerate())
+	manager.MapAccessGenerate(accessGenerate)
 
 	// token store
-	tokenStore, err := NewTokenStore(db, WithTokenStoreGCInterval(time.Minute))
-	manager.MustTokenStorage(tokenStore, err)
+	manager.MapTokenStorage(tokenStore)
+
+	manager.MapClientStorage(clientStore)
 
-	// client store
-	clientStore := store.NewClientStore()
-	for _, client := range config.Clients {
-		err := clientStore.Set(client.ID, &client)
+	// tokens of the deleted user are rejected and revoked
+	manager.SetUserActiveHandler(func(userID int64) (bool, error) {
+		user, err := userStore.GetUserByID(userID)
 		if err != nil {
-			panic(err)
+			return false, err
 		}
+		return user != nil, nil
+	})
+
+	srvConfig := server.NewConfig()
+	for _, gt := range config.GrantTypes {
+		srvConfig.AllowedGrantTypes = append(srvConfig.AllowedGrantTypes, oauth2server.GrantType(gt))
 	}
 
-	manager.MapClientStorage(clientStore)
+	srv := server.NewServer(srvConfig, manager)
 
-	srv := server.NewServer(&server.Config{}, manager)
+	srv.SetPasswordAuthorizationHandler(func(username, password, remoteAddr string) (userID int64, err error) {
+		// locked credentials are not checked at all, so the lockout can't be used as the oracle
+		err = throttle.Check(username, remoteAddr)
+		if err != nil {
+			return 0, err
+		}
 
-	srv.SetPasswordAuthorizationHandler(func(username, password string) (userID int64, err error) {
 		user, err := userStore.GetUserByCredentials(username, password)
 		if err != nil {
 			return 0, err
 		}
-		if user != nil {
-			return user.ID, nil
+
+		if user == nil {
+			err = throttle.Fail(username, remoteAddr)
+			if err != nil {
+				log.Println("Failed to count failed login:", err.Error())
+				sentry.CaptureException(err)
+			}
+			return 0, nil
+		}
+
+		err = throttle.Success(username)
+		if err != nil {
+			log.Println("Failed to reset failed logins:", err.Error())
+			sentry.CaptureException(err)
+		}
+
+		if mfaStore != nil {
+			enabled, err := mfaStore.IsEnabled(user.ID)
+			if err != nil {
+				return 0, err
+			}
+			if enabled {
+				token, err := mfaStore.NewToken(user.ID)
+				if err != nil {
+					return 0, err
+				}
+				return 0, &errors.MFARequiredError{Token: token}
+			}
+		}
+
+		return user.ID, nil
+	})
+
+	srv.SetMFAAuthorizationHandler(func(mfaToken, otp, remoteAddr string) (int64, error) {
+		if mfaStore == nil {
+			return 0, nil
+		}
+
+		tokenUserID, err := mfaStore.TokenUser(mfaToken)
+		if err != nil || tokenUserID == 0 {
+			return 0, err
+		}
+
+		// the password step issues the new token every time, so the codes are limited per user too
+		err = throttle.CheckMFA(tokenUserID)
+		if err != nil {
+			return 0, err
+		}
+
+		userID, err := mfaStore.ConsumeToken(mfaToken, otp)
+		if err != nil {
+			return 0, err
+		}
+
+		if userID == 0 {
+			err = throttle.FailMFA(tokenUserID, config.MFA.MaxAttempts)
+			if err != nil {
+				log.Println("Failed to count failed code:", err.Error())
+				sentry.CaptureException(err)
+			}
+			return 0, nil
+		}
+
+		err = throttle.SuccessMFA(userID)
+		if err != nil {
+			log.Println("Failed to reset failed codes:", err.Error())
+			sentry.CaptureException(err)
 		}
-		return 0, nil
+
+		return userID, nil
 	})
 
 	srv.SetInternalErrorHandler(func(err error) (re *errors.Response) {
@@ -380,80 +431,43 @@ func randomBase64String(l int) (string, error) {
 	return str[:l], nil // strip 1 extra character we get from odd length results
 }
 
-func (s *Service) getUserIDFromRequest(c *gin.Context) (int64, error) {
-	authorizationHeader := c.GetHeader("Authorization")
-
-	if authorizationHeader == "" {
-		return 0, nil
-	}
-
-	bearerToken := strings.Split(authorizationHeader, " ")
-
-	if len(bearerToken) != 2 || bearerToken[0] != "Bearer" {
-		return 0, fmt.Errorf("Invalid authorization token")
-	}
-
-	token, err := jwt.Parse(bearerToken[1], func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("There was an error")
-		}
-		return []byte(s.config.OAuth.Secret), nil
-	})
-	if err != nil {
-		return 0, err
-	}
-
-	if !token.Valid {
-		return 0, fmt.Errorf("Invalid authorization token")
-	}
-
-	var claims jwt.StandardClaims
-	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
-		TagName: "json",
-		Result:  &claims,
-	})
-	if err != nil {
-		return 0, err
-	}
-	err = decoder.Decode(token.Claims)
-	if err != nil {
-		return 0, err
-	}
-
-	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
-	if err != nil {
-		return 0, err
-	}
-
-	return userID, nil
-}
-
 func (s *Service) setupRouter() {
 	r := gin.New()
+	// the client address is resolved by the trusted proxies only
+	r.ForwardedByClientIP = false
 	r.Use(gin.Recovery())
 
+	r.GET("/.well-known/openid-configuration", s.handleOpenIDConfiguration)
+	r.GET("/.well-known/jwks.json", s.handleJWKS)
+
+	s.setupRegistrationRoutes(r)
+
 	apiGroup := r.Group("/api/oauth")
 	{
-		/*apiGroup.GET("/authorize", func(c *gin.Context) {
-			err := s.oauthServer.HandleAuthorizeRequest(c.Writer, c.Request)
+		authorizeHandler := func(c *gin.Context) {
+			err := s.oauthServer.HandleAuthorizeRequest(c)
 			if err != nil {
-				c.String(http.StatusBadRequest, err.Error())
+				s.oauthServer.TokenError(c, err)
 			}
-		})*/
+		}
+		apiGroup.GET("/authorize", authorizeHandler)
+		apiGroup.POST("/authorize", authorizeHandler)
 
 		apiGroup.POST("/token", func(c *gin.Context) {
 
-			client := s.config.OAuth.Clients[0]
-
 			trd := oauth2server.TokenRequestData{}
 
 			err := c.ShouldBind(&trd)
 			if err != nil {
 				c.String(http.StatusBadRequest, err.Error())
+				return
 			}
+			trd.ClientIP = s.proxies.ClientIP(c.Request)
 
-			trd.ClientID = client.GetID()
-			trd.ClientSecret = client.GetSecret()
+			// the client acting on its own behalf must prove its identity
+			if oauth2server.GrantType(trd.GrantType) != oauth2server.ClientCredentials && trd.ClientID == "" {
+				s.setDefaultClient(c)
+			}
 
 			gt, tgr, _, err := s.oauthServer.ValidationTokenRequest(c, &trd)
 			if err != nil {
@@ -470,160 +484,347 @@ func (s *Service) setupRouter() {
 			s.oauthServer.Token(c, s.oauthServer.GetTokenData(ti), nil, 0)
 		})
 
-		apiGroup.GET("/service", func(c *gin.Context) {
+		apiGroup.POST("/revoke", func(c *gin.Context) {
+			err := s.oauthServer.HandleRevocationRequest(c)
+			if err != nil {
+				s.oauthServer.TokenError(c, err)
+			}
+		})
+
+		apiGroup.POST("/session", s.handleSessionStart)
+		apiGroup.DELETE("/session", s.handleSessionEnd)
+
+		apiGroup.GET("/sessions", s.handleSessions)
+		apiGroup.DELETE("/sessions", s.handleSessionsDelete)
+		apiGroup.DELETE("/sessions/:id", s.handleSessionDelete)
 
-			userID, err := s.getUserIDFromRequest(c)
+		s.setupMFARoutes(apiGroup)
+		s.setupWebAuthnRoutes(apiGroup)
+		s.setupSignUpRoutes(apiGroup)
+		s.setupEmailFlowsRoutes(apiGroup)
+
+		apiGroup.GET("/accounts", s.handleAccounts)
+		apiGroup.DELETE("/accounts/:service/:external_id", s.handleAccountDelete)
+		apiGroup.POST("/accounts/link/confirm", s.handleAccountLinkConfirm)
+
+		apiGroup.GET("/userinfo", s.handleUserInfo)
+		apiGroup.POST("/userinfo", s.handleUserInfo)
+
+		apiGroup.POST("/introspect", func(c *gin.Context) {
+			err := s.oauthServer.HandleIntrospectionRequest(c)
 			if err != nil {
-				c.String(http.StatusBadRequest, err.Error())
-				return
+				s.oauthServer.TokenError(c, err)
 			}
+		})
+
+		apiGroup.GET("/service", func(c *gin.Context) {
 
-			language := s.config.Hosts[0].Language
-			for _, host := range s.config.Hosts {
-				if host.Hostname == c.Request.Host {
-					language = host.Language
+			// authorized request links the account to the user, the anonymous one logs in
+			var userID int64
+			if c.GetHeader("Authorization") != "" {
+				ti := s.userToken(c)
+				if ti == nil {
+					return
 				}
+				userID = ti.GetUserID()
+			}
+
+			language := s.requestHost(c).Language
+
+			clientID := c.Query("client_id")
+			if clientID == "" {
+				clientID = s.config.OAuth.DefaultClient
 			}
 
 			redirectURI := c.Query("redirect_uri")
-			if redirectURI == "" {
-				c.String(http.StatusBadRequest, "invalid redirect_uri")
+			err := s.oauthServer.Manager.ValidateRedirectURI(clientID, redirectURI)
+			if err != nil {
+				renderErrorPage(c, http.StatusBadRequest, "The redirect_uri is not registered for the client.")
 				return
 			}
 
 			serviceName := ExternalService(c.Query("service"))
 
-			if serviceName == "" {
-				c.String(http.StatusBadRequest, "unexpected service")
+			provider := s.socialProviders.Get(serviceName)
+			if provider == nil {
+				renderErrorPage(c, http.StatusBadRequest, "Unexpected service.")
 				return
 			}
 
-			stateID, err := randomBase64String(32)
-			if err != nil {
-				c.String(http.StatusInternalServerError, err.Error())
+			if !s.oauthServer.CheckGrantType(oauth2server.AuthorizationCode) {
+				renderErrorPage(c, http.StatusBadRequest, "Authorization code grant is disabled.")
 				return
 			}
 
-			state := State{
-				UserID:      userID,
-				Language:    language,
-				Service:     serviceName,
-				RedirectURI: redirectURI,
+			// same checks as the authorize endpoint, the code is exchanged the same way
+			cli, err := s.oauthServer.Manager.GetClient(clientID)
+			if err != nil {
+				renderErrorPage(c, http.StatusBadRequest, "Unknown client.")
+				return
 			}
 
-			s.stateMap.Put(stateID, state)
-
-			var config *oauth2.Config
+			if !s.oauthServer.CheckClientGrantType(cli, oauth2server.AuthorizationCode) {
+				renderErrorPage(c, http.StatusBadRequest, "Authorization code grant is not allowed for the client.")
+				return
+			}
 
-			switch serviceName {
-			case Google:
-				config = &oauth2.Config{
-					ClientID:     s.config.Services.Google.ClientID,
-					ClientSecret: s.config.Services.Google.ClientSecret,
-					Endpoint:     google.Endpoint,
-					Scopes:       s.config.Services.Google.Scopes,
-					RedirectURL:  s.config.Services.RedirectURI,
-				}
-			case Facebook:
-				config = &oauth2.Config{
-					ClientID:     s.config.Services.Facebook.ClientID,
-					ClientSecret: s.config.Services.Facebook.ClientSecret,
-					Endpoint:     facebook.Endpoint,
-					Scopes:       s.config.Services.Facebook.Scopes,
-					RedirectURL:  s.config.Services.RedirectURI,
-				}
-			case VK:
-				config = &oauth2.Config{
-					ClientID:     s.config.Services.VK.ClientID,
-					ClientSecret: s.config.Services.VK.ClientSecret,
-					Endpoint:     vk.Endpoint,
-					Scopes:       s.config.Services.VK.Scopes,
-					RedirectURL:  s.config.Services.RedirectURI,
-				}
-			default:
-				c.Status(http.StatusNotFound)
+			scope := c.Query("scope")
+			if !s.oauthServer.CheckClientScope(cli, scope) {
+				renderErrorPage(c, http.StatusBadRequest, "The requested scope is not allowed for the client.")
+				return
 			}
 
-			c.JSON(http.StatusOK, gin.H{
-				"url": config.AuthCodeURL(stateID, oauth2.AccessTypeOnline),
-			})
-		})
+			codeChallenge := c.Query("code_challenge")
+			codeChallengeMethod, err := s.oauthServer.ValidateCodeChallenge(
+				codeChallenge,
+				oauth2server.CodeChallengeMethod(c.Query("code_challenge_method")),
+			)
+			if err != nil {
+				renderErrorPage(c, http.StatusBadRequest, err.Error())
+				return
+			}
 
-		apiGroup.GET("/service-callback", func(c *gin.Context) {
-			client := s.config.OAuth.Clients[0]
-
-			trd := oauth2server.TokenRequestData{
-				ClientID:     client.GetID(),
-				ClientSecret: client.GetSecret(),
-				GrantType:    oauth2server.SocialAuthorizationCode.String(),
-				State:        c.Query("state"),
-				Code:         c.Query("code"),
-				Scope:        c.Query("scope"),
-				ClientIP:     c.ClientIP(),
+			if cli.IsPublic() && codeChallenge == "" {
+				renderErrorPage(c, http.StatusBadRequest, errors.Descriptions[errors.ErrCodeChallengeRequired])
+				return
 			}
 
-			gt, tgr, redirectURI, err := s.oauthServer.ValidationTokenRequest(c, &trd)
+			stateID, err := randomBase64String(32)
 			if err != nil {
-				s.oauthServer.TokenError(c, err)
+				c.String(http.StatusInternalServerError, err.Error())
 				return
 			}
 
-			ti, err := s.oauthServer.GetAccessToken(gt, tgr)
+			state := State{
+				UserID:              userID,
+				Language:            language,
+				Service:             serviceName,
+				ClientID:            clientID,
+				RedirectURI:         redirectURI,
+				Scope:               scope,
+				ClientState:         c.Query("state"),
+				CodeChallenge:       codeChallenge,
+				CodeChallengeMethod: codeChallengeMethod,
+			}
+
+			authCodeURL, err := provider.AuthCodeURL(socialContext(c.Request.Context()), stateID, &state)
 			if err != nil {
-				s.oauthServer.TokenError(c, err)
+				c.String(http.StatusInternalServerError, err.Error())
 				return
 			}
 
-			td := s.oauthServer.GetTokenData(ti)
-
-			encoded, err := json.Marshal(td)
+			err = s.stateStore.Put(stateID, state)
 			if err != nil {
 				c.String(http.StatusInternalServerError, err.Error())
 				return
 			}
 
-			c.Header("Content-Type", "application/json;charset=UTF-8")
-			c.Header("Cache-Control", "no-store")
-			c.Header("Pragma", "no-cache")
+			c.JSON(http.StatusOK, gin.H{
+				"url": authCodeURL,
+			})
+		})
 
-			u, err := url.Parse(redirectURI)
+		apiGroup.GET("/service-callback", func(c *gin.Context) {
+			userID, state, err := s.socialLogin(c.Request.Context(), c.Query("code"), c.Query("state"), s.proxies.ClientIP(c.Request))
+			if state == nil {
+				if err != errors.ErrInvalidRequest {
+					log.Println("Social login failed:", err.Error())
+					sentry.CaptureException(err)
+				}
+				renderErrorPage(c, http.StatusBadRequest, "The login session is invalid or expired, please try again.")
+				return
+			}
+			if ae, ok := err.(*errors.AccountConflictError); ok {
+				redirectWithQuery(c, state.RedirectURI, url.Values{
+					"error":      {errors.ErrAccountConflict.Error()},
+					"link_token": {ae.Token},
+					"state":      {state.ClientState},
+				})
+				return
+			}
 			if err != nil {
-				c.String(http.StatusInternalServerError, err.Error())
+				log.Println("Social login failed:", err.Error())
+				sentry.CaptureException(err)
+				redirectWithQuery(c, state.RedirectURI, url.Values{
+					"error": {"access_denied"},
+					"state": {state.ClientState},
+				})
 				return
 			}
 
-			q, err := url.ParseQuery(u.RawQuery)
+			// the client exchanges the code at the token endpoint, so no token appears in the url
+			ti, err := s.oauthServer.Manager.GenerateAuthToken(oauth2server.Code, &oauth2server.TokenGenerateRequest{
+				ClientID:            state.ClientID,
+				UserID:              userID,
+				RedirectURI:         state.RedirectURI,
+				Scope:               state.Scope,
+				CodeChallenge:       state.CodeChallenge,
+				CodeChallengeMethod: state.CodeChallengeMethod,
+				Request:             c.Request,
+			})
 			if err != nil {
-				c.String(http.StatusInternalServerError, err.Error())
+				log.Println("Failed to issue authorization code:", err.Error())
+				sentry.CaptureException(err)
+				redirectWithQuery(c, state.RedirectURI, url.Values{
+					"error": {"server_error"},
+					"state": {state.ClientState},
+				})
 				return
 			}
 
-			q.Add("token", string(encoded))
-			u.RawQuery = q.Encode()
-
-			c.Redirect(http.StatusFound, u.String())
+			redirectWithQuery(c, state.RedirectURI, url.Values{
+				"code":  {ti.GetCode()},
+				"state": {state.ClientState},
+			})
 		})
 	}
 
 	s.router = r
 }
 
-func (s *Service) registerUser(userInfo *UserInfo, state *State, timezone string, ip string) (int64, error) {
+// setDefaultClient authenticates the request without client credentials as the default client
+func (s *Service) setDefaultClient(c *gin.Context) {
+	if s.config.OAuth.DefaultClient == "" {
+		return
+	}
+
+	if c.GetHeader("Authorization") != "" || c.PostForm("client_id") != "" {
+		return
+	}
+
+	// registered confidential clients have no plain secret, so only public or config clients can be default
+	cli, err := s.oauthServer.Manager.GetClient(s.config.OAuth.DefaultClient)
+	if err != nil {
+		return
+	}
+
+	// the public client has no secret to lend, its codes are exchanged only with PKCE
+	if !cli.IsPublic() && !s.config.OAuth.LegacyDefaultClient {
+		return
+	}
+
+	c.Request.SetBasicAuth(cli.GetID(), cli.GetSecret())
+}
 
-	stateUserID := state.UserID
+// redirectWithQuery redirects to the uri with the params appended to its query, empty params are skipped
+func redirectWithQuery(c *gin.Context, redirectURI string, params url.Values) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	q := u.Query()
+	for k, values := range params {
+		for _, v := range values {
+			if v != "" {
+				q.Add(k, v)
+			}
+		}
+	}
+	u.RawQuery = q.Encode()
+
+	c.Redirect(http.StatusFound, u.String())
+}
+
+// socialLogin consumes the state and registers the user by the provider profile.
+// State is nil when it is missing or expired
+func (s *Service) socialLogin(ctx context.Context, code, stateID, remoteAddr string) (int64, *State, error) {
+	if stateID == "" {
+		return 0, nil, errors.ErrInvalidRequest
+	}
+
+	state, err := s.stateStore.Consume(stateID)
+	if err != nil {
+		return 0, nil, err
+	}
+	if state == nil {
+		return 0, nil, errors.ErrInvalidRequest
+	}
+
+	provider := s.socialProviders.Get(state.Service)
+	if provider == nil {
+		return 0, state, fmt.Errorf("Unexpected service %s", state.Service)
+	}
+
+	ctx = socialContext(ctx)
+
+	token, err := provider.Exchange(ctx, code, state)
+	if err != nil {
+		return 0, state, err
+	}
+
+	userInfo, err := provider.UserInfo(ctx, token, state)
+	if err != nil {
+		return 0, state, err
+	}
+
+	if userInfo.ID == "" {
+		return 0, state, fmt.Errorf("Failed to get user id")
+	}
+
+	if userInfo.Name == "" {
+		return 0, state, fmt.Errorf("Failed to get user name")
+	}
+
+	userID, err := s.registerUser(userInfo, state, "Europe/Moscow", remoteAddr)
+	if err != nil {
+		return 0, state, err
+	}
+
+	return userID, state, nil
+}
 
-	if stateUserID <= 0 {
-		row := s.usersDB.QueryRow("SELECT user_id FROM user_account WHERE service_id = ? AND external_id = ?", state.Service, userInfo.ID)
+// mysqlDuplicateEntry ER_DUP_ENTRY
+const mysqlDuplicateEntry = 1062
 
-		err := row.Scan(&stateUserID)
-		if err != nil && err != sql.ErrNoRows {
+// registerUser finds or creates the user of the social account, or links the account to the user of the state.
+// Account of the other user is never moved silently, AccountConflictError asks to confirm it
+func (s *Service) registerUser(userInfo *UserInfo, state *State, timezone string, ip string) (int64, error) {
+	var ownerID int64
+	row := s.usersDB.QueryRow("SELECT user_id FROM user_account WHERE service_id = ? AND external_id = ?", state.Service, userInfo.ID)
+	err := row.Scan(&ownerID)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	if state.UserID > 0 && ownerID > 0 && ownerID != state.UserID {
+		token, err := s.linkStore.Put(AccountLink{
+			UserID:         state.UserID,
+			Service:        state.Service,
+			ExternalID:     userInfo.ID,
+			Name:           userInfo.Name,
+			Link:           userInfo.URL,
+			PreviousUserID: ownerID,
+		})
+		if err != nil {
+			return 0, err
+		}
+		return 0, &errors.AccountConflictError{Token: token}
+	}
+
+	if ownerID > 0 {
+		_, err = s.usersDB.Exec(
+			"UPDATE user_account SET name = ?, link = ? WHERE service_id = ? AND external_id = ?",
+			userInfo.Name, userInfo.URL, state.Service, userInfo.ID,
+		)
+		if err != nil {
 			return 0, err
 		}
+		return ownerID, nil
+	}
+
+	userID := state.UserID
+
+	// the user is created with the account, so the concurrent first login does not leave the orphan user
+	tx, err := s.usersDB.Begin()
+	if err != nil {
+		return 0, err
 	}
 
-	if stateUserID <= 0 {
+	if userID <= 0 {
 
-		res, err := s.usersDB.Exec(`
+		res, err := tx.Exec(`
 			INSERT INTO users (login, e_mail, password, email_to_check, hide_e_mail, email_check_code, name, reg_date, last_online, timezone, last_ip, language) 
 			VALUES (NULL, NULL, '', NULL, 1, NULL, ?, NOW(), NOW(), ?, INET6_ATON(?), ?)
 		`,
@@ -633,39 +834,43 @@ func (s *Service) registerUser(userInfo *UserInfo, state *State, timezone string
 			state.Language,
 		)
 		if err != nil {
+			_ = tx.Rollback()
 			return 0, err
 		}
 
-		stateUserID, err = res.LastInsertId()
+		userID, err = res.LastInsertId()
 		if err != nil {
+			_ = tx.Rollback()
 			return 0, err
 		}
 	}
 
-	if stateUserID <= 0 {
-		return 0, fmt.Errorf("Account not found")
-	}
-
-	_, err := s.usersDB.Exec(`
+	_, err = tx.Exec(`
 		INSERT INTO user_account (service_id, external_id, user_id, used_for_reg, name, link) 
 		VALUES (?, ?, ?, ?, ?, ?)
-		ON DUPLICATE KEY UPDATE
-			user_id = VALUES(user_id),
-			name = VALUES(name),
-			link = VALUES(link)
 	`,
 		state.Service,
 		userInfo.ID,
-		stateUserID,
+		userID,
 		state.UserID == 0,
 		userInfo.Name,
 		userInfo.URL,
 	)
+	if err != nil {
+		_ = tx.Rollback()
+		// the account is registered concurrently, so it is handled as the one of its owner
+		if e, ok := err.(*mysql.MySQLError); ok && e.Number == mysqlDuplicateEntry {
+			return s.registerUser(userInfo, state, timezone, ip)
+		}
+		return 0, err
+	}
+
+	err = tx.Commit()
 	if err != nil {
 		return 0, err
 	}
 
-	return stateUserID, nil
+	return userID, nil
 }
 
 // ListenHTTP HTTP thread
@@ -726,6 +931,48 @@ func (s *Service) Close() {
 
 	s.waitGroup.Wait()
 
+	if s.tokenStore != nil {
+		err := s.tokenStore.Close()
+		if err != nil {
+			s.logger.Println(err)
+		}
+	}
+
+	if s.mfaStore != nil {
+		err := s.mfaStore.Close()
+		if err != nil {
+			s.logger.Println(err)
+		}
+	}
+
+	if s.linkStore != nil {
+		err := s.linkStore.Close()
+		if err != nil {
+			s.logger.Println(err)
+		}
+	}
+
+	if s.webAuthnStore != nil {
+		err := s.webAuthnStore.Close()
+		if err != nil {
+			s.logger.Println(err)
+		}
+	}
+
+	if s.throttleStore != nil {
+		err := s.throttleStore.Close()
+		if err != nil {
+			s.logger.Println(err)
+		}
+	}
+
+	if s.stateStore != nil {
+		err := s.stateStore.Close()
+		if err != nil {
+			s.logger.Println(err)
+		}
+	}
+
 	if s.db != nil {
 		err := s.db.Close()
 		if err != nil {
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/autowp/auth/oauth2server"
+	"github.com/getsentry/sentry-go"
+	"github.com/gin-gonic/gin"
+)
+
+// SessionResponse the session of the user, marked when the request is authorized by it
+type SessionResponse struct {
+	oauth2server.Session
+	Current bool `json:"current"`
+}
+
+// userToken authorizes the account management request by the access token of the user.
+// Only the first-party clients manage the account, the tokens of the other ones are refused
+func (s *Service) userToken(c *gin.Context) oauth2server.TokenInfo {
+	ti, err := s.oauthServer.ValidationBearerToken(c.Request)
+	if err != nil || ti.GetUserID() == 0 {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.Status(http.StatusUnauthorized)
+		return nil
+	}
+
+	if !s.isFirstPartyClient(ti.GetClientID()) {
+		c.Header("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+		c.Status(http.StatusForbidden)
+		return nil
+	}
+
+	return ti
+}
+
+func (s *Service) handleSessions(c *gin.Context) {
+	ti := s.userToken(c)
+	if ti == nil {
+		return
+	}
+
+	sessions, err := s.tokenStore.GetSessionsByUser(ti.GetUserID())
+	if err != nil {
+		log.Println("Failed to list sessions:", err.Error())
+		sentry.CaptureException(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	items := make([]SessionResponse, len(sessions))
+	for i, session := range sessions {
+		items[i] = SessionResponse{
+			Session: session,
+			Current: session.ID == ti.GetFamily(),
+		}
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"items": items,
+	})
+}
+
+func (s *Service) handleSessionDelete(c *gin.Context) {
+	ti := s.userToken(c)
+	if ti == nil {
+		return
+	}
+
+	found, err := s.tokenStore.RemoveUserSession(ti.GetUserID(), c.Param("id"))
+	if err != nil {
+		log.Println("Failed to revoke session:", err.Error())
+		sentry.CaptureException(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	if !found {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Service) handleSessionsDelete(c *gin.Context) {
+	ti := s.userToken(c)
+	if ti == nil {
+		return
+	}
+
+	err := s.tokenStore.RemoveByUser(ti.GetUserID())
+	if err != nil {
+		log.Println("Failed to revoke sessions:", err.Error())
+		sentry.CaptureException(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,344 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/autowp/auth/oauth2server"
+	"github.com/autowp/auth/oauth2server/errors"
+	"github.com/getsentry/sentry-go"
+	"github.com/gin-gonic/gin"
+)
+
+// SignUpConfig native signup at /api/oauth/register.
+// With IssueTokens the client of the request gets the password grant tokens of the new user.
+// Signups are limited to IPLimit per client address in IPWindow minutes, zero disables.
+// The counters are kept in the throttle store, so IPWindow must not exceed its window
+type SignUpConfig struct {
+	Enabled           bool `yaml:"enabled"             mapstructure:"enabled"`
+	PasswordMinLength uint `yaml:"password_min_length" mapstructure:"password_min_length"`
+	IssueTokens       bool `yaml:"issue_tokens"        mapstructure:"issue_tokens"`
+	IPLimit           uint `yaml:"ip_limit"            mapstructure:"ip_limit"`
+	IPWindow          uint `yaml:"ip_window"           mapstructure:"ip_window"`
+}
+
+const (
+	signUpLoginMaxLength    = 30
+	signUpNameMaxLength     = 50
+	signUpEmailMaxLength    = 255
+	signUpPasswordMaxLength = 1024
+)
+
+var signUpLoginRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// SignUpRequest signup form, login is optional
+type SignUpRequest struct {
+	Login    string `form:"login"    json:"login"`
+	Email    string `form:"email"    json:"email"`
+	Password string `form:"password" json:"password"`
+	Name     string `form:"name"     json:"name"`
+	Scope    string `form:"scope"    json:"scope"`
+	// IP and Host of the request are set by the handler
+	IP   string `form:"-" json:"-"`
+	Host Host   `form:"-" json:"-"`
+}
+
+// SignUpError rejected signup, Field is the invalid form field if any
+type SignUpError struct {
+	Status      int
+	Code        string
+	Description string
+	Field       string
+}
+
+func (e *SignUpError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func invalidSignUp(field, description string) *SignUpError {
+	return &SignUpError{
+		Status:      http.StatusBadRequest,
+		Code:        "invalid_" + field,
+		Description: description,
+		Field:       field,
+	}
+}
+
+// SignUpHook anti-abuse check of the signup, e.g. captcha or disposable email domains.
+// SignUpError rejects the signup, other errors fail the request
+type SignUpHook func(c *gin.Context, request *SignUpRequest) error
+
+type signUpHooks struct {
+	mutex sync.RWMutex
+	hooks []SignUpHook
+}
+
+func (h *signUpHooks) add(hook SignUpHook) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.hooks = append(h.hooks, hook)
+}
+
+func (h *signUpHooks) run(c *gin.Context, request *SignUpRequest) error {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for _, hook := range h.hooks {
+		err := hook(c, request)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddSignUpHook adds the check, hooks run in the order of adding after the form validation
+func (s *Service) AddSignUpHook(hook SignUpHook) {
+	s.signUpHooks.add(hook)
+}
+
+// signUpRateLimitHook limits the signups per client address
+func signUpRateLimitHook(store ThrottleStore, limit uint, window time.Duration) SignUpHook {
+	return func(c *gin.Context, request *SignUpRequest) error {
+		count, err := store.Fail("signup:"+request.IP, window)
+		if err != nil {
+			return err
+		}
+		if count > limit {
+			return &SignUpError{
+				Status:      http.StatusTooManyRequests,
+				Code:        "too_many_signups",
+				Description: "Too many signups from this address, try again later",
+			}
+		}
+		return nil
+	}
+}
+
+// requestHost the host of the request, the first one when it does not match
+func (s *Service) requestHost(c *gin.Context) Host {
+	for _, host := range s.config.Hosts {
+		if host.Hostname == c.Request.Host {
+			return host
+		}
+	}
+	return s.config.Hosts[0]
+}
+
+func validateEmail(email string) *SignUpError {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || len(email) > signUpEmailMaxLength {
+		return invalidSignUp("email", "Email is invalid")
+	}
+	return nil
+}
+
+func emailTakenError() *SignUpError {
+	return &SignUpError{
+		Status:      http.StatusConflict,
+		Code:        "email_taken",
+		Description: "Email is already registered",
+		Field:       "email",
+	}
+}
+
+func (s *Service) validatePassword(password string) *SignUpError {
+	if utf8.RuneCountInString(password) < int(s.config.OAuth.SignUp.PasswordMinLength) ||
+		len(password) > signUpPasswordMaxLength {
+		return invalidSignUp("password", fmt.Sprintf(
+			"Password must be at least %d characters", s.config.OAuth.SignUp.PasswordMinLength,
+		))
+	}
+	return nil
+}
+
+func (s *Service) validateSignUp(request *SignUpRequest) (*SignUpError, error) {
+	request.Login = strings.TrimSpace(request.Login)
+	request.Email = strings.TrimSpace(request.Email)
+	request.Name = strings.TrimSpace(request.Name)
+
+	if request.Login != "" {
+		if len(request.Login) < 2 || len(request.Login) > signUpLoginMaxLength || !signUpLoginRegexp.MatchString(request.Login) {
+			return invalidSignUp("login", fmt.Sprintf(
+				"Login must be 2-%d latin letters, digits, dots, dashes or underscores", signUpLoginMaxLength,
+			)), nil
+		}
+	}
+
+	if e := validateEmail(request.Email); e != nil {
+		return e, nil
+	}
+
+	if e := s.validatePassword(request.Password); e != nil {
+		return e, nil
+	}
+
+	if request.Name == "" || utf8.RuneCountInString(request.Name) > signUpNameMaxLength {
+		return invalidSignUp("name", fmt.Sprintf("Name must be 1-%d characters", signUpNameMaxLength)), nil
+	}
+
+	if request.Login != "" {
+		taken, err := s.userStore.IsLoginTaken(request.Login)
+		if err != nil {
+			return nil, err
+		}
+		if taken {
+			return &SignUpError{
+				Status:      http.StatusConflict,
+				Code:        "login_taken",
+				Description: "Login is already taken",
+				Field:       "login",
+			}, nil
+		}
+	}
+
+	taken, err := s.userStore.IsEmailTaken(request.Email, 0)
+	if err != nil {
+		return nil, err
+	}
+	if taken {
+		return emailTakenError(), nil
+	}
+
+	return nil, nil
+}
+
+// signUpClient authenticates the client which receives the tokens of the new user
+func (s *Service) signUpClient(c *gin.Context, scope string) (*oauth2server.TokenGenerateRequest, error) {
+	s.setDefaultClient(c)
+
+	clientID, clientSecret, err := s.oauthServer.ClientInfoHandler(c.Request)
+	if err != nil {
+		return nil, err
+	}
+
+	cli, err := s.oauthServer.Manager.GetClient(clientID)
+	if err != nil || cli == nil || !oauth2server.VerifyClientSecret(cli, clientSecret) {
+		return nil, errors.ErrInvalidClient
+	}
+
+	gt := oauth2server.PasswordCredentials
+	if !s.oauthServer.CheckGrantType(gt) || !s.oauthServer.CheckClientGrantType(cli, gt) {
+		return nil, errors.ErrUnauthorizedClient
+	}
+
+	if !s.oauthServer.CheckClientScope(cli, scope) {
+		return nil, errors.ErrInvalidScope
+	}
+
+	return &oauth2server.TokenGenerateRequest{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scope:        scope,
+		Request:      c.Request,
+	}, nil
+}
+
+func (s *Service) signUpError(c *gin.Context, e *SignUpError) {
+	data := gin.H{
+		"error":             e.Code,
+		"error_description": e.Description,
+	}
+	if e.Field != "" {
+		data["field"] = e.Field
+	}
+	c.JSON(e.Status, data)
+}
+
+func (s *Service) handleSignUp(c *gin.Context) {
+	var request SignUpRequest
+	err := c.ShouldBind(&request)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	request.IP = s.proxies.ClientIP(c.Request)
+	request.Host = s.requestHost(c)
+
+	// the client is checked first, so the failed token issuing does not leave the orphan user
+	var tgr *oauth2server.TokenGenerateRequest
+	if s.config.OAuth.SignUp.IssueTokens {
+		tgr, err = s.signUpClient(c, request.Scope)
+		if err != nil {
+			s.oauthServer.TokenError(c, err)
+			return
+		}
+	}
+
+	signUpErr, err := s.validateSignUp(&request)
+	if err == nil && signUpErr == nil {
+		err = s.signUpHooks.run(c, &request)
+		if e, ok := err.(*SignUpError); ok {
+			signUpErr, err = e, nil
+		}
+	}
+	if err != nil {
+		log.Println("Failed to validate signup:", err.Error())
+		sentry.CaptureException(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	if signUpErr != nil {
+		s.signUpError(c, signUpErr)
+		return
+	}
+
+	// the email stays pending until the emailed link is opened, without the email flows it is never confirmed
+	emailCheckCode, err := newEmailCheckCode()
+	if err != nil {
+		log.Println("Failed to create user:", err.Error())
+		sentry.CaptureException(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	userID, err := s.userStore.Create(
+		request.Login, request.Email, emailCheckCode, request.Password, request.Name,
+		request.Host.Language, request.Host.Timezone, request.IP,
+	)
+	if err != nil {
+		log.Println("Failed to create user:", err.Error())
+		sentry.CaptureException(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	if s.mailer != nil {
+		err = s.sendEmailVerification(request.Host, userID, request.Name, request.Email, emailCheckCode)
+		if err != nil {
+			// the link can be requested again
+			log.Println("Failed to send email verification:", err.Error())
+			sentry.CaptureException(err)
+		}
+	}
+
+	data := map[string]interface{}{}
+	if tgr != nil {
+		tgr.UserID = userID
+		ti, err := s.oauthServer.GetAccessToken(oauth2server.PasswordCredentials, tgr)
+		if err != nil {
+			// the user is created anyway and can log in with the password
+			log.Println("Failed to issue signup tokens:", err.Error())
+			sentry.CaptureException(err)
+		} else {
+			data = s.oauthServer.GetTokenData(ti)
+		}
+	}
+	data["user_id"] = userID
+
+	s.oauthServer.Token(c, data, nil, http.StatusCreated)
+}
+
+func (s *Service) setupSignUpRoutes(apiGroup *gin.RouterGroup) {
+	if !s.config.OAuth.SignUp.Enabled {
+		return
+	}
+
+	apiGroup.POST("/register", s.handleSignUp)
+}
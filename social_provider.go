@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// socialHTTPClient the client of the provider requests, the slow provider must not hold the request forever
+var socialHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// socialContext makes the oauth2 package use socialHTTPClient
+func socialContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, socialHTTPClient)
+}
+
+// SocialProvider external identity provider
+type SocialProvider interface {
+	// AuthCodeURL returns the url of the provider consent page
+	AuthCodeURL(ctx context.Context, stateID string, state *State) (string, error)
+	// Exchange converts the authorization code into the provider token
+	Exchange(ctx context.Context, code string, state *State) (*oauth2.Token, error)
+	// UserInfo fetches the normalized profile of the token owner
+	UserInfo(ctx context.Context, token *oauth2.Token, state *State) (*UserInfo, error)
+}
+
+// SocialProviderFactory builds the provider from its config
+type SocialProviderFactory func(config ServiceConfig, redirectURI string) (SocialProvider, error)
+
+var socialProviderFactories = make(map[string]SocialProviderFactory)
+
+// RegisterSocialProviderType makes the provider type available for the services config
+func RegisterSocialProviderType(name string, factory SocialProviderFactory) {
+	if _, ok := socialProviderFactories[name]; ok {
+		panic(fmt.Sprintf("Social provider type `%s` already registered", name))
+	}
+	socialProviderFactories[name] = factory
+}
+
+// SocialProviders registry of the configured providers
+type SocialProviders map[ExternalService]SocialProvider
+
+// legacyProviders the provider types of the deprecated services.google, services.facebook and services.vk
+var legacyProviders = map[ExternalService]string{
+	Google:   "google",
+	Facebook: "facebook",
+	VK:       "vk",
+}
+
+// providersConfig the providers with the deprecated configs mapped in, their scopes replace the default ones
+func providersConfig(config ServicesConfig) (map[string]ServiceConfig, error) {
+	result := make(map[string]ServiceConfig, len(config.Providers))
+	for id, providerConfig := range config.Providers {
+		result[id] = providerConfig
+	}
+
+	legacy := map[ExternalService]ServiceConfig{
+		Google:   config.Google,
+		Facebook: config.Facebook,
+		VK:       config.VK,
+	}
+
+	for service, legacyConfig := range legacy {
+		if legacyConfig.ClientID == "" && legacyConfig.ClientSecret == "" {
+			continue
+		}
+
+		id := string(service)
+		providerConfig := result[id]
+		if providerConfig.ClientID != "" || providerConfig.ClientSecret != "" {
+			return nil, fmt.Errorf("Service `%s`: configured both in services and services.providers", id)
+		}
+
+		log.Printf("services.%s is deprecated, use services.providers.%s", legacyProviders[service], id)
+
+		providerConfig.Type = legacyProviders[service]
+		providerConfig.ClientID = legacyConfig.ClientID
+		providerConfig.ClientSecret = legacyConfig.ClientSecret
+		if len(legacyConfig.Scopes) > 0 {
+			providerConfig.Scopes = legacyConfig.Scopes
+		}
+		result[id] = providerConfig
+	}
+
+	return result, nil
+}
+
+// NewSocialProviders constructor
+func NewSocialProviders(config ServicesConfig) (SocialProviders, error) {
+	providers := make(SocialProviders)
+
+	configs, err := providersConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	for id, providerConfig := range configs {
+		providerType := providerConfig.Type
+		if providerType == "" {
+			providerType = id
+		}
+
+		factory, ok := socialProviderFactories[providerType]
+		if !ok {
+			return nil, fmt.Errorf("Service `%s`: unknown provider type `%s`", id, providerType)
+		}
+
+		provider, err := factory(providerConfig, config.RedirectURI)
+		if err != nil {
+			return nil, fmt.Errorf("Service `%s`: %v", id, err)
+		}
+
+		providers[ExternalService(id)] = provider
+	}
+
+	return providers, nil
+}
+
+// Get returns nil for unknown service
+func (p SocialProviders) Get(service ExternalService) SocialProvider {
+	return p[service]
+}
+
+// oauth2Provider common part of the providers based on the authorization code flow
+type oauth2Provider struct {
+	config *oauth2.Config
+}
+
+func newOAuth2Provider(config ServiceConfig, redirectURI string, endpoint oauth2.Endpoint) oauth2Provider {
+	return oauth2Provider{
+		config: &oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			Endpoint:     endpoint,
+			Scopes:       config.Scopes,
+			RedirectURL:  redirectURI,
+		},
+	}
+}
+
+// AuthCodeURL AuthCodeURL
+func (p *oauth2Provider) AuthCodeURL(ctx context.Context, stateID string, state *State) (string, error) {
+	return p.config.AuthCodeURL(stateID, oauth2.AccessTypeOnline), nil
+}
+
+// Exchange Exchange
+func (p *oauth2Provider) Exchange(ctx context.Context, code string, state *State) (*oauth2.Token, error) {
+	return p.config.Exchange(ctx, code)
+}
+
+func readOKBody(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
@@ -1,8 +1,14 @@
 package auth
 
 import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"os"
 	"sync"
 	"time"
+
+	"github.com/autowp/auth/oauth2server"
 )
 
 // State State
@@ -10,70 +16,185 @@ type State struct {
 	UserID      int64
 	Language    string
 	Service     ExternalService
+	ClientID    string
 	RedirectURI string
+	Scope       string
+	// ClientState returned back to the client with the code
+	ClientState         string
+	CodeChallenge       string
+	CodeChallengeMethod oauth2server.CodeChallengeMethod
+	// Nonce expected in the upstream id_token
+	Nonce string
+}
+
+// StateStore storage of the social login states between /service and /service-callback
+type StateStore interface {
+	// Put stores the state for the store TTL
+	Put(id string, state State) error
+	// Consume removes the state and returns it, nil when state is missing or expired.
+	// Each state can be consumed only once
+	Consume(id string) (*State, error)
+	// Close stops the garbage collection
+	Close() error
+}
+
+// NewStateStore creates the store by its name
+func NewStateStore(name string, db *sql.DB, ttl time.Duration) StateStore {
+	if name == "memory" {
+		return NewMemoryStateStore(ttl)
+	}
+	return NewPostgresStateStore(db, ttl)
 }
 
-// StateMapItem StateMapItem
-type StateMapItem struct {
-	State      State
-	lastAccess time.Time
+type memoryStateItem struct {
+	state     State
+	expiresAt time.Time
 }
 
-// StateMap StateMap
-type StateMap struct {
-	m map[string]*StateMapItem
-	l sync.Mutex
+// MemoryStateStore in-process store, suitable only for the single instance
+type MemoryStateStore struct {
+	m      map[string]memoryStateItem
+	l      sync.Mutex
+	ttl    time.Duration
+	ticker *time.Ticker
 }
 
-// NewStateMap NewStateMap
-func NewStateMap(maxTTL time.Duration) (m *StateMap) {
-	m = &StateMap{m: make(map[string]*StateMapItem)}
-	go func() {
-		for now := range time.Tick(time.Minute) {
-			m.l.Lock()
-			for k, v := range m.m {
-				expiresAt := v.lastAccess.Add(maxTTL)
-				if now.After(expiresAt) {
-					delete(m.m, k)
-				}
+// NewMemoryStateStore constructor
+func NewMemoryStateStore(ttl time.Duration) *MemoryStateStore {
+	s := &MemoryStateStore{
+		m:      make(map[string]memoryStateItem),
+		ttl:    ttl,
+		ticker: time.NewTicker(time.Minute),
+	}
+	go s.gc()
+	return s
+}
+
+func (s *MemoryStateStore) gc() {
+	for now := range s.ticker.C {
+		s.l.Lock()
+		for k, v := range s.m {
+			if now.After(v.expiresAt) {
+				delete(s.m, k)
 			}
-			m.l.Unlock()
 		}
-	}()
-	return
+		s.l.Unlock()
+	}
+}
+
+// Close Close
+func (s *MemoryStateStore) Close() error {
+	s.ticker.Stop()
+	return nil
 }
 
 // Len Len
-func (m *StateMap) Len() int {
-	return len(m.m)
+func (s *MemoryStateStore) Len() int {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return len(s.m)
 }
 
 // Put Put
-func (m *StateMap) Put(k string, v State) {
-	m.l.Lock()
-	it, ok := m.m[k]
+func (s *MemoryStateStore) Put(id string, state State) error {
+	s.l.Lock()
+	s.m[id] = memoryStateItem{
+		state:     state,
+		expiresAt: time.Now().Add(s.ttl),
+	}
+	s.l.Unlock()
+	return nil
+}
+
+// Consume Consume
+func (s *MemoryStateStore) Consume(id string) (*State, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	it, ok := s.m[id]
 	if !ok {
-		it = &StateMapItem{State: v}
-		m.m[k] = it
+		return nil, nil
+	}
+	delete(s.m, id)
+
+	if time.Now().After(it.expiresAt) {
+		return nil, nil
 	}
-	it.lastAccess = time.Now()
-	m.l.Unlock()
+
+	return &it.state, nil
 }
 
-// Get Get
-func (m *StateMap) Get(k string) (v *State) {
-	m.l.Lock()
-	if it, ok := m.m[k]; ok {
-		v = &it.State
-		it.lastAccess = time.Now()
+// PostgresStateStore store shared by all instances
+type PostgresStateStore struct {
+	db     *sql.DB
+	ttl    time.Duration
+	logger *log.Logger
+	ticker *time.Ticker
+}
+
+// NewPostgresStateStore constructor
+func NewPostgresStateStore(db *sql.DB, ttl time.Duration) *PostgresStateStore {
+	s := &PostgresStateStore{
+		db:     db,
+		ttl:    ttl,
+		logger: log.New(os.Stderr, "[STATES-PG-ERROR]", log.LstdFlags),
+		ticker: time.NewTicker(10 * time.Minute),
+	}
+	go s.gc()
+	return s
+}
+
+func (s *PostgresStateStore) gc() {
+	for range s.ticker.C {
+		_, err := s.db.Exec("DELETE FROM states WHERE expires_at <= $1", time.Now())
+		if err != nil {
+			s.logger.Printf("Error while cleaning out outdated states: %+v", err)
+		}
 	}
-	m.l.Unlock()
-	return
 }
 
-// Delete Delete
-func (m *StateMap) Delete(k string) {
-	m.l.Lock()
-	delete(m.m, k)
-	m.l.Unlock()
+// Close Close
+func (s *PostgresStateStore) Close() error {
+	s.ticker.Stop()
+	return nil
+}
+
+// Put Put
+func (s *PostgresStateStore) Put(id string, state State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		"INSERT INTO states (id, expires_at, data) VALUES ($1, $2, $3)",
+		id, time.Now().Add(s.ttl), data,
+	)
+
+	return err
+}
+
+// Consume Consume
+func (s *PostgresStateStore) Consume(id string) (*State, error) {
+	var data []byte
+
+	// DELETE ... RETURNING guarantees that only one of the concurrent callbacks gets the state
+	err := s.db.QueryRow(
+		"DELETE FROM states WHERE id = $1 AND expires_at > $2 RETURNING data",
+		id, time.Now(),
+	).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := &State{}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
 }
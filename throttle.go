@@ -0,0 +1,349 @@
+package auth
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/autowp/auth/oauth2server/errors"
+)
+
+// ThrottleConfig limits of the failed password attempts.
+// Limits are the failures per username and per client address before the lockout, zero disables.
+// Lockout in seconds is doubled with each next failure up to MaxLockout.
+// Failures are forgotten after Window minutes since the last one
+type ThrottleConfig struct {
+	Store         string `yaml:"store"          mapstructure:"store"`
+	UsernameLimit uint   `yaml:"username_limit" mapstructure:"username_limit"`
+	IPLimit       uint   `yaml:"ip_limit"       mapstructure:"ip_limit"`
+	Lockout       uint   `yaml:"lockout"        mapstructure:"lockout"`
+	MaxLockout    uint   `yaml:"max_lockout"    mapstructure:"max_lockout"`
+	Window        uint   `yaml:"window"         mapstructure:"window"`
+}
+
+// ThrottleStore failed attempts counters
+type ThrottleStore interface {
+	// LockedUntil the end of the key lockout, zero when it is not locked
+	LockedUntil(key string) (time.Time, error)
+	// Fail counts the failure and returns the failures count.
+	// Counter starts over when the previous failure is older than the window
+	Fail(key string, window time.Duration) (uint, error)
+	// Lock locks the key until the time
+	Lock(key string, until time.Time) error
+	// Reset forgets the failures of the key
+	Reset(key string) error
+	// Close stops the garbage collection
+	Close() error
+}
+
+// NewThrottleStore creates the store by its name
+func NewThrottleStore(name string, db *sql.DB, window time.Duration) ThrottleStore {
+	if name == "memory" {
+		return NewMemoryThrottleStore(window)
+	}
+	return NewPostgresThrottleStore(db, window)
+}
+
+// Throttle exponential backoff of the password attempts per username and per client address
+type Throttle struct {
+	store  ThrottleStore
+	config ThrottleConfig
+}
+
+// NewThrottle constructor
+func NewThrottle(store ThrottleStore, config ThrottleConfig) *Throttle {
+	return &Throttle{
+		store:  store,
+		config: config,
+	}
+}
+
+func throttleUsernameKey(username string) string {
+	return "username:" + strings.ToLower(strings.TrimSpace(username))
+}
+
+func throttleIPKey(ip string) string {
+	return "ip:" + ip
+}
+
+func (t *Throttle) keys(username, ip string) map[string]uint {
+	keys := make(map[string]uint)
+	if t.config.UsernameLimit > 0 && username != "" {
+		keys[throttleUsernameKey(username)] = t.config.UsernameLimit
+	}
+	if t.config.IPLimit > 0 && ip != "" {
+		keys[throttleIPKey(ip)] = t.config.IPLimit
+	}
+	return keys
+}
+
+func throttleMFAKey(userID int64) string {
+	return "mfa:" + strconv.FormatInt(userID, 10)
+}
+
+// Check returns *errors.LockedError when the username or the address is locked
+func (t *Throttle) Check(username, ip string) error {
+	return t.check(t.keys(username, ip))
+}
+
+func (t *Throttle) check(keys map[string]uint) error {
+	now := time.Now()
+	var retryAfter time.Duration
+
+	for key := range keys {
+		until, err := t.store.LockedUntil(key)
+		if err != nil {
+			return err
+		}
+		if d := until.Sub(now); d > retryAfter {
+			retryAfter = d
+		}
+	}
+
+	if retryAfter > 0 {
+		return &errors.LockedError{RetryAfter: retryAfter}
+	}
+
+	return nil
+}
+
+// Fail counts the failed attempt and locks the keys which are over the limit
+func (t *Throttle) Fail(username, ip string) error {
+	return t.fail(t.keys(username, ip))
+}
+
+func (t *Throttle) fail(keys map[string]uint) error {
+	window := time.Duration(t.config.Window) * time.Minute
+
+	for key, limit := range keys {
+		failures, err := t.store.Fail(key, window)
+		if err != nil {
+			return err
+		}
+
+		if failures < limit {
+			continue
+		}
+
+		err = t.store.Lock(key, time.Now().Add(t.lockout(failures-limit)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Success forgets the failures of the username, the address counter is kept against the credential stuffing
+func (t *Throttle) Success(username string) error {
+	if t.config.UsernameLimit == 0 || username == "" {
+		return nil
+	}
+	return t.store.Reset(throttleUsernameKey(username))
+}
+
+// CheckMFA returns *errors.LockedError when the codes of the user are locked
+func (t *Throttle) CheckMFA(userID int64) error {
+	return t.check(map[string]uint{throttleMFAKey(userID): 0})
+}
+
+// FailMFA counts the wrong code of the user, the codes are locked after the limit of failures
+func (t *Throttle) FailMFA(userID int64, limit uint) error {
+	if limit == 0 {
+		return nil
+	}
+	return t.fail(map[string]uint{throttleMFAKey(userID): limit})
+}
+
+// SuccessMFA forgets the wrong codes of the user
+func (t *Throttle) SuccessMFA(userID int64) error {
+	return t.store.Reset(throttleMFAKey(userID))
+}
+
+func (t *Throttle) lockout(n uint) time.Duration {
+	lockout := time.Duration(t.config.Lockout) * time.Second
+	maxLockout := time.Duration(t.config.MaxLockout) * time.Second
+
+	for i := uint(0); i < n && lockout < maxLockout; i++ {
+		lockout *= 2
+	}
+
+	if lockout > maxLockout {
+		lockout = maxLockout
+	}
+
+	return lockout
+}
+
+type memoryThrottleItem struct {
+	failures    uint
+	failedAt    time.Time
+	lockedUntil time.Time
+}
+
+// MemoryThrottleStore in-process store, suitable only for the single instance
+type MemoryThrottleStore struct {
+	m      map[string]memoryThrottleItem
+	l      sync.Mutex
+	window time.Duration
+	ticker *time.Ticker
+}
+
+// NewMemoryThrottleStore constructor
+func NewMemoryThrottleStore(window time.Duration) *MemoryThrottleStore {
+	s := &MemoryThrottleStore{
+		m:      make(map[string]memoryThrottleItem),
+		window: window,
+		ticker: time.NewTicker(time.Minute),
+	}
+	go s.gc()
+	return s
+}
+
+func (s *MemoryThrottleStore) gc() {
+	for now := range s.ticker.C {
+		s.l.Lock()
+		for k, v := range s.m {
+			if now.Sub(v.failedAt) > s.window && now.After(v.lockedUntil) {
+				delete(s.m, k)
+			}
+		}
+		s.l.Unlock()
+	}
+}
+
+// Close Close
+func (s *MemoryThrottleStore) Close() error {
+	s.ticker.Stop()
+	return nil
+}
+
+// LockedUntil LockedUntil
+func (s *MemoryThrottleStore) LockedUntil(key string) (time.Time, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	return s.m[key].lockedUntil, nil
+}
+
+// Fail Fail
+func (s *MemoryThrottleStore) Fail(key string, window time.Duration) (uint, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	now := time.Now()
+	it := s.m[key]
+	if now.Sub(it.failedAt) > window {
+		it.failures = 0
+	}
+	it.failures++
+	it.failedAt = now
+	s.m[key] = it
+
+	return it.failures, nil
+}
+
+// Lock Lock
+func (s *MemoryThrottleStore) Lock(key string, until time.Time) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	it := s.m[key]
+	it.lockedUntil = until
+	s.m[key] = it
+
+	return nil
+}
+
+// Reset Reset
+func (s *MemoryThrottleStore) Reset(key string) error {
+	s.l.Lock()
+	delete(s.m, key)
+	s.l.Unlock()
+	return nil
+}
+
+// PostgresThrottleStore store shared by all instances
+type PostgresThrottleStore struct {
+	db     *sql.DB
+	window time.Duration
+	logger *log.Logger
+	ticker *time.Ticker
+}
+
+// NewPostgresThrottleStore constructor
+func NewPostgresThrottleStore(db *sql.DB, window time.Duration) *PostgresThrottleStore {
+	s := &PostgresThrottleStore{
+		db:     db,
+		window: window,
+		logger: log.New(os.Stderr, "[THROTTLE-PG-ERROR]", log.LstdFlags),
+		ticker: time.NewTicker(10 * time.Minute),
+	}
+	go s.gc()
+	return s
+}
+
+func (s *PostgresThrottleStore) gc() {
+	for now := range s.ticker.C {
+		_, err := s.db.Exec(
+			"DELETE FROM login_attempts WHERE failed_at <= $1 AND (locked_until IS NULL OR locked_until <= $2)",
+			now.Add(-s.window), now,
+		)
+		if err != nil {
+			s.logger.Printf("Error while cleaning out outdated login attempts: %+v", err)
+		}
+	}
+}
+
+// Close Close
+func (s *PostgresThrottleStore) Close() error {
+	s.ticker.Stop()
+	return nil
+}
+
+// LockedUntil LockedUntil
+func (s *PostgresThrottleStore) LockedUntil(key string) (time.Time, error) {
+	var until sql.NullTime
+	err := s.db.QueryRow("SELECT locked_until FROM login_attempts WHERE key = $1", key).Scan(&until)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return until.Time, nil
+}
+
+// Fail Fail
+func (s *PostgresThrottleStore) Fail(key string, window time.Duration) (uint, error) {
+	now := time.Now()
+
+	// upsert keeps the counter consistent between the concurrent replicas
+	var failures uint
+	err := s.db.QueryRow(`
+		INSERT INTO login_attempts (key, failures, failed_at) VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_attempts.failed_at < $3 THEN 1 ELSE login_attempts.failures + 1 END,
+			failed_at = $2
+		RETURNING failures
+	`, key, now, now.Add(-window)).Scan(&failures)
+
+	return failures, err
+}
+
+// Lock Lock
+func (s *PostgresThrottleStore) Lock(key string, until time.Time) error {
+	_, err := s.db.Exec("UPDATE login_attempts SET locked_until = $1 WHERE key = $2", until, key)
+	return err
+}
+
+// Reset Reset
+func (s *PostgresThrottleStore) Reset(key string) error {
+	_, err := s.db.Exec("DELETE FROM login_attempts WHERE key = $1", key)
+	return err
+}
@@ -1,20 +1,28 @@
 package auth
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"fmt"
 	"log"
 	"os"
 	"time"
 
 	"github.com/autowp/auth/oauth2server"
+	"github.com/autowp/auth/oauth2server/errors"
 	"github.com/autowp/auth/oauth2server/models"
 	jsoniter "github.com/json-iterator/go"
 )
 
-// TokenStore PostgreSQL token store
+// TokenStore PostgreSQL token store.
+// Only HMAC-SHA256 of the code, access and refresh tokens are stored,
+// so the table contents can't be used as credentials
 type TokenStore struct {
 	adapter *sql.DB
 	logger  *log.Logger
+	hashKey []byte
 
 	gcDisabled bool
 	gcInterval time.Duration
@@ -23,13 +31,19 @@ type TokenStore struct {
 
 // TokenStoreItem data item
 type TokenStoreItem struct {
-	ID        int64     `db:"id"`
-	CreatedAt time.Time `db:"created_at"`
-	ExpiresAt time.Time `db:"expires_at"`
-	Code      string    `db:"code"`
-	Access    string    `db:"access"`
-	Refresh   string    `db:"refresh"`
-	Data      []byte    `db:"data"`
+	ID        int64      `db:"id"`
+	CreatedAt time.Time  `db:"created_at"`
+	ExpiresAt time.Time  `db:"expires_at"`
+	Code      string     `db:"code"`
+	Access    string     `db:"access"`
+	Refresh   string     `db:"refresh"`
+	Data      []byte     `db:"data"`
+	Family    string     `db:"family"`
+	RotatedAt *time.Time `db:"rotated_at"`
+	UserID    int64      `db:"user_id"`
+	ClientID  string     `db:"client_id"`
+	IP        string     `db:"ip"`
+	UserAgent string     `db:"user_agent"`
 }
 
 // NewTokenStore creates PostgreSQL store instance
@@ -44,14 +58,110 @@ func NewTokenStore(adapter *sql.DB, options ...TokenStoreOption) (*TokenStore, e
 		o(store)
 	}
 
-	var err error
+	if len(store.hashKey) == 0 {
+		return nil, fmt.Errorf("token store hash key is required")
+	}
+
+	err := store.hashLegacyTokens()
+	if err != nil {
+		return nil, err
+	}
 
 	if !store.gcDisabled {
 		store.ticker = time.NewTicker(store.gcInterval)
 		go store.gc()
 	}
 
-	return store, err
+	return store, nil
+}
+
+func (s *TokenStore) hash(value string) string {
+	mac := hmac.New(sha256.New, s.hashKey)
+	_, _ = mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *TokenStore) hashNonEmpty(value string) string {
+	if value == "" {
+		return ""
+	}
+	return s.hash(value)
+}
+
+// tokenData returns token information without the secret values
+func tokenData(info oauth2server.TokenInfo) ([]byte, error) {
+	buf, err := jsoniter.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+
+	var tm models.Token
+	err = jsoniter.Unmarshal(buf, &tm)
+	if err != nil {
+		return nil, err
+	}
+
+	tm.SetCode("")
+	tm.SetAccess("")
+	tm.SetRefresh("")
+
+	return jsoniter.Marshal(&tm)
+}
+
+// hashLegacyTokens replaces the plain values of the rows stored before the hashing was introduced
+func (s *TokenStore) hashLegacyTokens() error {
+	const batchSize = 100
+
+	for {
+		rows, err := s.adapter.Query(
+			"SELECT id, code, access, refresh, data FROM tokens WHERE NOT hashed LIMIT $1",
+			batchSize,
+		)
+		if err != nil {
+			return err
+		}
+
+		var items []TokenStoreItem
+		for rows.Next() {
+			var item TokenStoreItem
+			err = rows.Scan(&item.ID, &item.Code, &item.Access, &item.Refresh, &item.Data)
+			if err != nil {
+				Close(rows)
+				return err
+			}
+			items = append(items, item)
+		}
+		err = rows.Err()
+		Close(rows)
+		if err != nil {
+			return err
+		}
+
+		if len(items) == 0 {
+			return nil
+		}
+
+		for _, item := range items {
+			var tm models.Token
+			err = jsoniter.Unmarshal(item.Data, &tm)
+			if err != nil {
+				return err
+			}
+
+			data, err := tokenData(&tm)
+			if err != nil {
+				return err
+			}
+
+			_, err = s.adapter.Exec(
+				"UPDATE tokens SET code = $1, access = $2, refresh = $3, data = $4, hashed = true WHERE id = $5 AND NOT hashed",
+				s.hashNonEmpty(item.Code), s.hashNonEmpty(item.Access), s.hashNonEmpty(item.Refresh), data, item.ID,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
 }
 
 // Close close the store
@@ -79,7 +189,7 @@ func (s *TokenStore) clean() {
 
 // Create creates and stores the new token information
 func (s *TokenStore) Create(info oauth2server.TokenInfo) error {
-	buf, err := jsoniter.Marshal(info)
+	buf, err := tokenData(info)
 	if err != nil {
 		return err
 	}
@@ -87,48 +197,77 @@ func (s *TokenStore) Create(info oauth2server.TokenInfo) error {
 	item := &TokenStoreItem{
 		Data:      buf,
 		CreatedAt: time.Now(),
+		Family:    info.GetFamily(),
+		UserID:    info.GetUserID(),
+		ClientID:  info.GetClientID(),
+		IP:        info.GetIP(),
+		UserAgent: info.GetUserAgent(),
 	}
 
 	if code := info.GetCode(); code != "" {
-		item.Code = code
+		item.Code = s.hash(code)
 		item.ExpiresAt = info.GetCodeCreateAt().Add(info.GetCodeExpiresIn())
 	} else {
-		item.Access = info.GetAccess()
+		item.Access = s.hashNonEmpty(info.GetAccess())
 		item.ExpiresAt = info.GetAccessCreateAt().Add(info.GetAccessExpiresIn())
 
 		if refresh := info.GetRefresh(); refresh != "" {
-			item.Refresh = info.GetRefresh()
+			item.Refresh = s.hash(refresh)
 			item.ExpiresAt = info.GetRefreshCreateAt().Add(info.GetRefreshExpiresIn())
 		}
 	}
 
 	rows, err := s.adapter.Query(
-		"INSERT INTO tokens (created_at, expires_at, code, access, refresh, data) VALUES ($1, $2, $3, $4, $5, $6)",
+		`INSERT INTO tokens (created_at, expires_at, code, access, refresh, data, family, hashed, user_id, client_id, ip, user_agent)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, true, $8, $9, $10, $11)`,
 		item.CreatedAt,
 		item.ExpiresAt,
 		item.Code,
 		item.Access,
 		item.Refresh,
 		item.Data,
+		item.Family,
+		item.UserID,
+		item.ClientID,
+		item.IP,
+		item.UserAgent,
 	)
 	defer Close(rows)
 
 	return err
 }
 
-// RemoveByCode deletes the authorization code
+// RemoveByCode deletes the authorization code.
+// Fails when the code is already gone, so concurrent exchanges of the same code can't both succeed
 func (s *TokenStore) RemoveByCode(code string) error {
-	rows, err := s.adapter.Query("DELETE FROM tokens WHERE code = $1", code)
-	defer Close(rows)
-	if err == sql.ErrNoRows {
-		return nil
+	if code == "" {
+		return errors.ErrInvalidAuthorizeCode
 	}
-	return err
+
+	res, err := s.adapter.Exec("DELETE FROM tokens WHERE code = $1", s.hash(code))
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected <= 0 {
+		return errors.ErrInvalidAuthorizeCode
+	}
+
+	return nil
 }
 
 // RemoveByAccess uses the access token to delete the token information
 func (s *TokenStore) RemoveByAccess(access string) error {
-	rows, err := s.adapter.Query("DELETE FROM tokens WHERE access = $1", access)
+	if access == "" {
+		return nil
+	}
+
+	rows, err := s.adapter.Query("DELETE FROM tokens WHERE access = $1", s.hash(access))
 	defer Close(rows)
 	if err == sql.ErrNoRows {
 		return nil
@@ -138,7 +277,11 @@ func (s *TokenStore) RemoveByAccess(access string) error {
 
 // RemoveByRefresh uses the refresh token to delete the token information
 func (s *TokenStore) RemoveByRefresh(refresh string) error {
-	rows, err := s.adapter.Query("DELETE FROM tokens WHERE refresh = $1", refresh)
+	if refresh == "" {
+		return nil
+	}
+
+	rows, err := s.adapter.Query("DELETE FROM tokens WHERE refresh = $1", s.hash(refresh))
 	defer Close(rows)
 	if err == sql.ErrNoRows {
 		return nil
@@ -146,22 +289,37 @@ func (s *TokenStore) RemoveByRefresh(refresh string) error {
 	return err
 }
 
-func (s *TokenStore) toTokenInfo(data []byte) (oauth2server.TokenInfo, error) {
+func (s *TokenStore) toTokenInfo(item *TokenStoreItem) (*models.Token, error) {
 	var tm models.Token
-	err := jsoniter.Unmarshal(data, &tm)
-	return &tm, err
+	err := jsoniter.Unmarshal(item.Data, &tm)
+	if err != nil {
+		return nil, err
+	}
+	if item.RotatedAt != nil {
+		tm.SetRefreshRotatedAt(*item.RotatedAt)
+	}
+	if item.Family != "" {
+		// legacy tokens got the family in the migration
+		tm.SetFamily(item.Family)
+	}
+	return &tm, nil
 }
 
-// GetByCode uses the authorization code for token information data
-func (s *TokenStore) GetByCode(code string) (oauth2server.TokenInfo, error) {
-	if code == "" {
+func (s *TokenStore) getBy(column string, value string) (*models.Token, error) {
+	if value == "" {
 		return nil, nil
 	}
 
-	row := s.adapter.QueryRow("SELECT id, created_at, expires_at, code, access, refresh, data FROM tokens WHERE code = $1", code)
+	row := s.adapter.QueryRow(
+		"SELECT id, created_at, expires_at, code, access, refresh, data, family, rotated_at FROM tokens WHERE "+column+" = $1",
+		s.hash(value),
+	)
 
 	var item TokenStoreItem
-	err := row.Scan(&item.ID, &item.CreatedAt, &item.ExpiresAt, &item.Code, &item.Access, &item.Refresh, &item.Data)
+	err := row.Scan(
+		&item.ID, &item.CreatedAt, &item.ExpiresAt, &item.Code, &item.Access, &item.Refresh, &item.Data,
+		&item.Family, &item.RotatedAt,
+	)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -169,45 +327,132 @@ func (s *TokenStore) GetByCode(code string) (oauth2server.TokenInfo, error) {
 		return nil, err
 	}
 
-	return s.toTokenInfo(item.Data)
+	return s.toTokenInfo(&item)
+}
+
+// GetByCode uses the authorization code for token information data
+func (s *TokenStore) GetByCode(code string) (oauth2server.TokenInfo, error) {
+	tm, err := s.getBy("code", code)
+	if err != nil || tm == nil {
+		return nil, err
+	}
+	tm.SetCode(code)
+	return tm, nil
 }
 
-// GetByAccess uses the access token for token information data
+// GetByAccess uses the access token for token information data.
+// Refresh token value is not restored
 func (s *TokenStore) GetByAccess(access string) (oauth2server.TokenInfo, error) {
-	if access == "" {
-		return nil, nil
+	tm, err := s.getBy("access", access)
+	if err != nil || tm == nil {
+		return nil, err
 	}
+	tm.SetAccess(access)
+	return tm, nil
+}
 
-	row := s.adapter.QueryRow("SELECT id, created_at, expires_at, code, access, refresh, data FROM tokens WHERE access = $1", access)
+// GetByRefresh uses the refresh token for token information data, including the rotated out one.
+// Access token value is not restored
+func (s *TokenStore) GetByRefresh(refresh string) (oauth2server.TokenInfo, error) {
+	tm, err := s.getBy("refresh", refresh)
+	if err != nil || tm == nil {
+		return nil, err
+	}
+	tm.SetRefresh(refresh)
+	return tm, nil
+}
 
-	var item TokenStoreItem
-	err := row.Scan(&item.ID, &item.CreatedAt, &item.ExpiresAt, &item.Code, &item.Access, &item.Refresh, &item.Data)
-	if err == sql.ErrNoRows {
-		return nil, nil
+// RotateRefresh marks the refresh token as rotated out and drops its access token
+func (s *TokenStore) RotateRefresh(refresh string, rotatedAt time.Time) (bool, error) {
+	res, err := s.adapter.Exec(
+		"UPDATE tokens SET rotated_at = $1, access = '' WHERE refresh = $2 AND rotated_at IS NULL",
+		rotatedAt, s.hash(refresh),
+	)
+	if err != nil {
+		return false, err
 	}
+
+	affected, err := res.RowsAffected()
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
-	return s.toTokenInfo(item.Data)
+	return affected > 0, nil
 }
 
-// GetByRefresh uses the refresh token for token information data
-func (s *TokenStore) GetByRefresh(refresh string) (oauth2server.TokenInfo, error) {
-	if refresh == "" {
-		return nil, nil
+// RemoveFamily deletes all the tokens of the refresh token family
+func (s *TokenStore) RemoveFamily(family string) error {
+	if family == "" {
+		return nil
 	}
+	_, err := s.adapter.Exec("DELETE FROM tokens WHERE family = $1", family)
+	return err
+}
 
-	row := s.adapter.QueryRow("SELECT id, created_at, expires_at, code, access, refresh, data FROM tokens WHERE refresh = $1", refresh)
+// GetSessionsByUser lists the active sessions of the user, the most recently used first.
+// Session is represented by the not rotated out token of the family
+func (s *TokenStore) GetSessionsByUser(userID int64) ([]oauth2server.Session, error) {
+	rows, err := s.adapter.Query(`
+		SELECT t.family, t.client_id, t.ip, t.user_agent, t.created_at, t.expires_at,
+			(SELECT MIN(f.created_at) FROM tokens f WHERE f.family = t.family)
+		FROM tokens t
+		WHERE t.user_id = $1 AND t.family <> '' AND t.code = '' AND t.rotated_at IS NULL AND t.expires_at > $2
+		ORDER BY t.created_at DESC
+	`, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer Close(rows)
 
-	var item TokenStoreItem
-	err := row.Scan(&item.ID, &item.CreatedAt, &item.ExpiresAt, &item.Code, &item.Access, &item.Refresh, &item.Data)
-	if err == sql.ErrNoRows {
-		return nil, nil
+	sessions := make([]oauth2server.Session, 0)
+	for rows.Next() {
+		var session oauth2server.Session
+		err = rows.Scan(
+			&session.ID, &session.ClientID, &session.IP, &session.UserAgent, &session.LastUsedAt, &session.ExpiresAt,
+			&session.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
 	}
+
+	return sessions, rows.Err()
+}
+
+// IsSessionActive checks that the session of the user has the valid token
+func (s *TokenStore) IsSessionActive(userID int64, id string) (bool, error) {
+	var active bool
+	err := s.adapter.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM tokens
+			WHERE user_id = $1 AND family = $2 AND code = '' AND rotated_at IS NULL AND expires_at > $3
+		)
+	`, userID, id, time.Now()).Scan(&active)
+	return active, err
+}
+
+// RemoveUserSession deletes all the tokens of the user session
+func (s *TokenStore) RemoveUserSession(userID int64, id string) (bool, error) {
+	if id == "" {
+		return false, nil
+	}
+
+	res, err := s.adapter.Exec("DELETE FROM tokens WHERE user_id = $1 AND family = $2", userID, id)
 	if err != nil {
-		return nil, err
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
 	}
 
-	return s.toTokenInfo(item.Data)
+	return affected > 0, nil
+}
+
+// RemoveByUser deletes all the tokens issued to the user
+func (s *TokenStore) RemoveByUser(userID int64) error {
+	_, err := s.adapter.Exec("DELETE FROM tokens WHERE user_id = $1", userID)
+	return err
 }
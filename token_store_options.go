@@ -28,3 +28,10 @@ func WithTokenStoreGCDisabled() TokenStoreOption {
 		s.gcDisabled = true
 	}
 }
+
+// WithTokenStoreHashKey returns option that sets the HMAC key of the stored token values
+func WithTokenStoreHashKey(key []byte) TokenStoreOption {
+	return func(s *TokenStore) {
+		s.hashKey = key
+	}
+}
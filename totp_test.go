@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// https://tools.ietf.org/html/rfc6238#appendix-B, SHA1, the last 6 of the 8 digits
+var totpTestSecret = []byte("12345678901234567890")
+
+func TestValidateTOTP(t *testing.T) {
+	cases := []struct {
+		time    int64
+		otp     string
+		counter int64
+	}{
+		{59, "287082", 1},
+		{1111111109, "081804", 37037036},
+		{1111111111, "050471", 37037037},
+		{1234567890, "005924", 41152263},
+		{2000000000, "279037", 66666666},
+		{20000000000, "353130", 666666666},
+	}
+
+	for _, tc := range cases {
+		counter, ok := validateTOTP(totpTestSecret, tc.otp, time.Unix(tc.time, 0))
+		if !ok {
+			t.Errorf("%d: code %s rejected", tc.time, tc.otp)
+			continue
+		}
+		if counter != tc.counter {
+			t.Errorf("%d: expected counter %d, got %d", tc.time, tc.counter, counter)
+		}
+	}
+}
+
+func TestValidateTOTPWindow(t *testing.T) {
+	cases := []struct {
+		name  string
+		time  int64
+		otp   string
+		valid bool
+	}{
+		{"previous period", 89, "287082", true},
+		{"next period", 29, "287082", true},
+		{"expired", 90, "287082", false},
+		{"spaces", 59, " 287082 ", true},
+		{"8 digits", 59, "94287082", false},
+		{"wrong", 59, "287083", false},
+		{"empty", 59, "", false},
+	}
+
+	for _, tc := range cases {
+		_, ok := validateTOTP(totpTestSecret, tc.otp, time.Unix(tc.time, 0))
+		if ok != tc.valid {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.valid, ok)
+		}
+	}
+}
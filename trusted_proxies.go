@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies the reverse proxies whose X-Forwarded-For is trusted
+type TrustedProxies struct {
+	networks []*net.IPNet
+}
+
+// NewTrustedProxies constructor, the proxies are IP addresses or CIDR networks
+func NewTrustedProxies(proxies []string) (*TrustedProxies, error) {
+	networks := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid trusted proxy `%s`", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy `%s`: %v", proxy, err)
+		}
+		networks = append(networks, network)
+	}
+
+	return &TrustedProxies{networks: networks}, nil
+}
+
+func (p *TrustedProxies) trusted(ip net.IP) bool {
+	for _, network := range p.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP the address of the client. X-Forwarded-For is read from the right while the hops are trusted,
+// so the address prepended by the client itself is never taken
+func (p *TrustedProxies) ClientIP(r *http.Request) string {
+	remoteAddr, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	if err != nil {
+		remoteAddr = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(remoteAddr)
+	if ip == nil || !p.trusted(ip) {
+		return remoteAddr
+	}
+
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !p.trusted(ip) {
+			break
+		}
+	}
+
+	return ip.String()
+}
@@ -3,6 +3,7 @@ package auth
 import (
 	"database/sql"
 	"fmt"
+	"log"
 	"strings"
 )
 
@@ -10,13 +11,16 @@ import (
 type UserStoreConfig struct {
 	Driver string `yaml:"driver"`
 	DSN    string `yaml:"dsn"`
-	Salt   string `yaml:"salt"`
+	// Salt of the legacy MD5 hashes
+	Salt           string               `yaml:"salt"            mapstructure:"salt"`
+	PasswordHasher PasswordHasherConfig `yaml:"password_hasher" mapstructure:"password_hasher"`
 }
 
 // UserStore UserStore
 type UserStore struct {
-	config UserStoreConfig
-	db     *sql.DB
+	config    UserStoreConfig
+	db        *sql.DB
+	passwords *Passwords
 }
 
 // User User
@@ -28,11 +32,54 @@ type User struct {
 }
 
 // NewUserStore constructor
-func NewUserStore(db *sql.DB, config UserStoreConfig) *UserStore {
-	return &UserStore{
-		config: config,
-		db:     db,
+func NewUserStore(db *sql.DB, config UserStoreConfig) (*UserStore, error) {
+	passwords, err := NewPasswords(config.PasswordHasher, config.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &UserStore{
+		config:    config,
+		db:        db,
+		passwords: passwords,
 	}
+
+	if config.Driver == "mysql" {
+		err = s.checkPasswordWidth()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// passwordMinWidth fits the argon2id hash with the default params, the legacy MD5 column is too narrow
+const passwordMinWidth = 100
+
+// checkPasswordWidth fails when users.password truncates the upgraded hashes
+func (s *UserStore) checkPasswordWidth() error {
+	var width sql.NullInt64
+	err := s.db.QueryRow(`
+		SELECT CHARACTER_MAXIMUM_LENGTH
+		FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'users' AND COLUMN_NAME = 'password'
+	`).Scan(&width)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("users.password column not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	if width.Valid && width.Int64 < passwordMinWidth {
+		return fmt.Errorf(
+			"users.password is %d chars, at least %d required: ALTER TABLE users MODIFY password VARCHAR(255)",
+			width.Int64, passwordMinWidth,
+		)
+	}
+
+	return nil
 }
 
 // GetUserByCredentials GetUserByCredentials
@@ -47,18 +94,143 @@ func (s *UserStore) GetUserByCredentials(username string, password string) (*Use
 	}
 
 	item := &User{}
+	var hash sql.NullString
 
 	row := s.db.QueryRow(
 		fmt.Sprintf(
 			`
-				SELECT id, login, e_mail, name
+				SELECT id, login, e_mail, name, password
 				FROM users
-				WHERE NOT deleted AND %s = ? AND password = MD5(CONCAT(?, ?))
+				WHERE NOT deleted AND %s = ?
 			`,
 			column,
 		),
-		username, s.config.Salt, password,
+		username,
+	)
+
+	err := row.Scan(&item.ID, &item.Login, &item.EMail, &item.Name, &hash)
+	if err == sql.ErrNoRows || (err == nil && !hash.Valid) {
+		s.passwords.VerifyDummy(password)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ok, rehash := s.passwords.Verify(hash.String, password)
+	if !ok {
+		return nil, nil
+	}
+
+	if rehash {
+		err = s.rehashPassword(item.ID, hash.String, password)
+		if err != nil {
+			// login is not blocked, next one will try again
+			log.Println("Failed to rehash password:", err.Error())
+		}
+	}
+
+	return item, nil
+}
+
+func (s *UserStore) rehashPassword(id int64, oldHash string, password string) error {
+	hash, err := s.passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	// condition on the old hash prevents overwriting of the concurrently changed password
+	_, err = s.db.Exec(`UPDATE users SET password = ? WHERE id = ? AND password = ?`, hash, id, oldHash)
+
+	return err
+}
+
+// GetUserByID GetUserByID
+func (s *UserStore) GetUserByID(id int64) (*User, error) {
+	item := &User{}
+
+	row := s.db.QueryRow(`
+		SELECT id, login, e_mail, name
+		FROM users
+		WHERE NOT deleted AND id = ?
+	`, id)
+
+	err := row.Scan(&item.ID, &item.Login, &item.EMail, &item.Name)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+// IsLoginTaken checks the login among all the users including the deleted ones
+func (s *UserStore) IsLoginTaken(login string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE login = ?)`, login).Scan(&exists)
+	return exists, err
+}
+
+// IsEmailTaken checks the email among the confirmed emails of the other users.
+// Pending emails are not checked, so nobody can hold the address without confirming it
+func (s *UserStore) IsEmailTaken(email string, exceptUserID int64) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(
+		`SELECT EXISTS(SELECT 1 FROM users WHERE e_mail = ? AND id <> ?)`,
+		email, exceptUserID,
+	).Scan(&exists)
+	return exists, err
+}
+
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
+// Create creates the user with the password, login is optional.
+// With the check code the email is stored as the pending one until it is confirmed
+func (s *UserStore) Create(login, email, emailCheckCode, password, name, language, timezone, ip string) (int64, error) {
+	hash, err := s.passwords.Hash(password)
+	if err != nil {
+		return 0, err
+	}
+
+	confirmedEmail, emailToCheck := email, ""
+	if emailCheckCode != "" {
+		confirmedEmail, emailToCheck = "", email
+	}
+
+	res, err := s.db.Exec(`
+		INSERT INTO users (login, e_mail, password, email_to_check, hide_e_mail, email_check_code, name, reg_date, last_online, timezone, last_ip, language)
+		VALUES (?, ?, ?, ?, 1, ?, ?, NOW(), NOW(), ?, INET6_ATON(?), ?)
+	`,
+		nullString(login),
+		nullString(confirmedEmail),
+		hash,
+		nullString(emailToCheck),
+		nullString(emailCheckCode),
+		name,
+		timezone,
+		ip,
+		language,
 	)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.LastInsertId()
+}
+
+// GetUserByEmail finds the user by the confirmed email
+func (s *UserStore) GetUserByEmail(email string) (*User, error) {
+	item := &User{}
+
+	row := s.db.QueryRow(`
+		SELECT id, login, e_mail, name
+		FROM users
+		WHERE NOT deleted AND e_mail = ?
+	`, email)
 
 	err := row.Scan(&item.ID, &item.Login, &item.EMail, &item.Name)
 	if err == sql.ErrNoRows {
@@ -70,3 +242,63 @@ func (s *UserStore) GetUserByCredentials(username string, password string) (*Use
 
 	return item, nil
 }
+
+// GetPasswordHash returns the current hash, empty for the users without the password
+func (s *UserStore) GetPasswordHash(id int64) (string, error) {
+	var hash sql.NullString
+	err := s.db.QueryRow(`SELECT password FROM users WHERE NOT deleted AND id = ?`, id).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return hash.String, err
+}
+
+// SetEmailToCheck stores the pending email with its check code
+func (s *UserStore) SetEmailToCheck(id int64, email string, code string) error {
+	_, err := s.db.Exec(
+		`UPDATE users SET email_to_check = ?, email_check_code = ? WHERE NOT deleted AND id = ?`,
+		email, code, id,
+	)
+	return err
+}
+
+// ConfirmEmail makes the pending email the confirmed one, false when the code or the email is outdated
+func (s *UserStore) ConfirmEmail(id int64, email string, code string) (bool, error) {
+	res, err := s.db.Exec(`
+		UPDATE users SET e_mail = email_to_check, email_to_check = NULL, email_check_code = NULL
+		WHERE NOT deleted AND id = ? AND email_to_check = ? AND email_check_code = ?
+	`, id, email, code)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+// ResetPassword sets the new password, false when the password was changed since the old hash was read
+func (s *UserStore) ResetPassword(id int64, oldHash string, password string) (bool, error) {
+	hash, err := s.passwords.Hash(password)
+	if err != nil {
+		return false, err
+	}
+
+	res, err := s.db.Exec(
+		`UPDATE users SET password = ? WHERE NOT deleted AND id = ? AND COALESCE(password, '') = ?`,
+		hash, id, oldHash,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
@@ -0,0 +1,313 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/autowp/auth/oauth2server/errors"
+	"github.com/autowp/auth/webauthn"
+	"github.com/getsentry/sentry-go"
+	"github.com/gin-gonic/gin"
+)
+
+// WebAuthnConfig passkey login, the webauthn grant type must be allowed too.
+// RPID is the registrable domain shared by the hosts, Origins are the allowed page origins
+// and ChallengeTTL is the ceremony lifetime in minutes
+type WebAuthnConfig struct {
+	Enabled          bool     `yaml:"enabled"           mapstructure:"enabled"`
+	RPID             string   `yaml:"rp_id"             mapstructure:"rp_id"`
+	RPName           string   `yaml:"rp_name"           mapstructure:"rp_name"`
+	Origins          []string `yaml:"origins"           mapstructure:"origins"`
+	UserVerification bool     `yaml:"user_verification" mapstructure:"user_verification"`
+	ChallengeTTL     uint     `yaml:"challenge_ttl"     mapstructure:"challenge_ttl"`
+}
+
+// WebAuthnCredentialResponse registered passkey
+type WebAuthnCredentialResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+type webAuthnRegistrationRequest struct {
+	ChallengeID string                       `json:"challenge_id" binding:"required"`
+	Name        string                       `json:"name"`
+	Credential  webauthn.AttestationResponse `json:"credential"`
+}
+
+func webAuthnUserHandle(userID int64) []byte {
+	return []byte(strconv.FormatInt(userID, 10))
+}
+
+func webAuthnCredentialResponse(credential *WebAuthnCredential) WebAuthnCredentialResponse {
+	return WebAuthnCredentialResponse{
+		ID:         base64.RawURLEncoding.EncodeToString(credential.ID),
+		Name:       credential.Name,
+		CreatedAt:  credential.CreatedAt,
+		LastUsedAt: credential.LastUsedAt,
+	}
+}
+
+func (s *Service) webAuthnInternalError(c *gin.Context, err error) {
+	log.Println("WebAuthn failed:", err.Error())
+	sentry.CaptureException(err)
+	c.Status(http.StatusInternalServerError)
+}
+
+// newWebAuthnChallenge stores the challenge of the ceremony and returns its id
+func (s *Service) newWebAuthnChallenge(purpose string, userID int64) (string, []byte, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", nil, err
+	}
+
+	id, err := randomBase64String(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = s.webAuthnStore.PutChallenge(id, purpose, userID, challenge)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return id, challenge, nil
+}
+
+func (s *Service) handleWebAuthnRegisterBegin(c *gin.Context) {
+	ti := s.userToken(c)
+	if ti == nil {
+		return
+	}
+
+	user, err := s.userStore.GetUserByID(ti.GetUserID())
+	if err != nil {
+		s.webAuthnInternalError(c, err)
+		return
+	}
+	if user == nil {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	credentials, err := s.webAuthnStore.GetByUser(user.ID)
+	if err != nil {
+		s.webAuthnInternalError(c, err)
+		return
+	}
+
+	exclude := make([][]byte, len(credentials))
+	for i, credential := range credentials {
+		exclude[i] = credential.ID
+	}
+
+	id, challenge, err := s.newWebAuthnChallenge(webAuthnRegistration, user.ID)
+	if err != nil {
+		s.webAuthnInternalError(c, err)
+		return
+	}
+
+	name := strconv.FormatInt(user.ID, 10)
+	if user.Login != nil && *user.Login != "" {
+		name = *user.Login
+	} else if user.EMail != nil && *user.EMail != "" {
+		name = *user.EMail
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"challenge_id": id,
+		"public_key": s.webAuthn.CreationOptions(challenge, webauthn.User{
+			ID:          webAuthnUserHandle(user.ID),
+			Name:        name,
+			DisplayName: user.Name,
+		}, exclude),
+	})
+}
+
+func (s *Service) handleWebAuthnRegisterFinish(c *gin.Context) {
+	ti := s.userToken(c)
+	if ti == nil {
+		return
+	}
+
+	var request webAuthnRegistrationRequest
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	challenge, err := s.webAuthnStore.ConsumeChallenge(request.ChallengeID, webAuthnRegistration, ti.GetUserID())
+	if err != nil {
+		s.webAuthnInternalError(c, err)
+		return
+	}
+	if challenge == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_challenge"})
+		return
+	}
+
+	verified, err := s.webAuthn.VerifyRegistration(challenge, &request.Credential)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             "invalid_credential",
+			"error_description": err.Error(),
+		})
+		return
+	}
+
+	credential := &WebAuthnCredential{
+		Credential: *verified,
+		UserID:     ti.GetUserID(),
+		Name:       strings.TrimSpace(request.Name),
+	}
+
+	existing, err := s.webAuthnStore.GetByID(credential.ID)
+	if err != nil {
+		s.webAuthnInternalError(c, err)
+		return
+	}
+	if existing != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "credential_exists"})
+		return
+	}
+
+	err = s.webAuthnStore.Create(credential)
+	if err != nil {
+		s.webAuthnInternalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, webAuthnCredentialResponse(credential))
+}
+
+func (s *Service) handleWebAuthnCredentials(c *gin.Context) {
+	ti := s.userToken(c)
+	if ti == nil {
+		return
+	}
+
+	credentials, err := s.webAuthnStore.GetByUser(ti.GetUserID())
+	if err != nil {
+		s.webAuthnInternalError(c, err)
+		return
+	}
+
+	items := make([]WebAuthnCredentialResponse, len(credentials))
+	for i, credential := range credentials {
+		items[i] = webAuthnCredentialResponse(credential)
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"items": items,
+	})
+}
+
+func (s *Service) handleWebAuthnCredentialDelete(c *gin.Context) {
+	ti := s.userToken(c)
+	if ti == nil {
+		return
+	}
+
+	id, err := base64.RawURLEncoding.DecodeString(c.Param("id"))
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	found, err := s.webAuthnStore.Delete(ti.GetUserID(), id)
+	if err != nil {
+		s.webAuthnInternalError(c, err)
+		return
+	}
+
+	if !found {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// handleWebAuthnLoginBegin issues the challenge for the discoverable credential,
+// the assertion is exchanged at the token endpoint with the webauthn grant
+func (s *Service) handleWebAuthnLoginBegin(c *gin.Context) {
+	id, challenge, err := s.newWebAuthnChallenge(webAuthnLogin, 0)
+	if err != nil {
+		s.webAuthnInternalError(c, err)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"challenge_id": id,
+		"public_key":   s.webAuthn.RequestOptions(challenge, nil),
+	})
+}
+
+// webAuthnLogin verifies the assertion of the webauthn grant, zero user means invalid grant
+func (s *Service) webAuthnLogin(challengeID, credentialJSON, remoteAddr string) (int64, error) {
+	var assertion webauthn.AssertionResponse
+	err := json.Unmarshal([]byte(credentialJSON), &assertion)
+	if err != nil {
+		return 0, errors.ErrInvalidRequest
+	}
+
+	// the challenge is consumed before any other check, so every attempt burns it
+	challenge, err := s.webAuthnStore.ConsumeChallenge(challengeID, webAuthnLogin, 0)
+	if err != nil || challenge == nil {
+		return 0, err
+	}
+
+	credential, err := s.webAuthnStore.GetByID(assertion.RawID)
+	if err != nil || credential == nil {
+		return 0, err
+	}
+
+	if len(assertion.Response.UserHandle) > 0 &&
+		string(assertion.Response.UserHandle) != string(webAuthnUserHandle(credential.UserID)) {
+		return 0, nil
+	}
+
+	signCount, err := s.webAuthn.VerifyAssertion(challenge, &credential.Credential, &assertion)
+	if err == webauthn.ErrSignCount {
+		log.Printf("WebAuthn credential of the user %d may be cloned, login from %s rejected", credential.UserID, remoteAddr)
+		sentry.CaptureException(err)
+		return 0, nil
+	}
+	if err != nil {
+		return 0, nil
+	}
+
+	updated, err := s.webAuthnStore.UpdateSignCount(credential, signCount)
+	if err != nil || !updated {
+		return 0, err
+	}
+
+	user, err := s.userStore.GetUserByID(credential.UserID)
+	if err != nil || user == nil {
+		return 0, err
+	}
+
+	return user.ID, nil
+}
+
+func (s *Service) setupWebAuthnRoutes(apiGroup *gin.RouterGroup) {
+	if s.webAuthn == nil {
+		return
+	}
+
+	apiGroup.POST("/webauthn/register/begin", s.handleWebAuthnRegisterBegin)
+	apiGroup.POST("/webauthn/register/finish", s.handleWebAuthnRegisterFinish)
+	apiGroup.GET("/webauthn/credentials", s.handleWebAuthnCredentials)
+	apiGroup.DELETE("/webauthn/credentials/:id", s.handleWebAuthnCredentialDelete)
+	apiGroup.POST("/webauthn/login/begin", s.handleWebAuthnLoginBegin)
+}
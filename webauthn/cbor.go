@@ -0,0 +1,169 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// nesting limit of the decoded items, attestation objects and COSE keys are shallow
+const maxCBORDepth = 16
+
+var errCBORTruncated = errors.New("webauthn: truncated cbor")
+
+// decodeCBOR decodes the first CBOR item of the data and returns the rest.
+// Only the subset used by WebAuthn is supported: integers, strings, arrays, maps and simple values.
+// Integers are decoded to int64, maps to map[interface{}]interface{} with int64 or string keys
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func cborHead(data []byte) (byte, byte, uint64, []byte, error) {
+	if len(data) == 0 {
+		return 0, 0, 0, nil, errCBORTruncated
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	var size int
+	switch {
+	case info < 24:
+		return major, info, uint64(info), data, nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, 0, nil, fmt.Errorf("webauthn: unsupported cbor additional info %d", info)
+	}
+
+	if len(data) < size {
+		return 0, 0, 0, nil, errCBORTruncated
+	}
+
+	var arg uint64
+	switch size {
+	case 1:
+		arg = uint64(data[0])
+	case 2:
+		arg = uint64(binary.BigEndian.Uint16(data))
+	case 4:
+		arg = uint64(binary.BigEndian.Uint32(data))
+	case 8:
+		arg = binary.BigEndian.Uint64(data)
+	}
+
+	return major, info, arg, data[size:], nil
+}
+
+func decodeCBORItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, errors.New("webauthn: cbor nesting is too deep")
+	}
+
+	major, info, arg, rest, err := cborHead(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0: // unsigned integer
+		if arg > math.MaxInt64 {
+			return nil, nil, errors.New("webauthn: cbor integer overflow")
+		}
+		return int64(arg), rest, nil
+	case 1: // negative integer
+		if arg > math.MaxInt64 {
+			return nil, nil, errors.New("webauthn: cbor integer overflow")
+		}
+		return -1 - int64(arg), rest, nil
+	case 2, 3: // byte and text strings
+		if arg > uint64(len(rest)) {
+			return nil, nil, errCBORTruncated
+		}
+		value := rest[:arg]
+		if major == 3 {
+			return string(value), rest[arg:], nil
+		}
+		return value, rest[arg:], nil
+	case 4: // array
+		if arg > uint64(len(rest)) {
+			return nil, nil, errCBORTruncated
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item interface{}
+			item, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, rest, nil
+	case 5: // map
+		if arg > uint64(len(rest)) {
+			return nil, nil, errCBORTruncated
+		}
+		items := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value interface{}
+			key, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.New("webauthn: unsupported cbor map key")
+			}
+			if _, ok := items[key]; ok {
+				return nil, nil, errors.New("webauthn: duplicate cbor map key")
+			}
+			value, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items[key] = value
+		}
+		return items, rest, nil
+	case 6: // tag, the tagged item is returned as is
+		return decodeCBORItem(rest, depth+1)
+	}
+
+	// simple values
+	switch info {
+	case 20:
+		return false, rest, nil
+	case 21:
+		return true, rest, nil
+	case 22, 23:
+		return nil, rest, nil
+	}
+
+	return nil, nil, fmt.Errorf("webauthn: unsupported cbor simple value %d", info)
+}
+
+// unmarshalCBORMap decodes the data which must be the single CBOR map
+func unmarshalCBORMap(data []byte) (map[interface{}]interface{}, error) {
+	value, rest, err := decodeCBOR(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("webauthn: unexpected data after cbor item")
+	}
+
+	m, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("webauthn: cbor map expected")
+	}
+
+	return m, nil
+}
@@ -0,0 +1,159 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithms, https://www.iana.org/assignments/cose/cose.xhtml#algorithms
+const (
+	AlgES256 int64 = -7
+	AlgEdDSA int64 = -8
+	AlgRS256 int64 = -257
+)
+
+// COSE key parameters
+const (
+	coseKeyType   int64 = 1
+	coseAlgorithm int64 = 3
+	coseCurve     int64 = -1
+	coseX         int64 = -2
+	coseY         int64 = -3
+	coseRSAN      int64 = -1
+	coseRSAE      int64 = -2
+
+	coseKeyTypeOKP int64 = 1
+	coseKeyTypeEC2 int64 = 2
+	coseKeyTypeRSA int64 = 3
+
+	coseCurveP256    int64 = 1
+	coseCurveEd25519 int64 = 6
+)
+
+// SupportedAlgorithms in the order of preference
+var SupportedAlgorithms = []int64{AlgES256, AlgEdDSA, AlgRS256}
+
+// PublicKey credential public key decoded from COSE_Key
+type PublicKey struct {
+	Algorithm int64
+	Key       crypto.PublicKey
+}
+
+func coseInt(m map[interface{}]interface{}, key int64) (int64, bool) {
+	v, ok := m[key].(int64)
+	return v, ok
+}
+
+func coseBytes(m map[interface{}]interface{}, key int64) ([]byte, bool) {
+	v, ok := m[key].([]byte)
+	return v, ok
+}
+
+// ParsePublicKey decodes COSE_Key of ES256, EdDSA or RS256 algorithms
+func ParsePublicKey(data []byte) (*PublicKey, error) {
+	m, err := unmarshalCBORMap(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseCOSEKey(m)
+}
+
+func parseCOSEKey(m map[interface{}]interface{}) (*PublicKey, error) {
+	kty, ok := coseInt(m, coseKeyType)
+	if !ok {
+		return nil, errors.New("webauthn: cose key type is missing")
+	}
+
+	alg, ok := coseInt(m, coseAlgorithm)
+	if !ok {
+		return nil, errors.New("webauthn: cose key algorithm is missing")
+	}
+
+	switch alg {
+	case AlgES256:
+		crv, _ := coseInt(m, coseCurve)
+		x, okX := coseBytes(m, coseX)
+		y, okY := coseBytes(m, coseY)
+		if kty != coseKeyTypeEC2 || crv != coseCurveP256 || !okX || !okY || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("webauthn: invalid ES256 cose key")
+		}
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("webauthn: ES256 point is not on the curve")
+		}
+		return &PublicKey{Algorithm: alg, Key: key}, nil
+
+	case AlgEdDSA:
+		crv, _ := coseInt(m, coseCurve)
+		x, okX := coseBytes(m, coseX)
+		if kty != coseKeyTypeOKP || crv != coseCurveEd25519 || !okX || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("webauthn: invalid EdDSA cose key")
+		}
+		return &PublicKey{Algorithm: alg, Key: ed25519.PublicKey(x)}, nil
+
+	case AlgRS256:
+		n, okN := coseBytes(m, coseRSAN)
+		e, okE := coseBytes(m, coseRSAE)
+		if kty != coseKeyTypeRSA || !okN || !okE || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("webauthn: invalid RS256 cose key")
+		}
+		key := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		if key.N.BitLen() < 2048 {
+			return nil, errors.New("webauthn: RS256 key is too short")
+		}
+		return &PublicKey{Algorithm: alg, Key: key}, nil
+	}
+
+	return nil, fmt.Errorf("webauthn: unsupported cose algorithm %d", alg)
+}
+
+// Verify checks the signature of the data
+func (k *PublicKey) Verify(data, sig []byte) error {
+	switch key := k.Key.(type) {
+	case *ecdsa.PublicKey:
+		var esig struct {
+			R, S *big.Int
+		}
+		rest, err := asn1.Unmarshal(sig, &esig)
+		if err != nil || len(rest) > 0 {
+			return errors.New("webauthn: malformed ES256 signature")
+		}
+		digest := sha256.Sum256(data)
+		if !ecdsa.Verify(key, digest[:], esig.R, esig.S) {
+			return errors.New("webauthn: invalid signature")
+		}
+		return nil
+
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, data, sig) {
+			return errors.New("webauthn: invalid signature")
+		}
+		return nil
+
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(data)
+		err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig)
+		if err != nil {
+			return errors.New("webauthn: invalid signature")
+		}
+		return nil
+	}
+
+	return errors.New("webauthn: unsupported public key")
+}
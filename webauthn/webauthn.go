@@ -0,0 +1,519 @@
+// Package webauthn implements the relying party side of the WebAuthn registration and assertion ceremonies,
+// https://www.w3.org/TR/webauthn-2/
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// client data types
+const (
+	ceremonyCreate = "webauthn.create"
+	ceremonyGet    = "webauthn.get"
+)
+
+// authenticator data flags
+const (
+	flagUserPresent      byte = 0x01
+	flagUserVerified     byte = 0x04
+	flagAttestedCredData byte = 0x40
+	flagExtensionData    byte = 0x80
+)
+
+// ChallengeSize bytes of the random challenge
+const ChallengeSize = 32
+
+// ErrSignCount the signature counter did not increase, the authenticator may be cloned
+var ErrSignCount = errors.New("webauthn: signature counter did not increase")
+
+// Base64URL bytes encoded as unpadded base64url in JSON
+type Base64URL []byte
+
+// MarshalJSON MarshalJSON
+func (b Base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+// UnmarshalJSON accepts both padded and unpadded values
+func (b *Base64URL) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+
+	value, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+
+	*b = value
+	return nil
+}
+
+// Config relying party
+type Config struct {
+	// RPID the effective domain of the relying party, e.g. wheelsage.org
+	RPID   string
+	RPName string
+	// Origins allowed in the client data, e.g. https://en.wheelsage.org
+	Origins []string
+	// RequireUserVerification requires the authenticator to verify the user by PIN or biometrics
+	RequireUserVerification bool
+	Timeout                 time.Duration
+}
+
+// WebAuthn relying party
+type WebAuthn struct {
+	config   Config
+	rpIDHash [32]byte
+}
+
+// New constructor
+func New(config Config) (*WebAuthn, error) {
+	if config.RPID == "" {
+		return nil, errors.New("webauthn: rp id is required")
+	}
+	if len(config.Origins) == 0 {
+		return nil, errors.New("webauthn: at least one origin is required")
+	}
+	if config.RPName == "" {
+		config.RPName = config.RPID
+	}
+
+	return &WebAuthn{
+		config:   config,
+		rpIDHash: sha256.Sum256([]byte(config.RPID)),
+	}, nil
+}
+
+// NewChallenge generates the random challenge of the ceremony
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, ChallengeSize)
+	_, err := rand.Read(challenge)
+	if err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// User the account the credential is created for
+type User struct {
+	ID          []byte
+	Name        string
+	DisplayName string
+}
+
+// RelyingPartyEntity PublicKeyCredentialRpEntity
+type RelyingPartyEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// UserEntity PublicKeyCredentialUserEntity
+type UserEntity struct {
+	ID          Base64URL `json:"id"`
+	Name        string    `json:"name"`
+	DisplayName string    `json:"displayName"`
+}
+
+// CredentialParameters PublicKeyCredentialParameters
+type CredentialParameters struct {
+	Type      string `json:"type"`
+	Algorithm int64  `json:"alg"`
+}
+
+// CredentialDescriptor PublicKeyCredentialDescriptor
+type CredentialDescriptor struct {
+	Type string    `json:"type"`
+	ID   Base64URL `json:"id"`
+}
+
+// AuthenticatorSelection AuthenticatorSelectionCriteria
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions PublicKeyCredentialCreationOptions for navigator.credentials.create()
+type CreationOptions struct {
+	Challenge              Base64URL              `json:"challenge"`
+	RP                     RelyingPartyEntity     `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	PubKeyCredParams       []CredentialParameters `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout,omitempty"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions PublicKeyCredentialRequestOptions for navigator.credentials.get()
+type RequestOptions struct {
+	Challenge        Base64URL              `json:"challenge"`
+	RPID             string                 `json:"rpId"`
+	Timeout          int64                  `json:"timeout,omitempty"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+func (w *WebAuthn) userVerification() string {
+	if w.config.RequireUserVerification {
+		return "required"
+	}
+	return "preferred"
+}
+
+func credentialDescriptors(ids [][]byte) []CredentialDescriptor {
+	descriptors := make([]CredentialDescriptor, len(ids))
+	for i, id := range ids {
+		descriptors[i] = CredentialDescriptor{Type: "public-key", ID: id}
+	}
+	return descriptors
+}
+
+// CreationOptions options of the registration ceremony, exclude lists the already registered credentials
+func (w *WebAuthn) CreationOptions(challenge []byte, user User, exclude [][]byte) *CreationOptions {
+	params := make([]CredentialParameters, len(SupportedAlgorithms))
+	for i, alg := range SupportedAlgorithms {
+		params[i] = CredentialParameters{Type: "public-key", Algorithm: alg}
+	}
+
+	return &CreationOptions{
+		Challenge: challenge,
+		RP: RelyingPartyEntity{
+			ID:   w.config.RPID,
+			Name: w.config.RPName,
+		},
+		User: UserEntity{
+			ID:          user.ID,
+			Name:        user.Name,
+			DisplayName: user.DisplayName,
+		},
+		PubKeyCredParams:   params,
+		Timeout:            w.config.Timeout.Milliseconds(),
+		ExcludeCredentials: credentialDescriptors(exclude),
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: w.userVerification(),
+		},
+		Attestation: "none",
+	}
+}
+
+// RequestOptions options of the assertion ceremony, empty allow list asks for the discoverable credential
+func (w *WebAuthn) RequestOptions(challenge []byte, allow [][]byte) *RequestOptions {
+	return &RequestOptions{
+		Challenge:        challenge,
+		RPID:             w.config.RPID,
+		Timeout:          w.config.Timeout.Milliseconds(),
+		AllowCredentials: credentialDescriptors(allow),
+		UserVerification: w.userVerification(),
+	}
+}
+
+// AttestationResponse PublicKeyCredential returned by navigator.credentials.create()
+type AttestationResponse struct {
+	ID       string    `json:"id"`
+	RawID    Base64URL `json:"rawId"`
+	Type     string    `json:"type"`
+	Response struct {
+		ClientDataJSON    Base64URL `json:"clientDataJSON"`
+		AttestationObject Base64URL `json:"attestationObject"`
+	} `json:"response"`
+}
+
+// AssertionResponse PublicKeyCredential returned by navigator.credentials.get()
+type AssertionResponse struct {
+	ID       string    `json:"id"`
+	RawID    Base64URL `json:"rawId"`
+	Type     string    `json:"type"`
+	Response struct {
+		ClientDataJSON    Base64URL `json:"clientDataJSON"`
+		AuthenticatorData Base64URL `json:"authenticatorData"`
+		Signature         Base64URL `json:"signature"`
+		UserHandle        Base64URL `json:"userHandle"`
+	} `json:"response"`
+}
+
+// Credential registered public key credential
+type Credential struct {
+	ID []byte
+	// PublicKey COSE_Key
+	PublicKey []byte
+	SignCount uint32
+	AAGUID    []byte
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+func (w *WebAuthn) verifyClientData(data []byte, ceremony string, challenge []byte) error {
+	var cd clientData
+	err := json.Unmarshal(data, &cd)
+	if err != nil {
+		return fmt.Errorf("webauthn: malformed client data: %v", err)
+	}
+
+	if cd.Type != ceremony {
+		return fmt.Errorf("webauthn: unexpected client data type `%s`", cd.Type)
+	}
+
+	received, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(cd.Challenge, "="))
+	if err != nil || subtle.ConstantTimeCompare(received, challenge) != 1 {
+		return errors.New("webauthn: challenge mismatch")
+	}
+
+	for _, origin := range w.config.Origins {
+		if cd.Origin == origin {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("webauthn: unexpected origin `%s`", cd.Origin)
+}
+
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	aaguid       []byte
+	credentialID []byte
+	publicKey    []byte
+}
+
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("webauthn: authenticator data is too short")
+	}
+
+	ad := &authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[37:]
+
+	if ad.flags&flagAttestedCredData != 0 {
+		if len(rest) < 18 {
+			return nil, errors.New("webauthn: attested credential data is too short")
+		}
+		ad.aaguid = rest[:16]
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < idLength {
+			return nil, errors.New("webauthn: credential id is truncated")
+		}
+		ad.credentialID = rest[:idLength]
+		rest = rest[idLength:]
+
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, err
+		}
+		ad.publicKey = rest[:len(rest)-len(after)]
+		rest = after
+	}
+
+	if ad.flags&flagExtensionData != 0 {
+		var err error
+		_, rest, err = decodeCBOR(rest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(rest) > 0 {
+		return nil, errors.New("webauthn: unexpected data after authenticator data")
+	}
+
+	return ad, nil
+}
+
+func (w *WebAuthn) verifyAuthenticatorData(ad *authenticatorData) error {
+	if subtle.ConstantTimeCompare(ad.rpIDHash, w.rpIDHash[:]) != 1 {
+		return errors.New("webauthn: rp id hash mismatch")
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return errors.New("webauthn: user is not present")
+	}
+	if w.config.RequireUserVerification && ad.flags&flagUserVerified == 0 {
+		return errors.New("webauthn: user is not verified")
+	}
+	return nil
+}
+
+// VerifyRegistration verifies the response of the registration ceremony with the issued challenge.
+// Attestation is not evaluated against the trust anchors, "none" and "packed" formats are accepted
+func (w *WebAuthn) VerifyRegistration(challenge []byte, r *AttestationResponse) (*Credential, error) {
+	if r.Type != "public-key" {
+		return nil, errors.New("webauthn: unexpected credential type")
+	}
+
+	err := w.verifyClientData(r.Response.ClientDataJSON, ceremonyCreate, challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	attestation, err := unmarshalCBORMap(r.Response.AttestationObject)
+	if err != nil {
+		return nil, err
+	}
+
+	format, _ := attestation["fmt"].(string)
+	attStmt, _ := attestation["attStmt"].(map[interface{}]interface{})
+	rawAuthData, _ := attestation["authData"].([]byte)
+	if attStmt == nil || rawAuthData == nil {
+		return nil, errors.New("webauthn: malformed attestation object")
+	}
+
+	ad, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.verifyAuthenticatorData(ad)
+	if err != nil {
+		return nil, err
+	}
+
+	if ad.credentialID == nil {
+		return nil, errors.New("webauthn: attested credential data is missing")
+	}
+
+	if len(r.RawID) > 0 && !bytes.Equal(r.RawID, ad.credentialID) {
+		return nil, errors.New("webauthn: credential id mismatch")
+	}
+
+	publicKey, err := ParsePublicKey(ad.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	clientDataHash := sha256.Sum256(r.Response.ClientDataJSON)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+
+	err = verifyAttestationStatement(format, attStmt, publicKey, signed)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		ID:        ad.credentialID,
+		PublicKey: ad.publicKey,
+		SignCount: ad.signCount,
+		AAGUID:    ad.aaguid,
+	}, nil
+}
+
+var x509Algorithms = map[int64]x509.SignatureAlgorithm{
+	AlgES256: x509.ECDSAWithSHA256,
+	AlgEdDSA: x509.PureEd25519,
+	AlgRS256: x509.SHA256WithRSA,
+}
+
+func verifyAttestationStatement(format string, attStmt map[interface{}]interface{}, publicKey *PublicKey, signed []byte) error {
+	switch format {
+	case "none":
+		if len(attStmt) > 0 {
+			return errors.New("webauthn: none attestation statement must be empty")
+		}
+		return nil
+
+	case "packed":
+		alg, _ := attStmt["alg"].(int64)
+		sig, _ := attStmt["sig"].([]byte)
+		if sig == nil {
+			return errors.New("webauthn: packed attestation signature is missing")
+		}
+
+		x5c, ok := attStmt["x5c"].([]interface{})
+		if !ok {
+			// self attestation
+			if alg != publicKey.Algorithm {
+				return errors.New("webauthn: packed attestation algorithm mismatch")
+			}
+			return publicKey.Verify(signed, sig)
+		}
+
+		if len(x5c) == 0 {
+			return errors.New("webauthn: packed attestation certificate is missing")
+		}
+		der, _ := x5c[0].([]byte)
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("webauthn: invalid attestation certificate: %v", err)
+		}
+		sigAlg, ok := x509Algorithms[alg]
+		if !ok {
+			return fmt.Errorf("webauthn: unsupported attestation algorithm %d", alg)
+		}
+		err = cert.CheckSignature(sigAlg, signed, sig)
+		if err != nil {
+			return errors.New("webauthn: invalid attestation signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("webauthn: unsupported attestation format `%s`", format)
+}
+
+// VerifyAssertion verifies the response of the assertion ceremony with the issued challenge
+// against the registered credential and returns the new signature counter
+func (w *WebAuthn) VerifyAssertion(challenge []byte, credential *Credential, r *AssertionResponse) (uint32, error) {
+	if r.Type != "public-key" {
+		return 0, errors.New("webauthn: unexpected credential type")
+	}
+
+	if !bytes.Equal(r.RawID, credential.ID) {
+		return 0, errors.New("webauthn: credential id mismatch")
+	}
+
+	err := w.verifyClientData(r.Response.ClientDataJSON, ceremonyGet, challenge)
+	if err != nil {
+		return 0, err
+	}
+
+	ad, err := parseAuthenticatorData(r.Response.AuthenticatorData)
+	if err != nil {
+		return 0, err
+	}
+
+	err = w.verifyAuthenticatorData(ad)
+	if err != nil {
+		return 0, err
+	}
+
+	publicKey, err := ParsePublicKey(credential.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+
+	clientDataHash := sha256.Sum256(r.Response.ClientDataJSON)
+	signed := append(append([]byte{}, r.Response.AuthenticatorData...), clientDataHash[:]...)
+
+	err = publicKey.Verify(signed, r.Response.Signature)
+	if err != nil {
+		return 0, err
+	}
+
+	// authenticators without the counter always report zero
+	if (ad.signCount != 0 || credential.SignCount != 0) && ad.signCount <= credential.SignCount {
+		return 0, ErrSignCount
+	}
+
+	return ad.signCount, nil
+}
@@ -0,0 +1,432 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+)
+
+const (
+	testRPID   = "example.org"
+	testOrigin = "https://en.example.org"
+)
+
+// cborPair map entry, the slice keeps the order of the encoded keys
+type cborPair struct {
+	key   interface{}
+	value interface{}
+}
+
+type cborMap []cborPair
+
+func cborEncodeHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		b := []byte{major<<5 | 25, 0, 0}
+		binary.BigEndian.PutUint16(b[1:], uint16(n))
+		return b
+	}
+	b := []byte{major<<5 | 26, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], uint32(n))
+	return b
+}
+
+func cborEncode(v interface{}) []byte {
+	switch value := v.(type) {
+	case int64:
+		if value < 0 {
+			return cborEncodeHead(1, uint64(-1-value))
+		}
+		return cborEncodeHead(0, uint64(value))
+	case int:
+		return cborEncode(int64(value))
+	case []byte:
+		return append(cborEncodeHead(2, uint64(len(value))), value...)
+	case string:
+		return append(cborEncodeHead(3, uint64(len(value))), value...)
+	case []interface{}:
+		result := cborEncodeHead(4, uint64(len(value)))
+		for _, item := range value {
+			result = append(result, cborEncode(item)...)
+		}
+		return result
+	case cborMap:
+		result := cborEncodeHead(5, uint64(len(value)))
+		for _, pair := range value {
+			result = append(result, cborEncode(pair.key)...)
+			result = append(result, cborEncode(pair.value)...)
+		}
+		return result
+	}
+	panic("unsupported cbor value")
+}
+
+// testAuthenticator software authenticator with the single credential
+type testAuthenticator struct {
+	alg       int64
+	signer    crypto.Signer
+	coseKey   []byte
+	id        []byte
+	signCount uint32
+}
+
+func newTestAuthenticator(t *testing.T, alg int64) *testAuthenticator {
+	a := &testAuthenticator{alg: alg, id: make([]byte, 16)}
+	_, err := rand.Read(a.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	switch alg {
+	case AlgES256:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		xb, yb := key.X.Bytes(), key.Y.Bytes()
+		copy(x[32-len(xb):], xb)
+		copy(y[32-len(yb):], yb)
+		a.signer = key
+		a.coseKey = cborEncode(cborMap{
+			{coseKeyType, coseKeyTypeEC2},
+			{coseAlgorithm, AlgES256},
+			{coseCurve, coseCurveP256},
+			{coseX, x},
+			{coseY, y},
+		})
+	case AlgEdDSA:
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.signer = private
+		a.coseKey = cborEncode(cborMap{
+			{coseKeyType, coseKeyTypeOKP},
+			{coseAlgorithm, AlgEdDSA},
+			{coseCurve, coseCurveEd25519},
+			{coseX, []byte(public)},
+		})
+	default:
+		t.Fatalf("unsupported algorithm %d", alg)
+	}
+
+	return a
+}
+
+func (a *testAuthenticator) sign(t *testing.T, data []byte) []byte {
+	var (
+		sig []byte
+		err error
+	)
+	if a.alg == AlgES256 {
+		digest := sha256.Sum256(data)
+		sig, err = a.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	} else {
+		sig, err = a.signer.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func (a *testAuthenticator) authData(rpID string, flags byte, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:37], a.signCount)
+
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		data = append(data, byte(len(a.id)>>8), byte(len(a.id)))
+		data = append(data, a.id...)
+		data = append(data, a.coseKey...)
+	}
+
+	return data
+}
+
+func clientDataJSON(t *testing.T, ceremony string, challenge []byte, origin string) []byte {
+	data, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    origin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// ceremony parameters of the authenticator response
+type ceremony struct {
+	challenge []byte
+	origin    string
+	rpID      string
+	flags     byte
+	format    string
+}
+
+func defaultCeremony(challenge []byte) ceremony {
+	return ceremony{
+		challenge: challenge,
+		origin:    testOrigin,
+		rpID:      testRPID,
+		flags:     flagUserPresent | flagUserVerified,
+		format:    "none",
+	}
+}
+
+func (a *testAuthenticator) create(t *testing.T, c ceremony) *AttestationResponse {
+	cdj := clientDataJSON(t, ceremonyCreate, c.challenge, c.origin)
+	authData := a.authData(c.rpID, c.flags|flagAttestedCredData, true)
+
+	attStmt := cborMap{}
+	if c.format == "packed" {
+		clientDataHash := sha256.Sum256(cdj)
+		attStmt = cborMap{
+			{"alg", a.alg},
+			{"sig", a.sign(t, append(append([]byte{}, authData...), clientDataHash[:]...))},
+		}
+	}
+
+	r := &AttestationResponse{RawID: a.id, Type: "public-key"}
+	r.Response.ClientDataJSON = cdj
+	r.Response.AttestationObject = cborEncode(cborMap{
+		{"fmt", c.format},
+		{"attStmt", attStmt},
+		{"authData", authData},
+	})
+	return r
+}
+
+func (a *testAuthenticator) get(t *testing.T, c ceremony) *AssertionResponse {
+	cdj := clientDataJSON(t, ceremonyGet, c.challenge, c.origin)
+	authData := a.authData(c.rpID, c.flags, false)
+	clientDataHash := sha256.Sum256(cdj)
+
+	r := &AssertionResponse{RawID: a.id, Type: "public-key"}
+	r.Response.ClientDataJSON = cdj
+	r.Response.AuthenticatorData = authData
+	r.Response.Signature = a.sign(t, append(append([]byte{}, authData...), clientDataHash[:]...))
+	return r
+}
+
+func newTestWebAuthn(t *testing.T, requireUV bool) *WebAuthn {
+	w, err := New(Config{
+		RPID:                    testRPID,
+		Origins:                 []string{testOrigin},
+		RequireUserVerification: requireUV,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func newTestChallenge(t *testing.T) []byte {
+	challenge, err := NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return challenge
+}
+
+// register registers the credential of the authenticator, it must succeed
+func register(t *testing.T, w *WebAuthn, a *testAuthenticator) *Credential {
+	challenge := newTestChallenge(t)
+	credential, err := w.VerifyRegistration(challenge, a.create(t, defaultCeremony(challenge)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return credential
+}
+
+func TestRegistrationAndAssertion(t *testing.T) {
+	for _, alg := range []int64{AlgES256, AlgEdDSA} {
+		for _, format := range []string{"none", "packed"} {
+			w := newTestWebAuthn(t, true)
+			a := newTestAuthenticator(t, alg)
+
+			challenge := newTestChallenge(t)
+			c := defaultCeremony(challenge)
+			c.format = format
+			credential, err := w.VerifyRegistration(challenge, a.create(t, c))
+			if err != nil {
+				t.Fatalf("alg %d, %s: registration failed: %v", alg, format, err)
+			}
+			if !bytes.Equal(credential.ID, a.id) || !bytes.Equal(credential.PublicKey, a.coseKey) {
+				t.Fatalf("alg %d, %s: unexpected credential", alg, format)
+			}
+
+			a.signCount = 1
+			challenge = newTestChallenge(t)
+			signCount, err := w.VerifyAssertion(challenge, credential, a.get(t, defaultCeremony(challenge)))
+			if err != nil {
+				t.Fatalf("alg %d, %s: assertion failed: %v", alg, format, err)
+			}
+			if signCount != 1 {
+				t.Fatalf("alg %d, %s: expected sign count 1, got %d", alg, format, signCount)
+			}
+		}
+	}
+}
+
+func TestCeremonyMismatch(t *testing.T) {
+	w := newTestWebAuthn(t, true)
+	a := newTestAuthenticator(t, AlgES256)
+
+	cases := map[string]func(c *ceremony){
+		"challenge": func(c *ceremony) { c.challenge = []byte("other challenge") },
+		"origin":    func(c *ceremony) { c.origin = "https://evil.example.com" },
+		"rp id":     func(c *ceremony) { c.rpID = "evil.example.com" },
+		"up":        func(c *ceremony) { c.flags = flagUserVerified },
+		"uv":        func(c *ceremony) { c.flags = flagUserPresent },
+	}
+
+	for name, modify := range cases {
+		challenge := newTestChallenge(t)
+		c := defaultCeremony(challenge)
+		modify(&c)
+		_, err := w.VerifyRegistration(challenge, a.create(t, c))
+		if err == nil {
+			t.Errorf("%s mismatch: registration is accepted", name)
+		}
+	}
+
+	credential := register(t, w, a)
+	for name, modify := range cases {
+		a.signCount++
+		challenge := newTestChallenge(t)
+		c := defaultCeremony(challenge)
+		modify(&c)
+		_, err := w.VerifyAssertion(challenge, credential, a.get(t, c))
+		if err == nil {
+			t.Errorf("%s mismatch: assertion is accepted", name)
+		}
+	}
+}
+
+func TestUserVerificationNotRequired(t *testing.T) {
+	w := newTestWebAuthn(t, false)
+	a := newTestAuthenticator(t, AlgEdDSA)
+	credential := register(t, w, a)
+
+	challenge := newTestChallenge(t)
+	c := defaultCeremony(challenge)
+	c.flags = flagUserPresent
+	_, err := w.VerifyAssertion(challenge, credential, a.get(t, c))
+	if err != nil {
+		t.Fatalf("assertion without uv failed: %v", err)
+	}
+}
+
+func TestSignCount(t *testing.T) {
+	w := newTestWebAuthn(t, true)
+	a := newTestAuthenticator(t, AlgES256)
+	credential := register(t, w, a)
+
+	// authenticators without the counter always report zero
+	challenge := newTestChallenge(t)
+	_, err := w.VerifyAssertion(challenge, credential, a.get(t, defaultCeremony(challenge)))
+	if err != nil {
+		t.Fatalf("assertion with the zero counter failed: %v", err)
+	}
+
+	credential.SignCount = 5
+	for _, signCount := range []uint32{0, 4, 5} {
+		a.signCount = signCount
+		challenge = newTestChallenge(t)
+		_, err = w.VerifyAssertion(challenge, credential, a.get(t, defaultCeremony(challenge)))
+		if err != ErrSignCount {
+			t.Errorf("sign count %d after 5: expected ErrSignCount, got %v", signCount, err)
+		}
+	}
+
+	a.signCount = 6
+	challenge = newTestChallenge(t)
+	signCount, err := w.VerifyAssertion(challenge, credential, a.get(t, defaultCeremony(challenge)))
+	if err != nil || signCount != 6 {
+		t.Fatalf("sign count 6 after 5: got %d, %v", signCount, err)
+	}
+}
+
+func TestCBORTruncated(t *testing.T) {
+	data := cborEncode(cborMap{
+		{"fmt", "none"},
+		{"attStmt", cborMap{}},
+		{"authData", []byte{1, 2, 3, 4}},
+		{"list", []interface{}{1, -300, "text"}},
+	})
+
+	_, err := unmarshalCBORMap(data)
+	if err != nil {
+		t.Fatalf("valid cbor is rejected: %v", err)
+	}
+
+	for i := 0; i < len(data); i++ {
+		_, _, err = decodeCBOR(data[:i])
+		if err == nil {
+			t.Fatalf("cbor truncated to %d of %d bytes is accepted", i, len(data))
+		}
+	}
+
+	// lengths exceeding the data
+	for _, head := range [][]byte{{0x59, 0xff, 0xff}, {0x7a, 0xff, 0xff, 0xff, 0xff}, {0x9b, 0, 0, 0, 1, 0, 0, 0, 0}, {0xb9, 0xff, 0xff}} {
+		_, _, err = decodeCBOR(head)
+		if err != errCBORTruncated {
+			t.Errorf("head %x: expected errCBORTruncated, got %v", head, err)
+		}
+	}
+
+	w := newTestWebAuthn(t, true)
+	a := newTestAuthenticator(t, AlgES256)
+	challenge := newTestChallenge(t)
+	r := a.create(t, defaultCeremony(challenge))
+	r.Response.AttestationObject = r.Response.AttestationObject[:len(r.Response.AttestationObject)-1]
+	_, err = w.VerifyRegistration(challenge, r)
+	if err == nil {
+		t.Fatal("truncated attestation object is accepted")
+	}
+}
+
+func TestCBORDepth(t *testing.T) {
+	nested := func(depth int) []byte {
+		var value interface{} = 1
+		for i := 0; i < depth; i++ {
+			value = []interface{}{value}
+		}
+		return cborEncode(value)
+	}
+
+	_, _, err := decodeCBOR(nested(maxCBORDepth))
+	if err != nil {
+		t.Fatalf("cbor of the max depth is rejected: %v", err)
+	}
+
+	_, _, err = decodeCBOR(nested(maxCBORDepth + 1))
+	if err == nil {
+		t.Fatal("cbor deeper than the limit is accepted")
+	}
+
+	// the nesting far beyond the limit must not exhaust the stack
+	deep := bytes.Repeat([]byte{0x81}, 1000000)
+	_, _, err = decodeCBOR(append(deep, 0x01))
+	if err == nil {
+		t.Fatal("deeply nested cbor is accepted")
+	}
+}
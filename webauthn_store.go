@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"time"
+
+	"github.com/autowp/auth/webauthn"
+)
+
+// WebAuthn challenge purposes
+const (
+	webAuthnRegistration = "registration"
+	webAuthnLogin        = "login"
+)
+
+// WebAuthnCredential passkey of the user
+type WebAuthnCredential struct {
+	webauthn.Credential
+	UserID     int64
+	Name       string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+// WebAuthnStore registered credentials and the pending ceremony challenges
+type WebAuthnStore struct {
+	db     *sql.DB
+	ttl    time.Duration
+	logger *log.Logger
+	ticker *time.Ticker
+}
+
+// NewWebAuthnStore constructor
+func NewWebAuthnStore(db *sql.DB, challengeTTL time.Duration) *WebAuthnStore {
+	s := &WebAuthnStore{
+		db:     db,
+		ttl:    challengeTTL,
+		logger: log.New(os.Stderr, "[WEBAUTHN-PG-ERROR]", log.LstdFlags),
+		ticker: time.NewTicker(10 * time.Minute),
+	}
+	go s.gc()
+	return s
+}
+
+func (s *WebAuthnStore) gc() {
+	for range s.ticker.C {
+		_, err := s.db.Exec("DELETE FROM webauthn_challenges WHERE expires_at <= $1", time.Now())
+		if err != nil {
+			s.logger.Printf("Error while cleaning out outdated webauthn challenges: %+v", err)
+		}
+	}
+}
+
+// Close Close
+func (s *WebAuthnStore) Close() error {
+	s.ticker.Stop()
+	return nil
+}
+
+// PutChallenge stores the challenge of the ceremony, user is zero for the login
+func (s *WebAuthnStore) PutChallenge(id string, purpose string, userID int64, challenge []byte) error {
+	_, err := s.db.Exec(
+		"INSERT INTO webauthn_challenges (id, purpose, user_id, challenge, expires_at) VALUES ($1, $2, $3, $4, $5)",
+		id, purpose, userID, challenge, time.Now().Add(s.ttl),
+	)
+	return err
+}
+
+// ConsumeChallenge removes the challenge and returns it, nil when missing or expired
+func (s *WebAuthnStore) ConsumeChallenge(id string, purpose string, userID int64) ([]byte, error) {
+	var challenge []byte
+	err := s.db.QueryRow(`
+		DELETE FROM webauthn_challenges
+		WHERE id = $1 AND purpose = $2 AND user_id = $3 AND expires_at > $4
+		RETURNING challenge
+	`, id, purpose, userID, time.Now()).Scan(&challenge)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return challenge, nil
+}
+
+// Create stores the verified credential
+func (s *WebAuthnStore) Create(credential *WebAuthnCredential) error {
+	credential.CreatedAt = time.Now()
+	_, err := s.db.Exec(`
+		INSERT INTO webauthn_credentials (id, user_id, name, public_key, sign_count, aaguid, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`,
+		credential.ID, credential.UserID, credential.Name, credential.PublicKey, int64(credential.SignCount),
+		credential.AAGUID, credential.CreatedAt,
+	)
+	return err
+}
+
+func scanWebAuthnCredential(row interface{ Scan(...interface{}) error }) (*WebAuthnCredential, error) {
+	var credential WebAuthnCredential
+	var signCount int64
+	err := row.Scan(
+		&credential.ID, &credential.UserID, &credential.Name, &credential.PublicKey, &signCount,
+		&credential.AAGUID, &credential.CreatedAt, &credential.LastUsedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	credential.SignCount = uint32(signCount)
+
+	return &credential, nil
+}
+
+// GetByID returns the credential, nil when not found
+func (s *WebAuthnStore) GetByID(id []byte) (*WebAuthnCredential, error) {
+	credential, err := scanWebAuthnCredential(s.db.QueryRow(`
+		SELECT id, user_id, name, public_key, sign_count, aaguid, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE id = $1
+	`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return credential, err
+}
+
+// GetByUser lists the credentials of the user
+func (s *WebAuthnStore) GetByUser(userID int64) ([]*WebAuthnCredential, error) {
+	rows, err := s.db.Query(`
+		SELECT id, user_id, name, public_key, sign_count, aaguid, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE user_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer Close(rows)
+
+	credentials := make([]*WebAuthnCredential, 0)
+	for rows.Next() {
+		credential, err := scanWebAuthnCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, credential)
+	}
+
+	return credentials, rows.Err()
+}
+
+// UpdateSignCount stores the counter of the successful assertion.
+// Fails when the concurrent assertion has already stored the counter
+func (s *WebAuthnStore) UpdateSignCount(credential *WebAuthnCredential, signCount uint32) (bool, error) {
+	res, err := s.db.Exec(`
+		UPDATE webauthn_credentials SET sign_count = $1, last_used_at = $2
+		WHERE id = $3 AND sign_count = $4
+	`, int64(signCount), time.Now(), credential.ID, int64(credential.SignCount))
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+// Delete removes the credential of the user
+func (s *WebAuthnStore) Delete(userID int64, id []byte) (bool, error) {
+	res, err := s.db.Exec("DELETE FROM webauthn_credentials WHERE user_id = $1 AND id = $2", userID, id)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}